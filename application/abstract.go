@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"path/filepath"
 	"sync"
 	"time"
 
@@ -49,11 +50,18 @@ type Abstract struct {
 	events       chan *common.ApplicationEvent
 	eventsClosed bool
 
+	// события обрабатываются в отдельных рутинах, переконфигурации и остановка применяются по очереди,
+	// чтобы сервисы не останавливались и не запускались одновременно из нескольких рутин
+	applyMutex sync.Mutex
+
 	// флаг, сигнализирующий окончание работы приложения
 	done       chan bool
 	doneClosed bool
 
 	CommonTimeout common.Timeout `yaml:"timeouts"`
+
+	// параметры, которыми собираются настройки, разбираются, чтобы попасть в схему настроек
+	configLayout `yaml:",inline"`
 }
 
 type ConfigMeta struct {
@@ -71,6 +79,12 @@ type ConfigMeta struct {
 	// config data
 	configData []byte
 
+	// части настроек из основного и включаемых файлов, используются для проверки настроек
+	configParts []configPart
+
+	// отпечаток настроек, по нему определяется, изменились ли настройки
+	configHash string
+
 	// warning error
 	configWarning error
 
@@ -79,6 +93,22 @@ type ConfigMeta struct {
 
 	client *http.Client
 
+	// параметры получения настроек по сети
+	remoteOptions common.RemoteConfigOptions
+
+	// проверяет подпись настроек, полученных по сети
+	remoteVerifier signatureVerifier
+
+	// последние полученные по сети настройки и их ETag, используются, если настройки не изменились
+	remoteData []byte
+	remoteETag string
+
+	// следит за изменениями файлов настроек
+	watcher *configWatcher
+
+	// не дает перечитывать настройки одновременно по таймеру, сигналу и изменению файлов
+	reloadMutex sync.Mutex
+
 	rwm sync.RWMutex
 }
 
@@ -94,13 +124,23 @@ func (a *Abstract) run(app common.Application, event *common.ApplicationEvent) {
 	defer app.CloseEvents()
 
 	app.OnEvent(func(ev *common.ApplicationEvent) {
+		if ev.Kind == common.ReconfigureApplicationEventKind || ev.Kind == common.FinishApplicationEventKind {
+			a.applyMutex.Lock()
+			defer a.applyMutex.Unlock()
+		}
+
 		action := actions[ev.Kind]
 
 		if preAction, ok := action.(PreFireAction); ok {
 			preAction.PreFire(app, ev)
 		}
 
-		for _, service := range app.Services() {
+		services := app.Services()
+		if ev.Kind == common.FinishApplicationEventKind {
+			// останавливаем сервисы в обратном порядке, чтобы сервис останавливался после сервисов, которые его используют
+			services = reverseServices(services)
+		}
+		for _, service := range services {
 			action.Fire(app, ev, service)
 		}
 
@@ -121,8 +161,7 @@ func (a *Abstract) InitConfig() {
 	if a.configMeta.configUpdateTimer != nil {
 		go func() {
 			for range a.configMeta.configUpdateTimer.C {
-				a.collectConfigData()
-				a.SendEvents(common.NewApplicationEvent(common.ReconfigureApplicationEventKind))
+				a.Reload(common.ReloadByTimer)
 			}
 		}()
 	}
@@ -132,13 +171,23 @@ func (a *Abstract) collectConfigData() {
 	ctx, cancel := context.WithTimeout(context.Background(), httpTimeout*2)
 	defer cancel()
 
+	a.configMeta.rwm.Lock()
 	a.configMeta.configData = nil
+	a.configMeta.configParts = nil
+	a.configMeta.configWarning = nil
+	a.configMeta.configError = nil
+	a.configMeta.rwm.Unlock()
 
 	if err := a.getRemoteConfigData(ctx); err != nil {
 		a.configMeta.configWarning = err
 	}
 
+	// настройкам, полученным по сети, доверяем, только если проверяется их подпись
+	source := a.configMeta.configRemoteAddr
+	trusted := a.configMeta.remoteVerifier != nil
 	if a.configMeta.configData == nil {
+		source = a.configMeta.configFilename
+		trusted = true
 		if err := a.getLocalConfigData(ctx); err != nil {
 			if a.configMeta.configWarning != nil {
 				err = fmt.Errorf("remote err %s; loal error %w", a.configMeta.configWarning, err)
@@ -147,37 +196,27 @@ func (a *Abstract) collectConfigData() {
 		}
 	}
 
+	a.configMeta.rwm.Lock()
+	defer a.configMeta.rwm.Unlock()
 	if a.configMeta.configData == nil {
 		a.configMeta.configError = fmt.Errorf("config file is empty")
+		return
 	}
-}
 
-func (a *Abstract) getRemoteConfigData(ctx context.Context) error {
-	if a.configMeta.client != nil && a.configMeta.configRemoteAddr != "" {
-		req, err := http.NewRequestWithContext(ctx, "GET", a.configMeta.configRemoteAddr, nil)
-		if err != nil {
-			return fmt.Errorf("create http request error %w", err)
-		}
-
-		resp, err := a.configMeta.client.Do(req)
-		if err != nil {
-			return fmt.Errorf("http client request error %w", err)
-		}
-		defer func() { _ = resp.Body.Close() }()
-
-		cfg, err := ioutil.ReadAll(resp.Body)
-		if err != nil {
-			return fmt.Errorf("can't read config body %w", err)
-		}
-		if cfg != nil && len(cfg) > 0 {
-			a.configMeta.rwm.Lock()
-			defer a.configMeta.rwm.Unlock()
-			a.configMeta.configData = cfg
-			return nil
-		}
+	// отпечаток считается по собранным настройкам после подстановки,
+	// чтобы изменение включаемых файлов, каталога доменов и секретов приводило к переконфигурации
+	data, parts, err := assembleConfig(a.configMeta.configData, source, filepath.Dir(a.configMeta.configFilename), trusted)
+	a.configMeta.configData = data
+	a.configMeta.configParts = parts
+	if err != nil {
+		a.configMeta.configError = err
+		return
 	}
-
-	return nil
+	if data == nil {
+		a.configMeta.configError = fmt.Errorf("config file is empty")
+		return
+	}
+	a.configMeta.configHash = common.FingerprintBytes(a.configMeta.configData)
 }
 
 func (a *Abstract) getLocalConfigData(_ context.Context) error {
@@ -265,7 +304,12 @@ func (a *Abstract) Close() {
 	if !a.doneClosed {
 		a.doneClosed = true
 		close(a.done)
-		a.configMeta.configUpdateTimer.Stop()
+		if a.configMeta.configUpdateTimer != nil {
+			a.configMeta.configUpdateTimer.Stop()
+		}
+		if a.configMeta.watcher != nil {
+			a.configMeta.watcher.close()
+		}
 	}
 }
 
@@ -309,7 +353,7 @@ func (i InitFireAction) Fire(app common.Application, event *common.ApplicationEv
 func (i InitFireAction) PreFire(app common.Application, event *common.ApplicationEvent) {
 	bytes, warn, err := app.GetConfigData()
 	if warn != nil {
-		logger.All().WarnWithErr(err, "application configuration read warning")
+		logger.All().WarnWithErr(warn, "application configuration read warning")
 	}
 
 	if err != nil {
@@ -338,19 +382,74 @@ func (f FinishFireAction) Fire(app common.Application, event *common.Application
 	app.FireFinish(event, abstractService)
 }
 
+func (f FinishFireAction) PreFire(app common.Application, event *common.ApplicationEvent) {
+	drain(app, true)
+}
+
 func (f FinishFireAction) PostFire(app common.Application, event *common.ApplicationEvent) {
-	time.Sleep(2 * time.Second)
 	app.Close()
 }
 
 type ReconfigureFireAction func(*Abstract, *common.ApplicationEvent, interface{})
 
+// Fire применяет новые настройки к сервису
+// сервис, умеющий применять настройки на лету, сам меняет только изменившиеся настройки,
+// остальные сервисы останавливаются и запускаются заново с новыми настройками
 func (r ReconfigureFireAction) Fire(app common.Application, event *common.ApplicationEvent, abstractService interface{}) {
+	// настройки не удалось прочитать, сервисы продолжают работать с текущими настройками
+	if event.Data == nil {
+		return
+	}
+
+	if service, ok := abstractService.(common.ReconfiguringService); ok {
+		service.OnReconfigure(event)
+		return
+	}
+
 	app.FireFinish(event, abstractService)
+	app.FireInit(event, abstractService)
+	app.FireRun(event, abstractService)
 }
 
-func (r ReconfigureFireAction) PostFire(app common.Application, event *common.ApplicationEvent) {
-	time.Sleep(2 * time.Second)
-	event.Kind = common.InitApplicationEventKind
-	app.SendEvents(event)
+func (r ReconfigureFireAction) PreFire(app common.Application, event *common.ApplicationEvent) {
+	bytes, _, err := app.GetConfigData()
+	if err != nil {
+		logger.All().WarnWithErr(err, "application can't read configuration file, current configuration is used")
+		return
+	}
+
+	event.Data = bytes
+	app.Init(event, true)
+	drain(app, false)
+}
+
+// перестает получать письма и дожидается отправки уже полученных писем, но не дольше timeouts.drain
+// при переконфигурации сервисы, применяющие настройки на лету, продолжают получать письма
+func drain(app common.Application, all bool) {
+	ctx, cancel := context.WithTimeout(context.Background(), app.Timeout().Drain)
+	defer cancel()
+
+	group := new(sync.WaitGroup)
+	for _, service := range app.Services() {
+		if _, ok := service.(common.ReconfiguringService); ok && !all {
+			continue
+		}
+		if drainingService, ok := service.(common.DrainingService); ok {
+			group.Add(1)
+			go func(drainingService common.DrainingService) {
+				defer group.Done()
+				drainingService.OnDrain(ctx)
+			}(drainingService)
+		}
+	}
+	group.Wait()
+}
+
+// отдает сервисы в обратном порядке
+func reverseServices(services []interface{}) []interface{} {
+	reversed := make([]interface{}, len(services))
+	for i, service := range services {
+		reversed[len(services)-1-i] = service
+	}
+	return reversed
 }
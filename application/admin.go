@@ -0,0 +1,67 @@
+package application
+
+import (
+	"net/http"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/Halfi/postmanq/common"
+)
+
+// заменяет секреты в настройках, отдаваемых api администрирования
+const redacted = "******"
+
+// регистрирует обработчики api администрирования приложения
+func (a *Abstract) registerAdminHandlers() {
+	common.RegisterAdminHandler(http.MethodGet, "/postmans", a.adminPostmans)
+	common.RegisterAdminHandler(http.MethodPost, "/reload", a.adminReload)
+}
+
+// отдает настройки доменов, с которых рассылаются письма, без секретов
+// параметр postman выбирает один домен
+func (a *Abstract) adminPostmans(r *http.Request) (interface{}, error) {
+	data, _, _ := a.GetConfigData()
+	config := new(struct {
+		Postmans map[string]map[string]interface{} `yaml:"postmans"`
+	})
+	if err := yaml.Unmarshal(data, config); err != nil {
+		return nil, err
+	}
+
+	for _, postman := range config.Postmans {
+		redactPostman(postman)
+	}
+
+	if name := r.URL.Query().Get("postman"); name != common.EmptyStr {
+		postman, ok := config.Postmans[name]
+		if !ok {
+			return nil, common.NewAdminError(http.StatusNotFound, "postman %s isn't found", name)
+		}
+		return map[string]map[string]interface{}{name: postman}, nil
+	}
+	return config.Postmans, nil
+}
+
+// заменяет закрытые ключи и сертификаты, заданные в формате PEM, и пароль релея
+func redactPostman(postman map[string]interface{}) {
+	for _, key := range []string{"privateKey", "certificate"} {
+		if value, ok := postman[key].(string); ok {
+			postman[key] = common.PEMSource(value)
+		}
+	}
+	if relay, ok := postman["relay"].(map[string]interface{}); ok {
+		if _, ok := relay["password"]; ok {
+			relay["password"] = redacted
+		}
+	}
+}
+
+// перечитывает настройки и отдает результат перечитывания
+func (a *Abstract) adminReload(_ *http.Request) (interface{}, error) {
+	a.Reload(common.ReloadByAPI)
+	status := common.LastReloadStatus()
+	if status == nil {
+		return nil, common.NewAdminError(http.StatusServiceUnavailable, "configuration isn't loaded yet")
+	}
+	return status, nil
+}
@@ -0,0 +1,114 @@
+package application
+
+import (
+	"fmt"
+	"os"
+	"sort"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/Halfi/postmanq/common"
+)
+
+// Check приложение, проверяющее настройки без запуска сервисов
+type Check struct {
+	Post
+}
+
+// NewCheck создает приложение, проверяющее настройки
+func NewCheck() common.Application {
+	return new(Check)
+}
+
+// Run проверяет настройки и печатает все найденные проблемы
+// если проблемы найдены, приложение завершается с кодом 1
+func (c *Check) Run() {
+	common.App = c
+	c.services = append(newPostServices(), newSendingServices()...)
+
+	c.collectConfigData()
+	data, _, err := c.GetConfigData()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	c.configMeta.rwm.RLock()
+	parts := c.configMeta.configParts
+	c.configMeta.rwm.RUnlock()
+
+	problems, _ := c.checkConfig(parts, data, false)
+	if len(problems) == 0 {
+		fmt.Println("configuration is valid")
+		return
+	}
+
+	for _, problem := range problems {
+		fmt.Println(problem)
+	}
+	fmt.Printf("found %d problems\n", len(problems))
+	os.Exit(1)
+}
+
+// проверяет настройки каждым сервисом, одинаковые проблемы, найденные несколькими сервисами, выводятся один раз
+// неизвестные параметры ищутся в каждом файле настроек отдельно, чтобы номера строк совпадали с файлом
+// используется командой проверки настроек и при перечитывании настроек
+// при перечитывании настройки проверяются без обращений к сети, а неизвестные параметры отдаются предупреждениями,
+// чтобы устаревшие параметры не мешали применить настройки работающему приложению
+func (a *Abstract) checkConfig(parts []configPart, data []byte, reloading bool) ([]string, []string) {
+	schema := NewConfigSchema()
+	errs := make([]error, 0)
+	warns := make([]error, 0)
+	for _, part := range parts {
+		for _, err := range schema.Validate(part.node, part.path...) {
+			// проблемы основного файла выводятся без имени файла
+			if !part.main {
+				err = fmt.Errorf("%s: %w", part.source, err)
+			}
+			if reloading {
+				warns = append(warns, err)
+			} else {
+				errs = append(errs, err)
+			}
+		}
+	}
+
+	post := new(Post)
+	if err := yaml.Unmarshal(data, post); err != nil {
+		errs = append(errs, err)
+	} else if post.Workers < 0 {
+		errs = append(errs, common.NewConfigError("workers", "workers shouldn't be negative"))
+	}
+
+	event := common.NewApplicationEvent(common.InitApplicationEventKind)
+	event.Data = data
+	event.Args = map[string]interface{}{common.OfflineCheckArg: reloading}
+	for _, service := range a.services {
+		if checkingService, ok := service.(common.CheckingService); ok {
+			errs = append(errs, checkingService.OnCheck(event)...)
+		}
+	}
+
+	return uniqueProblems(errs), uniqueProblems(warns)
+}
+
+// отдает отсортированные тексты проблем без повторов
+func uniqueProblems(errs []error) []string {
+	unique := make(map[string]bool, len(errs))
+	problems := make([]string, 0, len(errs))
+	for _, err := range errs {
+		problem := err.Error()
+		if !unique[problem] {
+			unique[problem] = true
+			problems = append(problems, problem)
+		}
+	}
+	sort.Strings(problems)
+	return problems
+}
+
+// NewConfigSchema создает json схему настроек приложения, отправляющего письма
+func NewConfigSchema() *common.Schema {
+	services := append([]interface{}{new(Post)}, newPostServices()...)
+	return common.NewSchema(append(services, newSendingServices()...)...)
+}
@@ -0,0 +1,263 @@
+package application
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/Halfi/postmanq/common"
+)
+
+const (
+	// каталог с настройками доменов по умолчанию, ищется рядом с файлом настроек
+	defaultPostmansDir = "postmans.d"
+
+	// раздел настроек доменов
+	postmansKey = "postmans"
+)
+
+// расширения файлов с настройками доменов
+var postmanExtensions = []string{".yaml", ".yml"}
+
+// часть настроек, прочитанная из отдельного файла
+type configPart struct {
+	// имя файла или адрес, с которого получены настройки
+	source string
+
+	// путь к разделу настроек, в который добавлена часть, пустой для корня настроек
+	path []string
+
+	node *yaml.Node
+
+	// признак основного файла настроек
+	main bool
+}
+
+// параметры, которыми собираются настройки
+type configLayout struct {
+	// Include файлы, добавляемые в настройки
+	Include []string `yaml:"include"`
+
+	// PostmansDir каталог с настройками доменов, каждый файл задает один домен
+	PostmansDir string `yaml:"postmansDir"`
+}
+
+// собирает настройки из основного файла, включаемых файлов и каталога с настройками доменов
+// включаемые файлы и каталог ищутся относительно baseDir, в каждой части настроек подставляются значения
+// переменных окружения и файлов, части отдаются для поиска неизвестных параметров
+// если основные настройки получены из ненадежного источника, подстановки запрещены и во включаемых файлах,
+// и в каталоге доменов: иначе основные настройки могли бы включить локальный файл с секретом и заменить адрес, куда он передается
+func assembleConfig(data []byte, source, baseDir string, trusted bool) ([]byte, []configPart, error) {
+	main, err := parseConfigPart(data, source, trusted)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	layout := new(configLayout)
+	if err := main.Decode(layout); err != nil {
+		return nil, nil, fmt.Errorf("%s: %w", source, err)
+	}
+
+	root := newMappingNode()
+	parts := make([]configPart, 0)
+	for _, pattern := range layout.Include {
+		filenames, err := globConfigFiles(resolvePath(baseDir, pattern))
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: include %s: %w", source, pattern, err)
+		}
+
+		for _, filename := range filenames {
+			node, err := readConfigPart(filename, trusted)
+			if err != nil {
+				return nil, nil, err
+			}
+			if mappingValue(node, "include") != nil {
+				return nil, nil, fmt.Errorf("%s: nested include isn't supported", filename)
+			}
+			mergeNodes(root, node)
+			parts = append(parts, configPart{source: filename, node: node})
+		}
+	}
+
+	// основной файл переопределяет параметры включаемых файлов
+	mergeNodes(root, main)
+	parts = append(parts, configPart{source: source, node: main, main: true})
+
+	postmanParts, err := readPostmansDir(root, layout.PostmansDir, baseDir, trusted)
+	if err != nil {
+		return nil, nil, err
+	}
+	parts = append(parts, postmanParts...)
+
+	if len(root.Content) == 0 {
+		return nil, parts, nil
+	}
+	out, err := yaml.Marshal(root)
+	if err != nil {
+		return nil, nil, err
+	}
+	return out, parts, nil
+}
+
+// добавляет в раздел postmans домены из каталога, имя файла без расширения используется как имя домена
+// каталог по умолчанию может отсутствовать, явно указанный каталог должен существовать
+func readPostmansDir(root *yaml.Node, dir, baseDir string, trusted bool) ([]configPart, error) {
+	explicit := dir != common.EmptyStr
+	if !explicit {
+		dir = defaultPostmansDir
+	}
+	dir = resolvePath(baseDir, dir)
+
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) && !explicit {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("can't read postmans dir %s: %w", dir, err)
+	}
+
+	parts := make([]configPart, 0, len(entries))
+	for _, entry := range entries {
+		domain, ok := postmanDomain(entry)
+		if !ok {
+			continue
+		}
+
+		filename := filepath.Join(dir, entry.Name())
+		node, err := readConfigPart(filename, trusted)
+		if err != nil {
+			return nil, err
+		}
+
+		postmans := mappingValue(root, postmansKey)
+		if postmans == nil {
+			postmans = newMappingNode()
+			root.Content = append(root.Content, newStringNode(postmansKey), postmans)
+		}
+		if postmans.Kind != yaml.MappingNode {
+			return nil, fmt.Errorf("%s: %s should be a mapping", filename, postmansKey)
+		}
+		if mappingValue(postmans, domain) != nil {
+			return nil, fmt.Errorf("%s: domain %s is already defined in %s", filename, domain, postmansKey)
+		}
+
+		postmans.Content = append(postmans.Content, newStringNode(domain), node)
+		parts = append(parts, configPart{source: filename, path: []string{postmansKey, domain}, node: node})
+	}
+	return parts, nil
+}
+
+// отдает имя домена по имени файла из каталога доменов
+func postmanDomain(entry os.FileInfo) (string, bool) {
+	if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+		return common.EmptyStr, false
+	}
+	for _, extension := range postmanExtensions {
+		if strings.HasSuffix(entry.Name(), extension) {
+			return strings.TrimSuffix(entry.Name(), extension), true
+		}
+	}
+	return common.EmptyStr, false
+}
+
+// отдает отсортированные файлы, подходящие под шаблон, файл без символов шаблона должен существовать
+func globConfigFiles(pattern string) ([]string, error) {
+	filenames, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, err
+	}
+	if len(filenames) == 0 && !strings.ContainsAny(pattern, "*?[") {
+		return nil, fmt.Errorf("file %s doesn't exist", pattern)
+	}
+	sort.Strings(filenames)
+	return filenames, nil
+}
+
+// читает файл с частью настроек
+func readConfigPart(filename string, trusted bool) (*yaml.Node, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("can't read file %s: %w", filename, err)
+	}
+	return parseConfigPart(data, filename, trusted)
+}
+
+// разбирает часть настроек и подставляет в нее значения, пустая часть считается пустым разделом
+func parseConfigPart(data []byte, source string, trusted bool) (*yaml.Node, error) {
+	document := new(yaml.Node)
+	if err := yaml.Unmarshal(data, document); err != nil {
+		return nil, fmt.Errorf("%s: %w", source, err)
+	}
+	if len(document.Content) == 0 {
+		return newMappingNode(), nil
+	}
+
+	node := document.Content[0]
+	if node.Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("%s: config should be a mapping", source)
+	}
+	if err := common.InterpolateNode(node, trusted); err != nil {
+		return nil, fmt.Errorf("%s: %w", source, err)
+	}
+	return node, nil
+}
+
+// добавляет параметры src в dst, разделы объединяются рекурсивно, остальные значения src заменяют значения dst
+// в dst добавляются копии узлов, чтобы части настроек оставались без изменений
+func mergeNodes(dst, src *yaml.Node) {
+	for i := 0; i+1 < len(src.Content); i += 2 {
+		key, value := src.Content[i], src.Content[i+1]
+		current := mappingValue(dst, key.Value)
+		switch {
+		case current == nil:
+			dst.Content = append(dst.Content, copyNode(key), copyNode(value))
+		case current.Kind == yaml.MappingNode && value.Kind == yaml.MappingNode:
+			mergeNodes(current, value)
+		default:
+			*current = *copyNode(value)
+		}
+	}
+}
+
+// копирует узел со всеми вложенными узлами
+func copyNode(node *yaml.Node) *yaml.Node {
+	clone := *node
+	if node.Content != nil {
+		clone.Content = make([]*yaml.Node, len(node.Content))
+		for i, content := range node.Content {
+			clone.Content[i] = copyNode(content)
+		}
+	}
+	return &clone
+}
+
+// отдает значение параметра раздела
+func mappingValue(node *yaml.Node, key string) *yaml.Node {
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return node.Content[i+1]
+		}
+	}
+	return nil
+}
+
+func newMappingNode() *yaml.Node {
+	return &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+}
+
+func newStringNode(value string) *yaml.Node {
+	return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: value}
+}
+
+// отдает путь относительно каталога
+func resolvePath(baseDir, path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(baseDir, path)
+}
@@ -1,6 +1,7 @@
 package application
 
 import (
+	"context"
 	"runtime"
 
 	"gopkg.in/yaml.v3"
@@ -12,12 +13,13 @@ import (
 	"github.com/Halfi/postmanq/limiter"
 	"github.com/Halfi/postmanq/logger"
 	"github.com/Halfi/postmanq/mailer"
+	"github.com/Halfi/postmanq/storage"
 	"github.com/Halfi/postmanq/webservice"
 )
 
 // Post приложение, рассылающее письма
 type Post struct {
-	Abstract
+	Abstract `yaml:",inline"`
 
 	// Workers количество отправителей
 	Workers int `yaml:"workers"`
@@ -31,20 +33,41 @@ func NewPost() common.Application {
 // Run запускает приложение
 func (p *Post) Run() {
 	common.App = p
-	common.Services = []interface{}{
+	common.Services = newSendingServices()
+	p.services = append(newPostServices(), common.Services...)
+
+	p.run(p, common.NewApplicationEvent(common.InitApplicationEventKind))
+}
+
+// InitConfig читает настройки, начинает следить за изменениями файлов настроек,
+// регистрирует api администрирования и проверку зависания отправки писем
+func (p *Post) InitConfig() {
+	p.Abstract.InitConfig()
+	p.watchConfig()
+	p.registerAdminHandlers()
+	common.RegisterHealthCheck("pipeline", common.LivenessProbe, func(_ context.Context) error {
+		return common.CheckEventChannels(p.Timeout().Blocked)
+	})
+}
+
+// создает сервисы, через которые письмо проходит при отправке
+func newSendingServices() []interface{} {
+	return []interface{}{
 		guardian.Inst(),
 		limiter.Inst(),
 		connector.Inst(),
 		mailer.Inst(),
 	}
+}
 
-	p.services = append([]interface{}{
+// создает сервисы, которые работают до сервисов отправки
+func newPostServices() []interface{} {
+	return []interface{}{
 		logger.Inst(),
+		storage.Inst(),
 		webservice.Inst(),
 		consumer.Inst(),
-	}, common.Services...)
-
-	p.run(p, common.NewApplicationEvent(common.InitApplicationEventKind))
+	}
 }
 
 // Init инициализирует приложение
@@ -73,7 +96,8 @@ func (p *Post) FireRun(event *common.ApplicationEvent, abstractService interface
 }
 
 // FireFinish останавливает сервисы приложения
+// сервисы останавливаются по очереди, чтобы сервис не получал события от уже остановленных сервисов
 func (p *Post) FireFinish(event *common.ApplicationEvent, abstractService interface{}) {
 	service := abstractService.(common.SendingService)
-	go service.OnFinish()
+	service.OnFinish()
 }
@@ -0,0 +1,147 @@
+package application
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/Halfi/postmanq/common"
+	"github.com/Halfi/postmanq/logger"
+)
+
+// глубина, до которой сравниваются разделы настроек при поиске изменений, например postmans.example.com
+const diffDepth = 2
+
+// состояние настроек, восстанавливается, если новые настройки не удалось применить
+type configSnapshot struct {
+	data  []byte
+	parts []configPart
+	hash  string
+}
+
+// Reload перечитывает настройки и, если они изменились и прошли проверку, переконфигурирует приложение
+// если настройки не удалось прочитать или они не прошли проверку, приложение продолжает работать с текущими настройками
+// результат перечитывания пишется в лог и отдается веб сервисом
+func (a *Abstract) Reload(trigger string) {
+	a.configMeta.reloadMutex.Lock()
+	defer a.configMeta.reloadMutex.Unlock()
+
+	a.configMeta.rwm.RLock()
+	previous := configSnapshot{
+		data:  a.configMeta.configData,
+		parts: a.configMeta.configParts,
+		hash:  a.configMeta.configHash,
+	}
+	a.configMeta.rwm.RUnlock()
+	// приложение еще не прочитало настройки при запуске
+	if previous.hash == common.EmptyStr {
+		logger.All().Debug("application configuration isn't loaded yet, %s reload is skipped", trigger)
+		return
+	}
+
+	status := a.reload(previous)
+	a.updateWatches()
+	status.Time = time.Now()
+	status.Trigger = trigger
+	common.SetReloadStatus(status)
+
+	if len(status.Warnings) > 0 {
+		logger.All().Warn("application configuration has problems, they don't prevent reload: %s", strings.Join(status.Warnings, "; "))
+	}
+	switch status.Result {
+	case common.ReloadApplied:
+		logger.All().Info("application configuration is reloaded by %s, changes: %s", trigger, strings.Join(status.Changes, ", "))
+		a.SendEvents(common.NewApplicationEvent(common.ReconfigureApplicationEventKind))
+	case common.ReloadUnchanged:
+		logger.All().Debug("application configuration isn't changed")
+	default:
+		logger.All().Warn("application can't reload configuration by %s, current configuration is used: %s", trigger, strings.Join(status.Errors, "; "))
+	}
+}
+
+// перечитывает и проверяет настройки
+func (a *Abstract) reload(previous configSnapshot) common.ReloadStatus {
+	a.collectConfigData()
+	data, warn, err := a.GetConfigData()
+	if warn != nil {
+		logger.All().WarnWithErr(warn, "application configuration read warning")
+	}
+	if err != nil {
+		a.restoreConfig(previous)
+		return common.ReloadStatus{Result: common.ReloadFailed, Errors: []string{err.Error()}}
+	}
+
+	a.configMeta.rwm.RLock()
+	parts, hash := a.configMeta.configParts, a.configMeta.configHash
+	a.configMeta.rwm.RUnlock()
+	if hash == previous.hash {
+		return common.ReloadStatus{Result: common.ReloadUnchanged}
+	}
+
+	problems, warnings := a.checkConfig(parts, data, true)
+	if len(problems) > 0 {
+		a.restoreConfig(previous)
+		return common.ReloadStatus{Result: common.ReloadRejected, Errors: problems, Warnings: warnings}
+	}
+
+	return common.ReloadStatus{Result: common.ReloadApplied, Changes: diffConfig(previous.data, data), Warnings: warnings}
+}
+
+// восстанавливает текущие настройки, чтобы следующее перечитывание сравнивало настройки с примененными
+func (a *Abstract) restoreConfig(previous configSnapshot) {
+	a.configMeta.rwm.Lock()
+	defer a.configMeta.rwm.Unlock()
+	a.configMeta.configData = previous.data
+	a.configMeta.configParts = previous.parts
+	a.configMeta.configHash = previous.hash
+	a.configMeta.configError = nil
+}
+
+// отдает измененные параметры и разделы настроек, разделы сравниваются по вложенным параметрам до глубины diffDepth
+func diffConfig(previous, current []byte) []string {
+	var previousValues, currentValues map[string]interface{}
+	_ = yaml.Unmarshal(previous, &previousValues)
+	_ = yaml.Unmarshal(current, &currentValues)
+
+	changes := make([]string, 0)
+	diffValues(previousValues, currentValues, common.EmptyStr, diffDepth, &changes)
+	sort.Strings(changes)
+	return changes
+}
+
+func diffValues(previous, current map[string]interface{}, prefix string, depth int, changes *[]string) {
+	path := func(key string) string {
+		if prefix == common.EmptyStr {
+			return key
+		}
+		return fmt.Sprintf("%s.%s", prefix, key)
+	}
+
+	for key, value := range current {
+		old, ok := previous[key]
+		if !ok {
+			*changes = append(*changes, path(key)+" added")
+			continue
+		}
+		if common.Fingerprint(old) == common.Fingerprint(value) {
+			continue
+		}
+
+		oldSection, oldOk := old.(map[string]interface{})
+		section, ok := value.(map[string]interface{})
+		if depth > 1 && oldOk && ok {
+			diffValues(oldSection, section, path(key), depth-1, changes)
+		} else {
+			*changes = append(*changes, path(key)+" changed")
+		}
+	}
+
+	for key := range previous {
+		if _, ok := current[key]; !ok {
+			*changes = append(*changes, path(key)+" removed")
+		}
+	}
+}
@@ -0,0 +1,282 @@
+package application
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/Halfi/postmanq/common"
+)
+
+// суффикс адреса подписи настроек по умолчанию
+const signatureSuffix = ".sig"
+
+var (
+	// ErrInvalidSignature подпись настроек, полученных по сети, не совпадает с настройками
+	ErrInvalidSignature = errors.New("remote config signature is invalid")
+)
+
+// проверяет подпись настроек
+type signatureVerifier func(data, signature []byte) error
+
+// SetRemoteConfigOptions устанавливает параметры получения настроек по сети
+func (a *Abstract) SetRemoteConfigOptions(options common.RemoteConfigOptions) error {
+	a.configMeta.remoteOptions = options
+	if a.configMeta.configRemoteAddr == common.EmptyStr {
+		return nil
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if options.CAFile != common.EmptyStr || options.CertFile != common.EmptyStr {
+		tlsConfig, err := newRemoteTLSConfig(options)
+		if err != nil {
+			return err
+		}
+		transport.TLSClientConfig = tlsConfig
+	}
+	a.configMeta.client = &http.Client{Transport: transport, Timeout: httpTimeout}
+
+	a.configMeta.remoteVerifier = nil
+	if options.PublicKey != common.EmptyStr {
+		verifier, err := newSignatureVerifier(options.PublicKey)
+		if err != nil {
+			return err
+		}
+		a.configMeta.remoteVerifier = verifier
+	}
+	return nil
+}
+
+// получает настройки по сети, если сервер настроек недоступен, используются последние полученные настройки из кэша
+// ошибка означает, что настройки получены из кэша или не получены вовсе
+func (a *Abstract) getRemoteConfigData(ctx context.Context) error {
+	if a.configMeta.client == nil || a.configMeta.configRemoteAddr == common.EmptyStr {
+		return nil
+	}
+
+	cfg, err := a.fetchRemoteConfig(ctx)
+	if err == nil {
+		a.configMeta.rwm.Lock()
+		defer a.configMeta.rwm.Unlock()
+		a.configMeta.configData = cfg
+		return nil
+	}
+
+	cacheFile := a.configMeta.remoteOptions.CacheFile
+	if cacheFile == common.EmptyStr {
+		return err
+	}
+	cfg, cacheErr := ioutil.ReadFile(cacheFile)
+	if cacheErr != nil || len(cfg) == 0 {
+		return fmt.Errorf("%w; can't read cached config %s: %v", err, cacheFile, cacheErr)
+	}
+
+	a.configMeta.rwm.Lock()
+	defer a.configMeta.rwm.Unlock()
+	a.configMeta.configData = cfg
+	return fmt.Errorf("cached config %s is used: %w", cacheFile, err)
+}
+
+// получает настройки по сети, если сервер ответил, что настройки не изменились, отдаются последние полученные настройки
+func (a *Abstract) fetchRemoteConfig(ctx context.Context) ([]byte, error) {
+	etag := a.configMeta.remoteETag
+	if a.configMeta.remoteData == nil {
+		etag = common.EmptyStr
+	}
+
+	cfg, newETag, err := a.fetch(ctx, a.configMeta.configRemoteAddr, etag)
+	if err != nil {
+		return nil, err
+	}
+	// настройки не изменились и уже проверены
+	if cfg == nil {
+		return a.configMeta.remoteData, nil
+	}
+
+	if a.configMeta.remoteVerifier != nil {
+		signatureURL := a.configMeta.remoteOptions.SignatureURL
+		if signatureURL == common.EmptyStr {
+			signatureURL = a.configMeta.configRemoteAddr + signatureSuffix
+		}
+		signature, _, err := a.fetch(ctx, signatureURL, common.EmptyStr)
+		if err != nil {
+			return nil, fmt.Errorf("can't get remote config signature: %w", err)
+		}
+		if err := a.configMeta.remoteVerifier(cfg, decodeSignature(signature)); err != nil {
+			return nil, err
+		}
+	}
+
+	a.configMeta.remoteData = cfg
+	a.configMeta.remoteETag = newETag
+	if cacheFile := a.configMeta.remoteOptions.CacheFile; cacheFile != common.EmptyStr {
+		if err := writeFileAtomic(cacheFile, cfg); err != nil {
+			return nil, fmt.Errorf("can't write cached config %s: %w", cacheFile, err)
+		}
+	}
+	return cfg, nil
+}
+
+// выполняет запрос к серверу настроек, если сервер ответил, что данные не изменились, отдается nil
+func (a *Abstract) fetch(ctx context.Context, url, etag string) ([]byte, string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, common.EmptyStr, fmt.Errorf("create http request error %w", err)
+	}
+
+	options := a.configMeta.remoteOptions
+	switch {
+	case options.BearerToken != common.EmptyStr:
+		req.Header.Set("Authorization", "Bearer "+options.BearerToken)
+	case options.Username != common.EmptyStr:
+		req.SetBasicAuth(options.Username, options.Password)
+	}
+	if etag != common.EmptyStr {
+		req.Header.Set("If-None-Match", etag)
+	}
+
+	resp, err := a.configMeta.client.Do(req)
+	if err != nil {
+		return nil, common.EmptyStr, fmt.Errorf("http client request error %w", err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotModified:
+		if etag != common.EmptyStr {
+			return nil, etag, nil
+		}
+		fallthrough
+	default:
+		return nil, common.EmptyStr, fmt.Errorf("%s responded with status %s", url, resp.Status)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, common.EmptyStr, fmt.Errorf("can't read body of %s: %w", url, err)
+	}
+	if len(body) == 0 {
+		return nil, common.EmptyStr, fmt.Errorf("%s responded with empty body", url)
+	}
+	return body, resp.Header.Get("ETag"), nil
+}
+
+// создает настройки TLS для подключения к серверу настроек
+func newRemoteTLSConfig(options common.RemoteConfigOptions) (*tls.Config, error) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if options.CAFile != common.EmptyStr {
+		caPEM, err := common.ReadPEM(options.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("can't read remote config CA %s: %w", common.PEMSource(options.CAFile), err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caPEM) {
+			return nil, fmt.Errorf("remote config CA %s doesn't contain certificates", common.PEMSource(options.CAFile))
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if options.CertFile != common.EmptyStr {
+		certPEM, err := common.ReadPEM(options.CertFile)
+		if err != nil {
+			return nil, fmt.Errorf("can't read remote config client certificate: %w", err)
+		}
+		keyPEM, err := common.ReadPEM(options.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("can't read remote config client key: %w", err)
+		}
+		cert, err := tls.X509KeyPair(certPEM, keyPEM)
+		if err != nil {
+			return nil, fmt.Errorf("can't load remote config client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
+
+// создает проверку подписи открытым ключом RSA (PKCS1v15, SHA-256), ECDSA (ASN.1, SHA-256) или Ed25519
+func newSignatureVerifier(value string) (signatureVerifier, error) {
+	data, err := common.ReadPEM(value)
+	if err != nil {
+		return nil, fmt.Errorf("can't read remote config public key: %w", err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("remote config public key %s isn't pem encoded", common.PEMSource(value))
+	}
+	publicKey, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("can't parse remote config public key %s: %w", common.PEMSource(value), err)
+	}
+
+	switch key := publicKey.(type) {
+	case *rsa.PublicKey:
+		return func(data, signature []byte) error {
+			digest := sha256.Sum256(data)
+			if rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature) != nil {
+				return ErrInvalidSignature
+			}
+			return nil
+		}, nil
+	case *ecdsa.PublicKey:
+		return func(data, signature []byte) error {
+			digest := sha256.Sum256(data)
+			if !ecdsa.VerifyASN1(key, digest[:], signature) {
+				return ErrInvalidSignature
+			}
+			return nil
+		}, nil
+	case ed25519.PublicKey:
+		return func(data, signature []byte) error {
+			if !ed25519.Verify(key, data, signature) {
+				return ErrInvalidSignature
+			}
+			return nil
+		}, nil
+	default:
+		return nil, fmt.Errorf("remote config public key type %T isn't supported", publicKey)
+	}
+}
+
+// подпись может передаваться как есть или в base64
+func decodeSignature(signature []byte) []byte {
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(signature)))
+	if err != nil {
+		return signature
+	}
+	return decoded
+}
+
+// записывает файл через временный файл, чтобы при сбое не оставить файл записанным частично
+func writeFileAtomic(filename string, data []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(filename), filepath.Base(filename)+".*")
+	if err != nil {
+		return err
+	}
+	defer func() { _ = os.Remove(tmp.Name()) }()
+
+	if _, err := tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filename)
+}
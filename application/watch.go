@@ -0,0 +1,172 @@
+package application
+
+import (
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/Halfi/postmanq/common"
+	"github.com/Halfi/postmanq/logger"
+)
+
+const (
+	// время, в течение которого собираются изменения файлов перед перечитыванием настроек,
+	// редакторы и системы развертывания меняют несколько файлов подряд
+	watchDebounce = time.Second
+
+	// Kubernetes обновляет ConfigMap и Secret заменой ссылки ..data, а не самих файлов
+	kubernetesDataLink = "..data"
+)
+
+// следит за изменениями файлов в каталогах, реализуется для каждой операционной системы
+type dirWatcher interface {
+	// начинает следить за каталогом
+	add(dir string) error
+
+	// перестает следить за каталогом
+	remove(dir string) error
+
+	// отдает пути измененных файлов
+	events() <-chan string
+
+	close() error
+}
+
+// следит за изменениями файлов настроек и перечитывает настройки
+// следит за каталогами, а не за файлами, т.к. файлы часто заменяются переименованием
+type configWatcher struct {
+	watcher dirWatcher
+
+	// шаблоны имен файлов настроек по каталогам
+	patterns map[string][]string
+
+	// перечитывает настройки
+	changed func()
+
+	mutex sync.Mutex
+}
+
+// начинает следить за файлами настроек
+func (a *Abstract) watchConfig() {
+	watcher, err := newDirWatcher()
+	if err != nil {
+		logger.All().WarnWithErr(err, "application can't watch configuration files")
+		return
+	}
+
+	a.configMeta.watcher = &configWatcher{
+		watcher:  watcher,
+		patterns: make(map[string][]string),
+		changed: func() {
+			a.Reload(common.ReloadByFile)
+		},
+	}
+	a.updateWatches()
+	go a.configMeta.watcher.run()
+}
+
+// обновляет список файлов настроек, за которыми следит приложение
+func (a *Abstract) updateWatches() {
+	if a.configMeta.watcher != nil {
+		a.configMeta.watcher.update(a.configWatches())
+	}
+}
+
+// отдает шаблоны имен файлов настроек по каталогам: основной файл, включаемые файлы и каталог с настройками доменов
+func (a *Abstract) configWatches() map[string][]string {
+	watches := make(map[string][]string)
+	watch := func(path string) {
+		dir, pattern := filepath.Split(filepath.Clean(path))
+		// каталоги, заданные шаблоном, не отслеживаются
+		if !strings.ContainsAny(dir, "*?[") {
+			dir = filepath.Clean(dir)
+			watches[dir] = append(watches[dir], pattern)
+		}
+	}
+
+	filename := a.configMeta.configFilename
+	baseDir := filepath.Dir(filename)
+	watch(filename)
+
+	a.configMeta.rwm.RLock()
+	data := a.configMeta.configData
+	a.configMeta.rwm.RUnlock()
+	layout := new(configLayout)
+	_ = yaml.Unmarshal(data, layout)
+
+	for _, pattern := range layout.Include {
+		watch(resolvePath(baseDir, pattern))
+	}
+
+	postmansDir := layout.PostmansDir
+	if postmansDir == common.EmptyStr {
+		postmansDir = defaultPostmansDir
+	}
+	postmansDir = filepath.Clean(resolvePath(baseDir, postmansDir))
+	watch(postmansDir)
+	watches[postmansDir] = append(watches[postmansDir], "*")
+
+	return watches
+}
+
+// начинает следить за каталогами и перестает следить за каталогами, которые больше не нужны
+// каталога может еще не быть, тогда его создание заметит слежение за родительским каталогом,
+// поэтому слежение добавляется при каждом обновлении, повторное добавление каталога ничего не меняет
+func (w *configWatcher) update(watches map[string][]string) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	for dir := range w.patterns {
+		if _, ok := watches[dir]; !ok {
+			_ = w.watcher.remove(dir)
+		}
+	}
+	for dir := range watches {
+		if err := w.watcher.add(dir); err != nil {
+			logger.All().Debug("application can't watch directory %s: %v", dir, err)
+		}
+	}
+	w.patterns = watches
+}
+
+// перечитывает настройки после изменения файлов настроек
+func (w *configWatcher) run() {
+	var timer *time.Timer
+	for path := range w.watcher.events() {
+		if !w.matches(path) {
+			continue
+		}
+		if timer == nil {
+			timer = time.AfterFunc(watchDebounce, w.changed)
+		} else {
+			timer.Reset(watchDebounce)
+		}
+	}
+	if timer != nil {
+		timer.Stop()
+	}
+}
+
+// сообщает, является ли файл файлом настроек
+func (w *configWatcher) matches(path string) bool {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	dir, name := filepath.Split(path)
+	if name == kubernetesDataLink {
+		return true
+	}
+	for _, pattern := range w.patterns[filepath.Clean(dir)] {
+		if matched, _ := filepath.Match(pattern, name); matched {
+			return true
+		}
+	}
+	return false
+}
+
+func (w *configWatcher) close() {
+	_ = w.watcher.close()
+}
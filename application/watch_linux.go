@@ -0,0 +1,129 @@
+//go:build linux
+// +build linux
+
+package application
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// события inotify, после которых файл настроек мог измениться
+const inotifyMask = unix.IN_CLOSE_WRITE | unix.IN_MODIFY | unix.IN_CREATE | unix.IN_DELETE |
+	unix.IN_MOVED_TO | unix.IN_MOVED_FROM | unix.IN_ATTRIB
+
+// следит за каталогами с помощью inotify
+type inotifyWatcher struct {
+	// дескриптор хранится отдельно, т.к. File.Fd переводит файл в блокирующий режим
+	fd int
+
+	file *os.File
+
+	// каталоги по дескрипторам слежения
+	dirs map[int32]string
+
+	// дескрипторы слежения по каталогам
+	watches map[string]int32
+
+	paths chan string
+
+	mutex sync.Mutex
+}
+
+// создает слежение за каталогами
+func newDirWatcher() (dirWatcher, error) {
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC | unix.IN_NONBLOCK)
+	if err != nil {
+		return nil, os.NewSyscallError("inotify_init1", err)
+	}
+
+	w := &inotifyWatcher{
+		fd: fd,
+		// неблокирующий дескриптор обслуживается планировщиком go, поэтому close прерывает чтение
+		file:    os.NewFile(uintptr(fd), "inotify"),
+		dirs:    make(map[int32]string),
+		watches: make(map[string]int32),
+		paths:   make(chan string),
+	}
+	go w.read()
+	return w, nil
+}
+
+func (w *inotifyWatcher) add(dir string) error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	wd, err := unix.InotifyAddWatch(w.fd, dir, inotifyMask|unix.IN_ONLYDIR)
+	if err != nil {
+		return os.NewSyscallError("inotify_add_watch", err)
+	}
+	w.dirs[int32(wd)] = dir
+	w.watches[dir] = int32(wd)
+	return nil
+}
+
+func (w *inotifyWatcher) remove(dir string) error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	wd, ok := w.watches[dir]
+	if !ok {
+		return nil
+	}
+	delete(w.watches, dir)
+	delete(w.dirs, wd)
+	if _, err := unix.InotifyRmWatch(w.fd, uint32(wd)); err != nil {
+		return os.NewSyscallError("inotify_rm_watch", err)
+	}
+	return nil
+}
+
+func (w *inotifyWatcher) events() <-chan string {
+	return w.paths
+}
+
+func (w *inotifyWatcher) close() error {
+	return w.file.Close()
+}
+
+// читает события inotify, пока дескриптор не закрыт
+func (w *inotifyWatcher) read() {
+	defer close(w.paths)
+
+	buf := make([]byte, unix.SizeofInotifyEvent*64+unix.PathMax)
+	for {
+		n, err := w.file.Read(buf)
+		if err != nil {
+			return
+		}
+
+		for offset := 0; offset+unix.SizeofInotifyEvent <= n; {
+			event := (*unix.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			nameStart := offset + unix.SizeofInotifyEvent
+			nameEnd := nameStart + int(event.Len)
+			if nameEnd > n {
+				break
+			}
+			name := strings.TrimRight(string(buf[nameStart:nameEnd]), "\x00")
+			offset = nameEnd
+
+			w.mutex.Lock()
+			dir, ok := w.dirs[event.Wd]
+			if event.Mask&unix.IN_IGNORED != 0 {
+				// каталог удален, слежение снято системой
+				delete(w.dirs, event.Wd)
+				delete(w.watches, dir)
+			}
+			w.mutex.Unlock()
+
+			if ok {
+				w.paths <- filepath.Join(dir, name)
+			}
+		}
+	}
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package application
+
+import (
+	"errors"
+)
+
+// создает слежение за каталогами, поддерживается только в linux, в остальных системах настройки перечитываются
+// по таймеру и сигналу SIGHUP
+func newDirWatcher() (dirWatcher, error) {
+	return nil, errors.New("watching configuration files isn't supported on this platform")
+}
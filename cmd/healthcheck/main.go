@@ -2,26 +2,61 @@ package main
 
 import (
 	"context"
+	"flag"
 	"fmt"
+	"io"
 	"net/http"
 	"os"
 	"time"
 )
 
+// порт веб сервиса по умолчанию
+const defaultPort = "1080"
+
+// пути проверок состояния по видам
+var probePaths = map[string]string{
+	"live":  "/health/live",
+	"ready": "/health/ready",
+	"all":   "/health",
+}
+
 func main() {
+	var probe string
+	flag.StringVar(&probe, "probe", "live", "health probe: live - application isn't stuck, ready - application can send mails, all - both")
+	flag.Parse()
+
+	path, ok := probePaths[probe]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown probe %s\n", probe)
+		os.Exit(2)
+	}
+
+	port := os.Getenv("PORT")
+	if port == "" {
+		port = defaultPort
+	}
+
 	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
-	req, err := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("http://127.0.0.1:%s/health", os.Getenv("PORT")), nil)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("http://127.0.0.1:%s%s", port, path), nil)
 	if err != nil {
-		cancel()
-		os.Exit(1)
+		fail(err)
 	}
 
 	res, err := http.DefaultClient.Do(req)
 	if err != nil {
-		cancel()
-		os.Exit(1)
+		fail(err)
 	}
+	defer res.Body.Close()
+
+	// неисправные проверки отдаются с кодом 503, выводим их, чтобы они попали в docker inspect
+	if res.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(res.Body)
+		fail(fmt.Errorf("%s: %s", res.Status, body))
+	}
+}
 
-	_ = res.Body.Close()
-	cancel()
+func fail(err error) {
+	fmt.Fprintln(os.Stderr, err)
+	os.Exit(1)
 }
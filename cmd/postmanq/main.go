@@ -1,6 +1,7 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
 	"fmt"
 	"os"
@@ -9,18 +10,30 @@ import (
 
 	"github.com/Halfi/postmanq/application"
 	"github.com/Halfi/postmanq/common"
+	"github.com/Halfi/postmanq/mailer"
 )
 
 const envPrefix = "POSTMANQ_"
 
 func main() {
 	var file, configURL, configUpdateDuration string
+	var check, skipDNS, schema bool
 
 	flag.StringVar(&file, "f", common.ExampleConfigYaml, "configuration yaml file")
 	flag.StringVar(&configURL, "u", common.InvalidInputString, "remote configurations file url")
 	flag.StringVar(&configUpdateDuration, "t", common.InvalidInputString, "config update duration")
+	flag.BoolVar(&check, "check", false, "check configuration and print all problems")
+	flag.BoolVar(&skipDNS, "skip-dns", false, "don't check dkim records while checking configuration")
+	flag.BoolVar(&schema, "schema", false, "print json schema of configuration")
 	flag.Parse()
 
+	if schema {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		_ = encoder.Encode(application.NewConfigSchema())
+		return
+	}
+
 	if url := os.Getenv(fmt.Sprintf("%sCONFIG_URL", envPrefix)); url != "" {
 		configURL = url
 	}
@@ -30,6 +43,12 @@ func main() {
 	}
 
 	app := application.NewPost()
+	if check {
+		if skipDNS {
+			mailer.DkimResolver = nil
+		}
+		app = application.NewCheck()
+	}
 
 	sig := make(chan os.Signal, 1)
 	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
@@ -38,11 +57,43 @@ func main() {
 		app.SendEvents(common.NewApplicationEvent(common.FinishApplicationEventKind))
 	}()
 
+	if !check {
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		go func() {
+			for range hup {
+				app.Reload(common.ReloadBySignal)
+			}
+		}()
+	}
+
 	if app.IsValidConfigFilename(file) {
 		app.SetConfigMeta(file, configURL, configUpdateDuration)
+		if err := app.SetRemoteConfigOptions(remoteConfigOptions()); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
 		app.Run()
 	} else {
 		fmt.Printf("Usage: postmanq -f %s\n", common.ExampleConfigYaml)
 		flag.VisitAll(common.PrintUsage)
 	}
 }
+
+// читает параметры получения настроек по сети из переменных окружения
+func remoteConfigOptions() common.RemoteConfigOptions {
+	env := func(name string) string {
+		return os.Getenv(fmt.Sprintf("%sCONFIG_%s", envPrefix, name))
+	}
+	return common.RemoteConfigOptions{
+		BearerToken:  env("TOKEN"),
+		Username:     env("USERNAME"),
+		Password:     env("PASSWORD"),
+		CAFile:       env("CA"),
+		CertFile:     env("CERT"),
+		KeyFile:      env("KEY"),
+		PublicKey:    env("PUBLIC_KEY"),
+		SignatureURL: env("SIGNATURE_URL"),
+		CacheFile:    env("CACHE"),
+	}
+}
@@ -0,0 +1,61 @@
+package common
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+)
+
+// AdminHandler обрабатывает запрос к api администрирования, ответ выводится в json
+type AdminHandler func(r *http.Request) (interface{}, error)
+
+// AdminError ошибка api администрирования с кодом ответа, остальные ошибки отдаются с кодом 500
+type AdminError struct {
+	Status int
+
+	Err error
+}
+
+// NewAdminError создает ошибку api администрирования
+func NewAdminError(status int, format string, args ...interface{}) error {
+	return &AdminError{Status: status, Err: fmt.Errorf(format, args...)}
+}
+
+func (e *AdminError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *AdminError) Unwrap() error {
+	return e.Err
+}
+
+var (
+	// обработчики api администрирования по путям и методам
+	adminHandlers = make(map[string]map[string]AdminHandler)
+	adminMutex    sync.RWMutex
+)
+
+// RegisterAdminHandler регистрирует обработчик api администрирования, обработчик с тем же путем и методом заменяется
+// путь указывается без префикса api администрирования, например /postmans
+func RegisterAdminHandler(method, path string, handler AdminHandler) {
+	adminMutex.Lock()
+	defer adminMutex.Unlock()
+	if _, ok := adminHandlers[path]; !ok {
+		adminHandlers[path] = make(map[string]AdminHandler)
+	}
+	adminHandlers[path][method] = handler
+}
+
+// AdminHandlers отдает зарегистрированные обработчики api администрирования по путям и методам
+func AdminHandlers() map[string]map[string]AdminHandler {
+	adminMutex.RLock()
+	defer adminMutex.RUnlock()
+	handlers := make(map[string]map[string]AdminHandler, len(adminHandlers))
+	for path, methods := range adminHandlers {
+		handlers[path] = make(map[string]AdminHandler, len(methods))
+		for method, handler := range methods {
+			handlers[path][method] = handler
+		}
+	}
+	return handlers
+}
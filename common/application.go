@@ -47,9 +47,15 @@ type Application interface {
 	// SetConfigMeta set config meta data
 	SetConfigMeta(configFilename, configRemoteAddr, configUpdateDuration string)
 
+	// SetRemoteConfigOptions устанавливает параметры получения настроек по сети, вызывается после SetConfigMeta
+	SetRemoteConfigOptions(options RemoteConfigOptions) error
+
 	// InitConfig initialize config data
 	InitConfig()
 
+	// Reload перечитывает настройки и переконфигурирует приложение, если настройки изменились
+	Reload(trigger string)
+
 	// IsValidConfigFilename проверяет валидность пути к файлу с настройками
 	IsValidConfigFilename(string) bool
 
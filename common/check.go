@@ -0,0 +1,38 @@
+package common
+
+import (
+	"fmt"
+)
+
+// OfflineCheckArg аргумент события проверки настроек, если true, проверяются только сами настройки, без обращений к сети
+const OfflineCheckArg = "offline"
+
+// IsOfflineCheck проверяются ли настройки без обращений к сети, например, при перечитывании настроек
+func (e *ApplicationEvent) IsOfflineCheck() bool {
+	offline, _ := e.Args[OfflineCheckArg].(bool)
+	return offline
+}
+
+// ConfigError проблема в настройках
+type ConfigError struct {
+	// Path путь к параметру, например postmans.example.com.ips[0]
+	Path string
+
+	Err error
+}
+
+// NewConfigError создает проблему в настройках параметра
+func NewConfigError(path string, format string, args ...interface{}) error {
+	return &ConfigError{Path: path, Err: fmt.Errorf(format, args...)}
+}
+
+func (e *ConfigError) Error() string {
+	if e.Path == EmptyStr {
+		return e.Err.Error()
+	}
+	return fmt.Sprintf("%s: %v", e.Path, e.Err)
+}
+
+func (e *ConfigError) Unwrap() error {
+	return e.Err
+}
@@ -7,6 +7,9 @@ import (
 	"time"
 )
 
+// время ожидания ответа на команду QUIT
+const quitTimeout = 5 * time.Second
+
 // SmtpClientStatus статус клиента почтового сервера
 type SmtpClientStatus int
 
@@ -38,6 +41,9 @@ type SmtpClient struct {
 	// Status статус
 	Status SmtpClientStatus
 
+	// Messages количество писем, отправленных через соединение
+	Messages int
+
 	// таймер, по истечении которого, соединение к почтовому сервису будет разорвано
 	timer *time.Timer
 }
@@ -51,23 +57,23 @@ func (s *SmtpClient) SetTimeout(timeout time.Duration) error {
 	return nil
 }
 
-// Wait переводит клиента в ожидание
-// после окончания ожидания соединение разрывается, а статус меняется на отсоединенный
-func (s *SmtpClient) Wait() {
-	s.Status = WaitingSmtpClientStatus
-	s.timer = time.AfterFunc(App.Timeout().Waiting, func() {
-		s.Status = DisconnectedSmtpClientStatus
-		_ = s.Worker.Quit()
-		s.timer = nil
-	})
-}
-
-// Wakeup переводит клиента в рабочее состояние
-// если клиент был в ожидании, ожидание прерывается
-func (s *SmtpClient) Wakeup() {
-	s.Status = WorkingSmtpClientStatus
+// останавливает таймер простоя клиента
+func (s *SmtpClient) stopTimer() {
 	if s.timer != nil {
 		s.timer.Stop()
 		s.timer = nil
 	}
 }
+
+// разрывает соединение к почтовому сервису
+func (s *SmtpClient) quit() {
+	s.Status = DisconnectedSmtpClientStatus
+	if s.Conn != nil {
+		_ = s.Conn.SetDeadline(time.Now().Add(quitTimeout))
+	}
+	if s.Worker != nil {
+		if err := s.Worker.Quit(); err != nil && s.Conn != nil {
+			_ = s.Conn.Close()
+		}
+	}
+}
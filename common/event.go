@@ -1,6 +1,7 @@
 package common
 
 import (
+	"sync/atomic"
 	"time"
 )
 
@@ -73,6 +74,22 @@ const (
 	RevokeSendEventResult
 )
 
+var sendEventResultNames = map[SendEventResult]string{
+	SuccessSendEventResult:   "success",
+	OverlimitSendEventResult: "overlimit",
+	ErrorSendEventResult:     "error",
+	DelaySendEventResult:     "delay",
+	RevokeSendEventResult:    "revoke",
+}
+
+// String возвращает название результата, используется в логах и метриках
+func (r SendEventResult) String() string {
+	if name, ok := sendEventResultNames[r]; ok {
+		return name
+	}
+	return "unknown"
+}
+
 // SendEvent событие отправки письма
 type SendEvent struct {
 	// Client клиент для отправки писем
@@ -93,8 +110,43 @@ type SendEvent struct {
 	// Iterator итератор сервисов, участвующих в отправке письма
 	Iterator *Iterator
 
-	// Queue очередь, в которую необходимо будет положить клиента после отправки письма
-	Queue *LimitedQueue
+	// Pool пул, в который необходимо будет вернуть клиента после отправки письма
+	Pool *ClientPool
+
+	// Address ip, с которого отправляется письмо
+	Address string
+
+	// AddressReservedAt время, когда письмо учтено в ограничениях прогрева ip Address,
+	// если письмо не отправлено, учет снимается, нулевое время - письмо не учитывалось
+	AddressReservedAt time.Time
+
+	// состояние отправки, изменяется атомарно только из начального состояния,
+	// поэтому письмо либо передается почтовому серверу, либо отменяется, но не то и другое сразу
+	state int32
+}
+
+// состояния отправки письма
+const (
+	// письмо еще не передавалось почтовому серверу
+	pendingSendEventState int32 = iota
+
+	// получатель перестал ждать результат и вернул письмо в очередь
+	cancelledSendEventState
+
+	// отправитель начал передавать письмо почтовому серверу
+	transmittingSendEventState
+)
+
+// StartTransmit отмечает, что отправитель начал передавать письмо почтовому серверу
+// если получатель уже отменил отправку, вернется false и письмо отправлять нельзя
+func (e *SendEvent) StartTransmit() bool {
+	return atomic.CompareAndSwapInt32(&e.state, pendingSendEventState, transmittingSendEventState)
+}
+
+// Cancel отменяет отправку письма, если отправитель еще не начал передавать его почтовому серверу
+// если передача уже началась, вернется false, письмо может быть принято почтовым сервером
+func (e *SendEvent) Cancel() bool {
+	return atomic.CompareAndSwapInt32(&e.state, pendingSendEventState, cancelledSendEventState)
 }
 
 // NewSendEvent создает событие отправки сообщения
@@ -102,7 +154,21 @@ func NewSendEvent(message *MailMessage) *SendEvent {
 	event := new(SendEvent)
 	event.Message = message
 	event.CreateDate = time.Now()
-	event.Result = make(chan SendEventResult)
+	// результат буферизуется, чтобы сервисы не блокировались, если получатель перестал ждать результат
+	event.Result = make(chan SendEventResult, 1)
 	event.Iterator = NewIterator(Services)
 	return event
 }
+
+// NotifyResult сообщает результат отправки письма сервисам, которым он необходим,
+// и учитывает время, проведенное письмом в последнем сервисе
+func NotifyResult(ev *SendEvent, result SendEventResult) {
+	if ev.Iterator != nil {
+		ev.Iterator.Done()
+	}
+	for _, service := range Services {
+		if resultService, ok := service.(ResultService); ok {
+			resultService.OnResult(ev, result)
+		}
+	}
+}
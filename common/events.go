@@ -0,0 +1,136 @@
+package common
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// EventChannel канал событий отправки письма
+// канал можно закрыть, пока в него отправляют события, отправка в закрытый канал не паникует, а возвращает false
+type EventChannel struct {
+	// имя сервиса, получающего события, для проверки состояния
+	name string
+
+	events chan *SendEvent
+	closed bool
+	rwm    sync.RWMutex
+
+	// время начала отправок, ждущих, пока событие заберут из канала, по номерам отправок
+	blocked map[uint64]time.Time
+	sends   uint64
+	mutex   sync.Mutex
+}
+
+var (
+	// открытые каналы событий, по ним проверяется, не зависла ли отправка писем
+	eventChannels      = make(map[*EventChannel]bool)
+	eventChannelsMutex sync.Mutex
+)
+
+// NewEventChannel создает канал событий отправки письма для сервиса с указанным именем
+func NewEventChannel(name string) *EventChannel {
+	c := &EventChannel{
+		name:    name,
+		events:  make(chan *SendEvent),
+		blocked: make(map[uint64]time.Time),
+	}
+	eventChannelsMutex.Lock()
+	eventChannels[c] = true
+	eventChannelsMutex.Unlock()
+	return c
+}
+
+// Send отправляет событие в канал, если канал закрыт, вернется false
+// канал не закрывается, пока событие не заберут из канала
+func (c *EventChannel) Send(ev *SendEvent) bool {
+	c.rwm.RLock()
+	defer c.rwm.RUnlock()
+	if c.closed {
+		return false
+	}
+
+	select {
+	case c.events <- ev:
+		return true
+	default:
+	}
+
+	// все получатели заняты, запоминаем, с какого времени ждет отправка
+	id := c.block()
+	c.events <- ev
+	c.unblock(id)
+	return true
+}
+
+func (c *EventChannel) block() uint64 {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.sends++
+	c.blocked[c.sends] = time.Now()
+	return c.sends
+}
+
+func (c *EventChannel) unblock(id uint64) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	delete(c.blocked, id)
+}
+
+// отдает, сколько ждет самая долгая отправка, и количество ждущих отправок
+func (c *EventChannel) waiting(now time.Time) (time.Duration, int) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	var longest time.Duration
+	for _, since := range c.blocked {
+		if wait := now.Sub(since); wait > longest {
+			longest = wait
+		}
+	}
+	return longest, len(c.blocked)
+}
+
+// Events отдает канал для получения событий, канал закрывается после Close
+func (c *EventChannel) Events() <-chan *SendEvent {
+	return c.events
+}
+
+// Close закрывает канал, дожидаясь окончания начатых отправок
+func (c *EventChannel) Close() {
+	c.rwm.Lock()
+	defer c.rwm.Unlock()
+	if !c.closed {
+		c.closed = true
+		close(c.events)
+	}
+
+	eventChannelsMutex.Lock()
+	delete(eventChannels, c)
+	eventChannelsMutex.Unlock()
+}
+
+// CheckEventChannels проверяет, что события не ждут отправки следующему сервису дольше timeout
+// долгое ожидание означает, что сервис, получающий события, завис и письма не отправляются
+func CheckEventChannels(timeout time.Duration) error {
+	eventChannelsMutex.Lock()
+	channels := make([]*EventChannel, 0, len(eventChannels))
+	for c := range eventChannels {
+		channels = append(channels, c)
+	}
+	eventChannelsMutex.Unlock()
+
+	now := time.Now()
+	problems := make([]string, 0)
+	for _, c := range channels {
+		if wait, count := c.waiting(now); wait > timeout {
+			problems = append(problems, fmt.Sprintf("%d events wait %s for %s service", count, wait.Round(time.Second), c.name))
+		}
+	}
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return fmt.Errorf("pipeline is blocked: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
@@ -0,0 +1,26 @@
+package common
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Fingerprint отдает отпечаток настроек, по отпечаткам сервисы определяют, изменились ли настройки при переконфигурации
+// отпечаток учитывает только экспортируемые поля, поэтому его нужно снимать до инициализации настроек
+func Fingerprint(config interface{}) string {
+	data, err := yaml.Marshal(config)
+	if err != nil {
+		// отпечаток с адресами указателей всегда отличается, поэтому такие настройки всегда считаются измененными
+		data = []byte(fmt.Sprintf("%#v", config))
+	}
+	return FingerprintBytes(data)
+}
+
+// FingerprintBytes отдает отпечаток данных
+func FingerprintBytes(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,48 @@
+package common
+
+import (
+	"context"
+	"sync"
+)
+
+// HealthCheck проверяет состояние сервиса, если сервис неисправен, возвращает ошибку
+type HealthCheck func(ctx context.Context) error
+
+// HealthProbe вид проверки состояния
+type HealthProbe string
+
+const (
+	// LivenessProbe проверяет, что приложение не зависло, неисправное приложение необходимо перезапустить
+	LivenessProbe HealthProbe = "live"
+
+	// ReadinessProbe проверяет, что приложение может отправлять письма, неисправное приложение ждет восстановления
+	// соединений и внешних сервисов, перезапуск не поможет
+	ReadinessProbe HealthProbe = "ready"
+)
+
+var (
+	// проверки состояния сервисов по видам и именам
+	healthChecks = map[HealthProbe]map[string]HealthCheck{
+		LivenessProbe:  make(map[string]HealthCheck),
+		ReadinessProbe: make(map[string]HealthCheck),
+	}
+	healthMutex sync.RWMutex
+)
+
+// RegisterHealthCheck регистрирует проверку состояния сервиса, проверка того же вида с тем же именем заменяется
+func RegisterHealthCheck(name string, probe HealthProbe, check HealthCheck) {
+	healthMutex.Lock()
+	defer healthMutex.Unlock()
+	healthChecks[probe][name] = check
+}
+
+// HealthChecks отдает зарегистрированные проверки состояния сервисов указанного вида
+func HealthChecks(probe HealthProbe) map[string]HealthCheck {
+	healthMutex.RLock()
+	defer healthMutex.RUnlock()
+	checks := make(map[string]HealthCheck, len(healthChecks[probe]))
+	for name, check := range healthChecks[probe] {
+		checks[name] = check
+	}
+	return checks
+}
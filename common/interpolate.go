@@ -0,0 +1,147 @@
+package common
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// префикс подстановки содержимого файла
+	interpolateFilePrefix = "file:"
+
+	// начало подстановки
+	interpolateOpen = "${"
+
+	// экранированное начало подстановки, заменяется на ${ без подстановки
+	interpolateEscaped = "$${"
+
+	// начало pem блока
+	pemPrefix = "-----BEGIN"
+)
+
+// InterpolateNode подставляет в значения настроек переменные окружения ${NAME} и содержимое файлов ${file:/path}
+// подстановка выполняется в разобранном документе, поэтому значения могут быть многострочными, например pem ключами,
+// ключи настроек не изменяются, если значение целиком состоит из подстановки, тип значения определяется заново,
+// поэтому ${WORKERS} может задавать число
+// в настройках из ненадежного источника, например, полученных по сети без проверки подписи, подстановки запрещены,
+// иначе сервер настроек мог бы получить переменные окружения и файлы, например, указав их паролем релея
+func InterpolateNode(node *yaml.Node, trusted bool) error {
+	errs := make([]string, 0)
+	interpolateNode(node, trusted, &errs)
+	if len(errs) > 0 {
+		return fmt.Errorf("can't interpolate config: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// подставляет значения во все скалярные значения узла, кроме ключей
+func interpolateNode(node *yaml.Node, trusted bool, errs *[]string) {
+	switch node.Kind {
+	case yaml.DocumentNode, yaml.SequenceNode:
+		for _, content := range node.Content {
+			interpolateNode(content, trusted, errs)
+		}
+	case yaml.MappingNode:
+		for i := 1; i < len(node.Content); i += 2 {
+			interpolateNode(node.Content[i], trusted, errs)
+		}
+	case yaml.ScalarNode:
+		if !strings.Contains(node.Value, interpolateOpen) {
+			return
+		}
+		value, err := interpolateString(node.Value, trusted)
+		if err != nil {
+			*errs = append(*errs, fmt.Sprintf("line %d: %v", node.Line, err))
+			return
+		}
+		node.Value = value
+		// тип строки в кавычках не меняется, тип остальных значений определяется по подставленному значению
+		if node.Style == 0 {
+			node.Tag = EmptyStr
+		}
+	}
+}
+
+// подставляет значения в строку
+func interpolateString(value string, trusted bool) (string, error) {
+	var builder strings.Builder
+	for {
+		start := strings.Index(value, interpolateOpen)
+		if start < 0 {
+			builder.WriteString(value)
+			return builder.String(), nil
+		}
+
+		if start > 0 && strings.HasPrefix(value[start-1:], interpolateEscaped) {
+			builder.WriteString(value[:start-1])
+			builder.WriteString(interpolateOpen)
+			value = value[start+len(interpolateOpen):]
+			continue
+		}
+
+		end := strings.Index(value[start:], "}")
+		if end < 0 {
+			return EmptyStr, fmt.Errorf("unclosed %s in %q", interpolateOpen, value[start:])
+		}
+		end += start
+
+		name := value[start+len(interpolateOpen) : end]
+		if !trusted {
+			return EmptyStr, fmt.Errorf("%s%s} isn't allowed in unsigned remote config", interpolateOpen, name)
+		}
+		replacement, err := resolve(name)
+		if err != nil {
+			return EmptyStr, err
+		}
+		builder.WriteString(value[:start])
+		builder.WriteString(replacement)
+		value = value[end+1:]
+	}
+}
+
+// отдает значение переменной окружения или содержимое файла
+func resolve(name string) (string, error) {
+	if strings.HasPrefix(name, interpolateFilePrefix) {
+		filename := strings.TrimPrefix(name, interpolateFilePrefix)
+		content, err := ioutil.ReadFile(filename)
+		if err != nil {
+			return EmptyStr, fmt.Errorf("can't read file %s: %w", filename, err)
+		}
+		// секреты часто записываются с переводом строки в конце
+		return strings.TrimRight(string(content), "\r\n"), nil
+	}
+
+	if name == EmptyStr {
+		return EmptyStr, fmt.Errorf("empty variable name in %s}", interpolateOpen)
+	}
+	value, ok := os.LookupEnv(name)
+	if !ok {
+		return EmptyStr, fmt.Errorf("environment variable %s isn't set", name)
+	}
+	return value, nil
+}
+
+// IsInlinePEM сообщает, задан ли ключ или сертификат в настройках в формате PEM, а не путем до файла
+func IsInlinePEM(value string) bool {
+	return strings.HasPrefix(strings.TrimSpace(value), pemPrefix)
+}
+
+// ReadPEM отдает ключ или сертификат, заданный в настройках в формате PEM или путем до файла
+func ReadPEM(value string) ([]byte, error) {
+	if IsInlinePEM(value) {
+		return []byte(strings.TrimSpace(value) + "\n"), nil
+	}
+	return ioutil.ReadFile(value)
+}
+
+// PEMSource отдает описание ключа или сертификата для журнала, чтобы не выводить содержимое ключа
+func PEMSource(value string) string {
+	if IsInlinePEM(value) {
+		return "inline pem"
+	}
+	return value
+}
@@ -1,5 +1,7 @@
 package common
 
+import "time"
+
 // Iterator итератор, используется для слабой связи между сервисами приложения
 type Iterator struct {
 	// элементы
@@ -7,6 +9,9 @@ type Iterator struct {
 
 	// указатель на текущий элемент
 	current int
+
+	// время перехода к текущему элементу, по нему считается время, проведенное письмом в сервисе
+	entered time.Time
 }
 
 // NewIterator создает итератор
@@ -21,6 +26,7 @@ func (i Iterator) First() interface{} {
 
 // Next отдает следующий элемент
 func (i *Iterator) Next() interface{} {
+	i.observe()
 	var item interface{}
 	i.current++
 	if i.isValidCurrent() {
@@ -29,6 +35,21 @@ func (i *Iterator) Next() interface{} {
 	return item
 }
 
+// Done учитывает время, проведенное письмом в последнем сервисе, вызывается после получения результата отправки
+func (i *Iterator) Done() {
+	i.observe()
+	i.entered = time.Time{}
+}
+
+// учитывает время, проведенное письмом в текущем сервисе, и запоминает время перехода к следующему сервису
+func (i *Iterator) observe() {
+	now := time.Now()
+	if i.current >= 0 && i.isValidCurrent() && !i.entered.IsZero() {
+		serviceDuration.WithLabelValues(serviceName(i.items[i.current])).Observe(now.Sub(i.entered).Seconds())
+	}
+	i.entered = now
+}
+
 // проверяет, что указатель на элемент не превысил количества элементов
 func (i *Iterator) isValidCurrent() bool {
 	return i.current < len(i.items)
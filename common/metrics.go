@@ -0,0 +1,68 @@
+package common
+
+import (
+	"fmt"
+	"path"
+	"reflect"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// команды smtp, время ответа на которые учитывается в метриках
+const (
+	HeloSmtpCommand = "helo"
+	MailSmtpCommand = "mail"
+	RcptSmtpCommand = "rcpt"
+	DataSmtpCommand = "data"
+)
+
+// промежутки гистограмм от 10 миллисекунд до полутора минут
+var durationBuckets = prometheus.ExponentialBuckets(0.01, 2, 14)
+
+var (
+	// время ответа почтового сервера на команды smtp
+	smtpCommandDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "postmanq",
+		Subsystem: "smtp",
+		Name:      "command_duration_seconds",
+		Help:      "SMTP command latency by command and status.",
+		Buckets:   durationBuckets,
+	}, []string{"command", "status"})
+
+	// время, проведенное письмом в сервисе, включая ожидание свободного обработчика сервиса
+	serviceDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "postmanq",
+		Subsystem: "pipeline",
+		Name:      "service_duration_seconds",
+		Help:      "Time a mail spends in each service of the delivery pipeline.",
+		Buckets:   durationBuckets,
+	}, []string{"service"})
+)
+
+// ObserveSmtpCommand учитывает время ответа почтового сервера на команду smtp, начатую в started
+func ObserveSmtpCommand(command string, started time.Time, err error) {
+	status := "ok"
+	if err != nil {
+		status = "error"
+	}
+	smtpCommandDuration.WithLabelValues(command, status).Observe(time.Since(started).Seconds())
+}
+
+// CodeClass отдает класс кода ответа почтового сервера, например 4xx, если кода нет, отдает none
+func CodeClass(code int) string {
+	if code < 100 || code > 599 {
+		return "none"
+	}
+	return fmt.Sprintf("%dxx", code/100)
+}
+
+// отдает имя сервиса по имени его пакета, например guardian
+func serviceName(service interface{}) string {
+	t := reflect.TypeOf(service)
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return path.Base(t.PkgPath())
+}
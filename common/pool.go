@@ -0,0 +1,345 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrPoolBroken пул не открывает соединения после нескольких неудачных попыток подряд
+	ErrPoolBroken = errors.New("smtp pool is broken")
+
+	// ErrPoolBusy в пуле нет свободных клиентов и открыто максимальное количество соединений
+	ErrPoolBusy = errors.New("smtp pool is busy")
+)
+
+// PoolUnlimited значение ограничений пула, отключающее ограничение
+// 0 означает, что значение не задано и берется значение по умолчанию или значение общих настроек пулов
+const PoolUnlimited = -1
+
+// PoolConfig настройки пула клиентов
+type PoolConfig struct {
+	// MaxConnections максимальное количество соединений, -1 - без ограничений, по умолчанию 10
+	MaxConnections int `yaml:"maxConnections"`
+
+	// MaxMessages максимальное количество писем, отправляемых через одно соединение, -1 - без ограничений, по умолчанию без ограничений
+	MaxMessages int `yaml:"maxMessages"`
+
+	// IdleTimeout время простоя, после которого соединение закрывается
+	IdleTimeout time.Duration `yaml:"idleTimeout"`
+
+	// FailureThreshold количество неудачных попыток открыть соединение подряд, после которых пул перестает открывать соединения
+	FailureThreshold int `yaml:"failureThreshold"`
+
+	// BreakDuration время, на которое пул перестает открывать соединения
+	BreakDuration time.Duration `yaml:"breakDuration"`
+}
+
+// Init инициализирует значения по умолчанию
+func (c *PoolConfig) Init() {
+	if c.MaxConnections == 0 {
+		c.MaxConnections = 10
+	}
+	if c.IdleTimeout == 0 {
+		c.IdleTimeout = App.Timeout().Waiting
+	}
+	if c.FailureThreshold == 0 {
+		c.FailureThreshold = 3
+	}
+	if c.BreakDuration == 0 {
+		c.BreakDuration = time.Minute
+	}
+}
+
+// InitBy инициализирует незаданные значения значениями других настроек
+func (c *PoolConfig) InitBy(parent *PoolConfig) {
+	if c.MaxConnections == 0 {
+		c.MaxConnections = parent.MaxConnections
+	}
+	if c.MaxMessages == 0 {
+		c.MaxMessages = parent.MaxMessages
+	}
+	if c.IdleTimeout == 0 {
+		c.IdleTimeout = parent.IdleTimeout
+	}
+	if c.FailureThreshold == 0 {
+		c.FailureThreshold = parent.FailureThreshold
+	}
+	if c.BreakDuration == 0 {
+		c.BreakDuration = parent.BreakDuration
+	}
+}
+
+// ClientPool пул клиентов к одному почтовому серверу с одного ip
+type ClientPool struct {
+	config *PoolConfig
+
+	// свободные клиенты
+	idle []*SmtpClient
+
+	// количество открытых и открываемых соединений
+	size int
+
+	// количество неудачных попыток открыть соединение подряд
+	failures int
+
+	// дата, до которой пул не открывает соединения
+	brokenUntil time.Time
+
+	// ожидающие освобождения клиента, упорядоченные по убыванию приоритета
+	waiters []*poolWaiter
+
+	// генератор идентификаторов клиентов
+	nextId func() int
+
+	mutex sync.Mutex
+}
+
+// NewClientPool создает пул клиентов
+func NewClientPool(config *PoolConfig, nextId func() int) *ClientPool {
+	return &ClientPool{
+		config:  config,
+		idle:    make([]*SmtpClient, 0),
+		waiters: make([]*poolWaiter, 0),
+		nextId:  nextId,
+	}
+}
+
+// ожидающий освобождения клиента
+type poolWaiter struct {
+	priority int
+
+	// переданный ожидающему клиент или ошибка, заполняются до закрытия ready
+	client *SmtpClient
+	err    error
+
+	// канал, закрываемый, когда ожидающему передали клиента или ошибку
+	ready chan struct{}
+}
+
+// Get отдает свободного клиента или нового клиента без соединения, которое необходимо открыть
+// если в пуле нет свободных клиентов и открыто максимальное количество соединений, ждет освобождения клиента
+// освободившийся клиент передается ожидающему с наибольшим приоритетом, при равном приоритете - ожидающему дольше
+// ожидание прерывается по окончании контекста
+func (p *ClientPool) Get(ctx context.Context, priority int) (*SmtpClient, error) {
+	p.mutex.Lock()
+	client, err := p.tryGet(priority)
+	if !errors.Is(err, ErrPoolBusy) {
+		p.mutex.Unlock()
+		return client, err
+	}
+	waiter := p.wait(priority)
+	p.mutex.Unlock()
+
+	select {
+	case <-ctx.Done():
+		p.mutex.Lock()
+		// если клиента уже передали, возвращаем его в пул, чтобы он достался следующему ожидающему
+		if !p.cancel(waiter) && waiter.client != nil {
+			p.putBack(waiter.client)
+		}
+		p.mutex.Unlock()
+		return nil, ctx.Err()
+	case <-waiter.ready:
+		return waiter.client, waiter.err
+	}
+}
+
+// TryGet отдает свободного клиента или нового клиента без соединения, не дожидаясь освобождения клиентов
+// если клиента ждут письма с большим приоритетом, вернется ErrPoolBusy
+func (p *ClientPool) TryGet(priority int) (*SmtpClient, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.tryGet(priority)
+}
+
+// отдает клиента, вызывается под семафором
+func (p *ClientPool) tryGet(priority int) (*SmtpClient, error) {
+	if len(p.waiters) > 0 && p.waiters[0].priority > priority {
+		return nil, ErrPoolBusy
+	}
+	return p.take()
+}
+
+// отдает свободного клиента или нового клиента без соединения без учета ожидающих, вызывается под семафором
+func (p *ClientPool) take() (*SmtpClient, error) {
+	if count := len(p.idle); count > 0 {
+		client := p.idle[count-1]
+		p.idle = p.idle[:count-1]
+		client.stopTimer()
+		client.Status = WorkingSmtpClientStatus
+		return client, nil
+	}
+
+	if time.Now().Before(p.brokenUntil) {
+		return nil, ErrPoolBroken
+	}
+
+	if p.config.MaxConnections > 0 && p.size >= p.config.MaxConnections {
+		return nil, ErrPoolBusy
+	}
+
+	p.size++
+	return &SmtpClient{Id: p.nextId(), Status: WorkingSmtpClientStatus}, nil
+}
+
+// добавляет ожидающего после всех ожидающих с таким же или большим приоритетом, вызывается под семафором
+func (p *ClientPool) wait(priority int) *poolWaiter {
+	waiter := &poolWaiter{priority: priority, ready: make(chan struct{})}
+	i := len(p.waiters)
+	for i > 0 && p.waiters[i-1].priority < priority {
+		i--
+	}
+	p.waiters = append(p.waiters, nil)
+	copy(p.waiters[i+1:], p.waiters[i:])
+	p.waiters[i] = waiter
+	return waiter
+}
+
+// удаляет ожидающего, если его еще не разбудили, вызывается под семафором
+func (p *ClientPool) cancel(waiter *poolWaiter) bool {
+	for i, w := range p.waiters {
+		if w == waiter {
+			p.waiters = append(p.waiters[:i], p.waiters[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// Opened сообщает пулу, что соединение клиента успешно открыто
+func (p *ClientPool) Opened(client *SmtpClient) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.failures = 0
+	client.ModifyDate = time.Now()
+}
+
+// Failed сообщает пулу, что соединение клиента не удалось открыть
+// после нескольких неудачных попыток подряд пул перестает открывать соединения
+func (p *ClientPool) Failed(_ *SmtpClient) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.size--
+	p.failures++
+	if p.failures >= p.config.FailureThreshold {
+		p.failures = 0
+		p.brokenUntil = time.Now().Add(p.config.BreakDuration)
+	}
+	// если пул перестал открывать соединения, все ожидающие получат ErrPoolBroken
+	p.notify()
+}
+
+// Put возвращает клиента в пул после отправки письма
+// если через соединение отправлено максимальное количество писем, соединение закрывается
+func (p *ClientPool) Put(client *SmtpClient) {
+	client.Messages++
+	if p.config.MaxMessages > 0 && client.Messages >= p.config.MaxMessages {
+		p.Discard(client)
+		return
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.putIdle(client)
+	p.notify()
+}
+
+// добавляет клиента в свободные, вызывается под семафором
+func (p *ClientPool) putIdle(client *SmtpClient) {
+	client.Status = WaitingSmtpClientStatus
+	client.ModifyDate = time.Now()
+	client.timer = time.AfterFunc(p.config.IdleTimeout, func() {
+		p.evict(client)
+	})
+	p.idle = append(p.idle, client)
+}
+
+// возвращает клиента, которого передали переставшему ждать, вызывается под семафором
+// у нового клиента соединение еще не открыто, поэтому освобождается только место в пуле
+func (p *ClientPool) putBack(client *SmtpClient) {
+	if client.Worker == nil {
+		p.size--
+	} else {
+		p.putIdle(client)
+	}
+	p.notify()
+}
+
+// Discard закрывает соединение клиента и освобождает место в пуле
+func (p *ClientPool) Discard(client *SmtpClient) {
+	p.mutex.Lock()
+	p.size--
+	p.notify()
+	p.mutex.Unlock()
+	client.quit()
+}
+
+// Close закрывает соединения всех свободных клиентов
+func (p *ClientPool) Close() {
+	p.mutex.Lock()
+	idle := p.idle
+	p.idle = make([]*SmtpClient, 0)
+	p.size -= len(idle)
+	p.notify()
+	p.mutex.Unlock()
+
+	for _, client := range idle {
+		client.stopTimer()
+		client.quit()
+	}
+}
+
+// Len возвращает количество открытых соединений и количество свободных клиентов
+func (p *ClientPool) Len() (size, idle int) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.size, len(p.idle)
+}
+
+// Broken сигнализирует, что пул перестал открывать соединения
+func (p *ClientPool) Broken() bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return time.Now().Before(p.brokenUntil)
+}
+
+// закрывает соединение клиента, простаивающего дольше допустимого
+func (p *ClientPool) evict(client *SmtpClient) {
+	p.mutex.Lock()
+	found := false
+	for i, idleClient := range p.idle {
+		if idleClient == client {
+			p.idle = append(p.idle[:i], p.idle[i+1:]...)
+			found = true
+			break
+		}
+	}
+	if found {
+		p.size--
+		p.notify()
+	}
+	p.mutex.Unlock()
+
+	if found {
+		client.quit()
+	}
+}
+
+// передает освободившихся клиентов ожидающим в порядке приоритета, вызывается под семафором
+// клиент передается напрямую, чтобы его не забрал TryGet с меньшим приоритетом и ожидающий не потерял очередь
+// если пул перестал открывать соединения, ожидающие получают ErrPoolBroken
+func (p *ClientPool) notify() {
+	for len(p.waiters) > 0 {
+		client, err := p.take()
+		if errors.Is(err, ErrPoolBusy) {
+			return
+		}
+		waiter := p.waiters[0]
+		p.waiters = p.waiters[1:]
+		waiter.client, waiter.err = client, err
+		close(waiter.ready)
+	}
+}
@@ -29,6 +29,12 @@ type Timeout struct {
 	Mail       time.Duration `yaml:"mail"`
 	Rcpt       time.Duration `yaml:"rcpt"`
 	Data       time.Duration `yaml:"data"`
+
+	// Drain время, в течение которого при остановке приложения дожидается отправки уже полученных писем
+	Drain time.Duration `yaml:"drain"`
+
+	// Blocked время, после которого письмо, ждущее передачи следующему сервису, означает, что отправка писем зависла
+	Blocked time.Duration `yaml:"blocked"`
 }
 
 // инициализирует значения таймаутов по умолчанию
@@ -54,6 +60,12 @@ func (t *Timeout) Init() {
 	if t.Data == 0 {
 		t.Data = 10 * time.Minute
 	}
+	if t.Drain == 0 {
+		t.Drain = 30 * time.Second
+	}
+	if t.Blocked == 0 {
+		t.Blocked = 10 * time.Minute
+	}
 }
 
 // тип отложенной очереди
@@ -113,6 +125,15 @@ type MailMessage struct {
 
 	// ошибка отправки
 	Error *MailError `json:"error"`
+
+	// дата, раньше которой письмо не отправляется, необязательный параметр
+	SendAt *time.Time `json:"sendAt,omitempty"`
+
+	// дата, после которой письмо не отправляется, необязательный параметр
+	ExpireAt *time.Time `json:"expireAt,omitempty"`
+
+	// приоритет письма, письма с большим приоритетом первыми получают свободные соединения, необязательный параметр
+	Priority int `json:"priority,omitempty"`
 }
 
 // инициализирует письмо
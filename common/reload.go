@@ -0,0 +1,79 @@
+package common
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// ReloadByTimer настройки перечитаны по таймеру
+	ReloadByTimer = "timer"
+
+	// ReloadBySignal настройки перечитаны по сигналу SIGHUP
+	ReloadBySignal = "signal"
+
+	// ReloadByFile настройки перечитаны после изменения файлов настроек
+	ReloadByFile = "file"
+
+	// ReloadByAPI настройки перечитаны по запросу к api администрирования
+	ReloadByAPI = "api"
+)
+
+const (
+	// ReloadApplied настройки изменились и применены
+	ReloadApplied = "applied"
+
+	// ReloadUnchanged настройки не изменились
+	ReloadUnchanged = "unchanged"
+
+	// ReloadRejected настройки не прошли проверку, приложение работает с текущими настройками
+	ReloadRejected = "rejected"
+
+	// ReloadFailed настройки не удалось прочитать, приложение работает с текущими настройками
+	ReloadFailed = "failed"
+)
+
+// ReloadStatus результат перечитывания настроек
+type ReloadStatus struct {
+	// Time время перечитывания
+	Time time.Time `json:"time"`
+
+	// Trigger причина перечитывания
+	Trigger string `json:"trigger"`
+
+	// Result результат перечитывания
+	Result string `json:"result"`
+
+	// Errors ошибки чтения и проверки настроек
+	Errors []string `json:"errors,omitempty"`
+
+	// Warnings проблемы, которые не мешают применить настройки, например неизвестные параметры
+	Warnings []string `json:"warnings,omitempty"`
+
+	// Changes измененные параметры и разделы настроек
+	Changes []string `json:"changes,omitempty"`
+}
+
+var (
+	// результат последнего перечитывания настроек
+	reloadStatus *ReloadStatus
+	reloadMutex  sync.RWMutex
+)
+
+// SetReloadStatus сохраняет результат последнего перечитывания настроек
+func SetReloadStatus(status ReloadStatus) {
+	reloadMutex.Lock()
+	defer reloadMutex.Unlock()
+	reloadStatus = &status
+}
+
+// LastReloadStatus отдает результат последнего перечитывания настроек, если настройки не перечитывались, отдается nil
+func LastReloadStatus() *ReloadStatus {
+	reloadMutex.RLock()
+	defer reloadMutex.RUnlock()
+	if reloadStatus == nil {
+		return nil
+	}
+	status := *reloadStatus
+	return &status
+}
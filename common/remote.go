@@ -0,0 +1,32 @@
+package common
+
+// RemoteConfigOptions параметры получения настроек по сети
+type RemoteConfigOptions struct {
+	// BearerToken токен, передается серверу настроек в заголовке Authorization
+	BearerToken string
+
+	// Username имя пользователя для basic авторизации, используется, если токен не задан
+	Username string
+
+	// Password пароль для basic авторизации
+	Password string
+
+	// CAFile сертификат центра сертификации, которым проверяется сертификат сервера настроек, путь до файла или PEM
+	CAFile string
+
+	// CertFile сертификат клиента для mTLS, путь до файла или PEM
+	CertFile string
+
+	// KeyFile закрытый ключ клиента для mTLS, путь до файла или PEM
+	KeyFile string
+
+	// PublicKey открытый ключ RSA, ECDSA или Ed25519, которым проверяется подпись настроек, путь до файла или PEM
+	// если ключ не задан, подпись не проверяется
+	PublicKey string
+
+	// SignatureURL адрес подписи настроек, по умолчанию адрес настроек с суффиксом .sig
+	SignatureURL string
+
+	// CacheFile файл с последними полученными настройками, используется, если сервер настроек недоступен
+	CacheFile string
+}
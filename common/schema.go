@@ -0,0 +1,226 @@
+package common
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+const jsonSchemaDraft = "http://json-schema.org/draft-07/schema#"
+
+var (
+	durationType = reflect.TypeOf(time.Duration(0))
+	timeType     = reflect.TypeOf(time.Time{})
+)
+
+// Schema json схема настроек, строится по типам сервисов так же, как yaml разбирает настройки в сервисы
+// используется редакторами для подсказок и проверки файла настроек и командой проверки настроек
+type Schema struct {
+	Schema               string             `json:"$schema,omitempty"`
+	Type                 interface{}        `json:"type,omitempty"`
+	Format               string             `json:"format,omitempty"`
+	Properties           map[string]*Schema `json:"properties,omitempty"`
+	AdditionalProperties interface{}        `json:"additionalProperties,omitempty"`
+	Items                *Schema            `json:"items,omitempty"`
+}
+
+// NewSchema создает схему настроек, объединяя поля всех переданных сервисов
+func NewSchema(services ...interface{}) *Schema {
+	schema := &Schema{
+		Schema:               jsonSchemaDraft,
+		Type:                 "object",
+		Properties:           make(map[string]*Schema),
+		AdditionalProperties: false,
+	}
+	for _, service := range services {
+		schema.merge(schemaOf(reflect.TypeOf(service)))
+	}
+	return schema
+}
+
+// отдает схему типа
+func schemaOf(t reflect.Type) *Schema {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	switch {
+	case t == durationType:
+		return &Schema{Type: []string{"string", "integer"}}
+	case t == timeType:
+		return &Schema{Type: "string", Format: "date-time"}
+	}
+
+	switch t.Kind() {
+	case reflect.Struct:
+		schema := &Schema{Type: "object", Properties: make(map[string]*Schema), AdditionalProperties: false}
+		schema.addFields(t)
+		return schema
+	case reflect.Map:
+		return &Schema{Type: "object", AdditionalProperties: schemaOf(t.Elem())}
+	case reflect.Slice, reflect.Array:
+		return &Schema{Type: "array", Items: schemaOf(t.Elem())}
+	case reflect.String:
+		return &Schema{Type: "string"}
+	case reflect.Bool:
+		return &Schema{Type: "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return &Schema{Type: "integer"}
+	case reflect.Float32, reflect.Float64:
+		return &Schema{Type: "number"}
+	default:
+		// любое значение
+		return &Schema{}
+	}
+}
+
+// добавляет в схему поля структуры по правилам yaml: имя берется из тега, иначе используется имя поля в нижнем регистре,
+// поля с флагом inline добавляются в структуру, неэкспортируемые поля и поля с тегом "-" пропускаются
+func (s *Schema) addFields(t reflect.Type) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" && !field.Anonymous {
+			continue
+		}
+
+		tag := field.Tag.Get("yaml")
+		if tag == "-" {
+			continue
+		}
+		parts := strings.Split(tag, ",")
+		name := parts[0]
+		inline := false
+		for _, flag := range parts[1:] {
+			inline = inline || flag == "inline"
+		}
+
+		switch {
+		case inline:
+			s.merge(schemaOf(field.Type))
+		case field.PkgPath != "":
+			// неэкспортируемая встроенная структура без флага inline yaml не разбирает
+		default:
+			if name == "" {
+				name = strings.ToLower(field.Name)
+			}
+			s.Properties[name] = schemaOf(field.Type)
+		}
+	}
+}
+
+// объединяет схему с другой схемой, одинаковые поля объединяются рекурсивно
+// используется, т.к. одни и те же разделы настроек, например postmans, разбирают несколько сервисов
+func (s *Schema) merge(other *Schema) {
+	if s.Type == nil {
+		s.Type = other.Type
+		s.Format = other.Format
+	}
+
+	for name, property := range other.Properties {
+		if s.Properties == nil {
+			s.Properties = make(map[string]*Schema)
+		}
+		if current, ok := s.Properties[name]; ok {
+			current.merge(property)
+		} else {
+			s.Properties[name] = property
+		}
+	}
+
+	switch additional := other.AdditionalProperties.(type) {
+	case *Schema:
+		if current, ok := s.AdditionalProperties.(*Schema); ok {
+			current.merge(additional)
+		} else {
+			s.AdditionalProperties = additional
+		}
+	case bool:
+		if s.AdditionalProperties == nil {
+			s.AdditionalProperties = additional
+		}
+	}
+
+	if other.Items != nil {
+		if s.Items == nil {
+			s.Items = other.Items
+		} else {
+			s.Items.merge(other.Items)
+		}
+	}
+}
+
+// Validate ищет в настройках параметры, которых нет в схеме
+// типы значений не проверяются, ошибки типов находят сервисы при разборе настроек
+// path задает раздел настроек, которому соответствует node, например postmans и имя домена
+func (s *Schema) Validate(node *yaml.Node, path ...string) []error {
+	schema := s
+	for _, name := range path {
+		if schema = schema.property(name); schema == nil {
+			return []error{NewConfigError(strings.Join(path, "."), "unknown section")}
+		}
+	}
+	return schema.validate(node, strings.Join(path, "."))
+}
+
+// отдает схему параметра
+func (s *Schema) property(name string) *Schema {
+	if property, ok := s.Properties[name]; ok {
+		return property
+	}
+	additional, _ := s.AdditionalProperties.(*Schema)
+	return additional
+}
+
+func (s *Schema) validate(node *yaml.Node, path string) []error {
+	errs := make([]error, 0)
+	switch node.Kind {
+	case yaml.DocumentNode:
+		for _, content := range node.Content {
+			errs = append(errs, s.validate(content, path)...)
+		}
+	case yaml.AliasNode:
+		errs = append(errs, s.validate(node.Alias, path)...)
+	case yaml.MappingNode:
+		if s.Type != "object" {
+			break
+		}
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key, value := node.Content[i], node.Content[i+1]
+			// ключ слияния добавляет параметры другого узла в текущий
+			if key.Value == "<<" {
+				errs = append(errs, s.validate(value, path)...)
+				continue
+			}
+
+			keyPath := key.Value
+			if path != EmptyStr {
+				keyPath = fmt.Sprintf("%s.%s", path, key.Value)
+			}
+
+			if property, ok := s.Properties[key.Value]; ok {
+				errs = append(errs, property.validate(value, keyPath)...)
+				continue
+			}
+			switch additional := s.AdditionalProperties.(type) {
+			case *Schema:
+				errs = append(errs, additional.validate(value, keyPath)...)
+			case bool:
+				if !additional {
+					errs = append(errs, NewConfigError(keyPath, "unknown key at line %d", key.Line))
+				}
+			}
+		}
+	case yaml.SequenceNode:
+		if s.Items == nil {
+			break
+		}
+		for i, item := range node.Content {
+			errs = append(errs, s.Items.validate(item, fmt.Sprintf("%s[%d]", path, i))...)
+		}
+	}
+	return errs
+}
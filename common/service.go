@@ -1,5 +1,9 @@
 package common
 
+import (
+	"context"
+)
+
 // Программа отправки почты получилась довольно сложной, т.к. она выполняет обработку и отправку писем,
 // работает с диском и с сетью, ведет логирование и проверяет ограничения перед отправкой
 // из - за такого насыщенного функционала, было принято решение разбить программу на логические части - сервисы
@@ -19,6 +23,12 @@ type EventService interface {
 	Event(ev *SendEvent) bool
 }
 
+// ResultService сервис, которому необходим результат отправки письма
+// результат получает сервис получения сообщений и передает его всем сервисам отправки
+type ResultService interface {
+	OnResult(ev *SendEvent, result SendEventResult)
+}
+
 // SendingService сервис принимающий участие в отправке письма
 type SendingService interface {
 	Service
@@ -45,3 +55,21 @@ type GrepService interface {
 	Service
 	OnGrep(*ApplicationEvent)
 }
+
+// DrainingService сервис, который перед остановкой приложения перестает получать письма
+// и дожидается окончания отправки уже полученных писем, пока не закончится контекст
+type DrainingService interface {
+	OnDrain(ctx context.Context)
+}
+
+// ReconfiguringService сервис, который применяет новые настройки, не останавливаясь
+// сервис сравнивает новые настройки с текущими и меняет только то, что изменилось
+type ReconfiguringService interface {
+	OnReconfigure(*ApplicationEvent)
+}
+
+// CheckingService сервис, проверяющий настройки без запуска
+// сервис разбирает настройки так же, как при инициализации, и отдает все найденные проблемы
+type CheckingService interface {
+	OnCheck(*ApplicationEvent) []error
+}
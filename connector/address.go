@@ -0,0 +1,193 @@
+package connector
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Halfi/postmanq/common"
+	"github.com/Halfi/postmanq/storage"
+)
+
+const defaultSidelineDuration = time.Hour
+
+var (
+	// признаки ответа почтового сервиса о том, что ip попал в черный список
+	// обычные отказы тоже говорят о лимитах, репутации и списках адресатов, поэтому признаки - формулировки dnsbl и их адреса
+	blocklistSigns = []string{
+		"blacklist",
+		"black list",
+		"blocklist",
+		"block list",
+		"blocked using",
+		"listed in",
+		"listed at",
+		"banned sending ip",
+		"spamhaus",
+		"spamcop",
+		"barracudacentral",
+		"sorbs.net",
+		"abuseat.org",
+		"uceprotect",
+		"dnsbl",
+	}
+
+	// расширенный код ответа 5.7.x - отказ по политике безопасности, с ним почтовые сервисы отвечают о черных списках
+	blocklistCodeRegex = regexp.MustCompile(`\b5\.7\.\d{1,3}\b`)
+)
+
+// WarmupStep шаг прогрева ip
+type WarmupStep struct {
+	// Day день прогрева, начиная с которого действует шаг, дни считаются с единицы
+	Day int `yaml:"day"`
+
+	// Daily максимальное количество писем в сутки, 0 - без ограничений
+	Daily int `yaml:"daily"`
+
+	// Hourly максимальное количество писем в час, 0 - без ограничений
+	Hourly int `yaml:"hourly"`
+}
+
+// Warmup расписание прогрева ip
+type Warmup struct {
+	// Start дата начала прогрева
+	Start time.Time `yaml:"start"`
+
+	// Schedule шаги прогрева, упорядоченные по дню
+	Schedule []*WarmupStep `yaml:"schedule"`
+}
+
+// отдает ограничения, действующие в указанный момент
+// после последнего шага продолжают действовать его ограничения
+func (w *Warmup) caps(now time.Time) (daily, hourly int) {
+	if w == nil {
+		return
+	}
+
+	day := int(now.Sub(w.Start)/(24*time.Hour)) + 1
+	for _, step := range w.Schedule {
+		if step.Day <= day {
+			daily, hourly = step.Daily, step.Hourly
+		}
+	}
+	return
+}
+
+// ip, с которого отправляются письма
+type sourceAddress struct {
+	ip string
+
+	// расписание прогрева
+	warmup *Warmup
+
+	// дата, до которой ip не используется для отправки
+	sidelinedUntil time.Time
+
+	mutex sync.Mutex
+}
+
+// отдает ключи счетчиков писем за текущий час и текущие сутки
+// счетчики хранятся в хранилище счетчиков, чтобы прогрев был общим для нескольких экземпляров приложения
+func (a *sourceAddress) keys(now time.Time) (hourKey, dayKey string) {
+	day := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	hourKey = fmt.Sprintf("warmup:%s:hour:%d", a.ip, now.Truncate(time.Hour).Unix())
+	dayKey = fmt.Sprintf("warmup:%s:day:%d", a.ip, day.Unix())
+	return
+}
+
+// сигнализирует, что с ip можно отправить письмо, и учитывает письмо в ограничениях прогрева
+// письмо учитывается сразу при выборе ip, чтобы одновременные отправки не превысили ограничения
+// если письмо учтено, reserved равен true и учет нужно снять, если письмо не будет отправлено
+func (a *sourceAddress) reserve(now time.Time) (available, reserved bool) {
+	a.mutex.Lock()
+	sidelinedUntil, warmup := a.sidelinedUntil, a.warmup
+	a.mutex.Unlock()
+
+	if now.Before(sidelinedUntil) {
+		return false, false
+	}
+
+	daily, hourly := warmup.caps(now)
+	if daily == 0 && hourly == 0 {
+		return true, false
+	}
+
+	hourKey, dayKey := a.keys(now)
+	hourCount, _ := storage.Inst().Add(hourKey, 1, time.Hour)
+	dayCount, _ := storage.Inst().Add(dayKey, 1, 24*time.Hour)
+	if (hourly > 0 && hourCount > int64(hourly)) || (daily > 0 && dayCount > int64(daily)) {
+		a.release(now)
+		return false, false
+	}
+	return true, true
+}
+
+// снимает учет письма, учтенного в момент reservedAt
+func (a *sourceAddress) release(reservedAt time.Time) {
+	hourKey, dayKey := a.keys(reservedAt)
+	_, _ = storage.Inst().Add(hourKey, -1, time.Hour)
+	_, _ = storage.Inst().Add(dayKey, -1, 24*time.Hour)
+}
+
+// отстраняет ip от отправки писем на указанное время
+func (a *sourceAddress) sideline(now time.Time, duration time.Duration) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.sidelinedUntil = now.Add(duration)
+}
+
+// сигнализирует, что ip отстранен от отправки писем
+func (a *sourceAddress) sidelined(now time.Time) bool {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return now.Before(a.sidelinedUntil)
+}
+
+// ip всех доменов отправителей
+// состояние ip общее для всех доменов, т.к. репутация принадлежит ip, а не домену
+type sourceAddresses struct {
+	addresses map[string]*sourceAddress
+	rwm       sync.RWMutex
+}
+
+func newSourceAddresses() *sourceAddresses {
+	return &sourceAddresses{addresses: make(map[string]*sourceAddress)}
+}
+
+// добавляет ip или обновляет его расписание прогрева, счетчики при этом сохраняются
+func (s *sourceAddresses) set(ip string, warmup *Warmup) {
+	s.rwm.Lock()
+	defer s.rwm.Unlock()
+	if address, ok := s.addresses[ip]; ok {
+		address.mutex.Lock()
+		address.warmup = warmup
+		address.mutex.Unlock()
+	} else {
+		s.addresses[ip] = &sourceAddress{ip: ip, warmup: warmup}
+	}
+}
+
+func (s *sourceAddresses) get(ip string) (*sourceAddress, bool) {
+	s.rwm.RLock()
+	defer s.rwm.RUnlock()
+	address, ok := s.addresses[ip]
+	return address, ok
+}
+
+// сигнализирует, что ответ почтового сервиса говорит о попадании ip в черный список
+// ответ должен быть постоянной ошибкой с расширенным кодом 5.7.x и формулировкой dnsbl
+func isBlocklistResponse(err *common.MailError) bool {
+	if err == nil || err.Code < 500 || err.Code >= 600 || !blocklistCodeRegex.MatchString(err.Message) {
+		return false
+	}
+
+	message := strings.ToLower(err.Message)
+	for _, sign := range blocklistSigns {
+		if strings.Contains(message, sign) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,195 @@
+package connector
+
+import (
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/Halfi/postmanq/common"
+)
+
+// почтовый сервис в ответе api администрирования
+type mailServerInfo struct {
+	Status string `json:"status"`
+
+	// оставшееся время приостановки отправки
+	ThrottleLeft string `json:"throttleLeft,omitempty"`
+
+	Servers []mxServerInfo `json:"servers"`
+}
+
+// почтовый сервер в ответе api администрирования
+type mxServerInfo struct {
+	Hostname       string     `json:"hostname"`
+	RealServerName string     `json:"realServerName"`
+	IPs            []string   `json:"ips,omitempty"`
+	TLS            bool       `json:"tls"`
+	Relay          string     `json:"relay,omitempty"`
+	Pools          []poolInfo `json:"pools"`
+}
+
+// пул клиентов в ответе api администрирования
+type poolInfo struct {
+	// почтовый сервис и сервер заполняются только в списке пулов
+	Domain string `json:"domain,omitempty"`
+	Mx     string `json:"mx,omitempty"`
+
+	// ip, с которого отправляются письма
+	Address string `json:"address"`
+	Size    int    `json:"size"`
+	Idle    int    `json:"idle"`
+	Broken  bool   `json:"broken"`
+}
+
+// регистрирует обработчики api администрирования сервиса соединений
+func (s *Service) registerAdminHandlers() {
+	common.RegisterAdminHandler(http.MethodGet, "/mx", s.adminMailServers)
+	common.RegisterAdminHandler(http.MethodDelete, "/mx", s.adminForgetMailServers)
+	common.RegisterAdminHandler(http.MethodGet, "/pools", s.adminPools)
+	common.RegisterAdminHandler(http.MethodDelete, "/pools", s.adminClosePools)
+}
+
+// отдает найденные почтовые сервисы, параметр domain выбирает один почтовый сервис
+func (s *Service) adminMailServers(r *http.Request) (interface{}, error) {
+	servers, err := s.adminFind(r)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	infos := make(map[string]mailServerInfo, len(servers))
+	for hostname, server := range servers {
+		mxServers := server.servers()
+		info := mailServerInfo{
+			Status:  server.getStatus().String(),
+			Servers: make([]mxServerInfo, 0, len(mxServers)),
+		}
+		if left := server.throttle.left(now); left > 0 {
+			info.ThrottleLeft = left.Round(time.Second).String()
+		}
+		for _, mxServer := range mxServers {
+			info.Servers = append(info.Servers, mxServer.info())
+		}
+		infos[hostname] = info
+	}
+	return infos, nil
+}
+
+// забывает найденные почтовые сервисы и закрывает соединения их свободных клиентов,
+// при следующей отправке почтовые сервисы ищутся заново, параметр domain выбирает один почтовый сервис
+func (s *Service) adminForgetMailServers(r *http.Request) (interface{}, error) {
+	servers, err := s.adminFind(r)
+	if err != nil {
+		return nil, err
+	}
+
+	mailServers := s.servers()
+	if mailServers == nil {
+		return nil, common.NewAdminError(http.StatusServiceUnavailable, "connection service isn't running")
+	}
+	forgotten := make([]string, 0, len(servers))
+	for hostname := range servers {
+		if mailServers.forget(hostname) {
+			forgotten = append(forgotten, hostname)
+		}
+	}
+	sort.Strings(forgotten)
+	return map[string][]string{"forgotten": forgotten}, nil
+}
+
+// отдает пулы клиентов всех почтовых сервисов, параметр domain выбирает один почтовый сервис
+func (s *Service) adminPools(r *http.Request) (interface{}, error) {
+	servers, err := s.adminFind(r)
+	if err != nil {
+		return nil, err
+	}
+
+	pools := make([]poolInfo, 0)
+	for hostname, server := range servers {
+		for _, mxServer := range server.servers() {
+			for _, pool := range mxServer.info().Pools {
+				pool.Domain = hostname
+				pool.Mx = mxServer.hostname
+				pools = append(pools, pool)
+			}
+		}
+	}
+	sort.Slice(pools, func(i, j int) bool {
+		if pools[i].Domain != pools[j].Domain {
+			return pools[i].Domain < pools[j].Domain
+		}
+		if pools[i].Mx != pools[j].Mx {
+			return pools[i].Mx < pools[j].Mx
+		}
+		return pools[i].Address < pools[j].Address
+	})
+	return pools, nil
+}
+
+// закрывает соединения свободных клиентов, занятые клиенты возвращаются в пул после отправки,
+// параметр domain выбирает один почтовый сервис
+func (s *Service) adminClosePools(r *http.Request) (interface{}, error) {
+	servers, err := s.adminFind(r)
+	if err != nil {
+		return nil, err
+	}
+
+	closed := make([]string, 0, len(servers))
+	for hostname, server := range servers {
+		server.closeIdle()
+		closed = append(closed, hostname)
+	}
+	sort.Strings(closed)
+	return map[string][]string{"closed": closed}, nil
+}
+
+// отдает почтовые сервисы, выбранные параметром domain, или все почтовые сервисы
+func (s *Service) adminFind(r *http.Request) (map[string]*MailServer, error) {
+	mailServers := s.servers()
+	if mailServers == nil {
+		return nil, common.NewAdminError(http.StatusServiceUnavailable, "connection service isn't running")
+	}
+
+	servers := mailServers.all()
+	domain := r.URL.Query().Get("domain")
+	if domain == common.EmptyStr {
+		return servers, nil
+	}
+	server, ok := servers[domain]
+	if !ok {
+		return nil, common.NewAdminError(http.StatusNotFound, "mail server %s isn't found", domain)
+	}
+	return map[string]*MailServer{domain: server}, nil
+}
+
+// отдает описание почтового сервера и его пулов клиентов
+func (m *MxServer) info() mxServerInfo {
+	info := mxServerInfo{
+		Hostname:       m.hostname,
+		RealServerName: m.realServerName,
+		TLS:            m.canUseTLS(),
+		Pools:          make([]poolInfo, 0),
+	}
+	for _, ip := range m.ips {
+		info.IPs = append(info.IPs, ip.String())
+	}
+	if m.relay != nil {
+		info.Relay = m.relay.addr()
+	}
+
+	m.rwm.RLock()
+	defer m.rwm.RUnlock()
+	for address, pool := range m.pools {
+		size, idle := pool.Len()
+		info.Pools = append(info.Pools, poolInfo{
+			Address: address,
+			Size:    size,
+			Idle:    idle,
+			Broken:  pool.Broken(),
+		})
+	}
+	sort.Slice(info.Pools, func(i, j int) bool {
+		return info.Pools[i].Address < info.Pools[j].Address
+	})
+	return info
+}
@@ -0,0 +1,109 @@
+package connector
+
+import (
+	"fmt"
+	"net"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/Halfi/postmanq/common"
+)
+
+// OnCheck проверяет ip, сертификаты, пулы, прогрев и релеи доменов
+func (s *Service) OnCheck(event *common.ApplicationEvent) []error {
+	service := new(Service)
+	if err := yaml.Unmarshal(event.Data, service); err != nil {
+		return []error{err}
+	}
+
+	errs := make([]error, 0)
+	if len(service.Configs) == 0 {
+		errs = append(errs, common.NewConfigError("postmans", "postmans should be defined"))
+	}
+	for name, config := range service.Configs {
+		if config != nil {
+			errs = append(errs, config.check(fmt.Sprintf("postmans.%s", name))...)
+		}
+	}
+	errs = append(errs, checkPool("smtpPool", &service.Pool)...)
+	for name, pool := range service.Pools {
+		if pool != nil {
+			errs = append(errs, checkPool(fmt.Sprintf("smtpPools.%s", name), pool)...)
+		}
+	}
+	return errs
+}
+
+// проверяет ограничения пула, -1 отключает ограничение, 0 - значение по умолчанию
+func checkPool(path string, pool *common.PoolConfig) []error {
+	errs := make([]error, 0)
+	if pool.MaxConnections < common.PoolUnlimited {
+		errs = append(errs, common.NewConfigError(path+".maxConnections", "maxConnections should be -1 or positive"))
+	}
+	if pool.MaxMessages < common.PoolUnlimited {
+		errs = append(errs, common.NewConfigError(path+".maxMessages", "maxMessages should be -1 or positive"))
+	}
+	return errs
+}
+
+// проверяет настройки домена
+func (c *Config) check(path string) []error {
+	errs := make([]error, 0)
+
+	addresses := make(map[string]bool, len(c.Addresses))
+	for i, address := range c.Addresses {
+		if net.ParseIP(address) == nil {
+			errs = append(errs, common.NewConfigError(fmt.Sprintf("%s.ips[%d]", path, i), "wrong ip %q", address))
+		}
+		if addresses[address] {
+			errs = append(errs, common.NewConfigError(fmt.Sprintf("%s.ips[%d]", path, i), "ip %s is duplicated", address))
+		}
+		addresses[address] = true
+	}
+
+	for hostnameTo, pool := range c.Pools {
+		for i, address := range pool {
+			if !addresses[address] {
+				errs = append(errs, common.NewConfigError(fmt.Sprintf("%s.ipPools.%s[%d]", path, hostnameTo, i), "ip %s is not defined in ips", address))
+			}
+		}
+	}
+
+	for address, warmup := range c.Warmups {
+		warmupPath := fmt.Sprintf("%s.ipWarmup.%s", path, address)
+		if !addresses[address] {
+			errs = append(errs, common.NewConfigError(warmupPath, "ip %s is not defined in ips", address))
+		}
+		if warmup == nil {
+			continue
+		}
+		if warmup.Start.IsZero() {
+			errs = append(errs, common.NewConfigError(warmupPath, "start should be defined"))
+		}
+		for i, step := range warmup.Schedule {
+			if step != nil && step.Day < 1 {
+				errs = append(errs, common.NewConfigError(fmt.Sprintf("%s.schedule[%d]", warmupPath, i), "day should be positive"))
+			}
+		}
+	}
+
+	if c.CertFilename != common.EmptyStr {
+		if _, err := loadKeyPair(c.CertFilename, c.PrivateKeyFilename); err != nil {
+			errs = append(errs, common.NewConfigError(path+".certificate", "can't load certificate %s with private key %s: %v", common.PEMSource(c.CertFilename), common.PEMSource(c.PrivateKeyFilename), err))
+		}
+	}
+
+	if c.SidelineDuration < 0 {
+		errs = append(errs, common.NewConfigError(path+".ipSideline", "duration should be positive"))
+	}
+
+	for hostnameTo, relay := range c.Relays {
+		if relay == nil {
+			continue
+		}
+		if err := relay.init(); err != nil {
+			errs = append(errs, common.NewConfigError(fmt.Sprintf("%s.relays.%s", path, hostnameTo), "%v", err))
+		}
+	}
+	return errs
+}
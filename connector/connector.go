@@ -1,6 +1,8 @@
 package connector
 
 import (
+	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"net"
@@ -35,82 +37,100 @@ func (c *Connector) run() {
 // устанавливает соединение к почтовому сервису
 func (c *Connector) connect(event *ConnectionEvent) {
 	logger.By(event.Message.HostnameFrom).Debug("connector#%d-%d try find connection", c.id, event.Message.Id)
-	goto receiveConnect
 
-receiveConnect:
-	event.TryCount++
-	var targetClient *common.SmtpClient
+	// почтовый сервис попросил уменьшить количество соединений или писем, пробуем отправить позже
+	if left := event.server.throttle.left(time.Now()); left > 0 {
+		mailer.ReturnMail(
+			event.SendEvent,
+			fmt.Errorf("connector#%d sending to %s is throttled for %v", c.id, event.Message.HostnameTo, left),
+		)
+		return
+	}
 
-	// смотрим все mx сервера почтового сервиса
-	for _, mxServer := range event.server.mxServers {
-		logger.By(event.Message.HostnameFrom).Debug("connector#%d-%d try receive connection for %s", c.id, event.Message.Id, mxServer.hostname)
+	// ждем свободного клиента не дольше, чем создается новое соединение
+	ctx, cancel := context.WithTimeout(context.Background(), common.App.Timeout().Connection)
+	defer cancel()
 
-		// пробуем получить клиента
-		var ok bool
-		event.Queue, ok = mxServer.queues[event.address]
-		if !ok {
-			event.Queue = common.NewLimitQueue()
-		}
+	var err error
+	for event.TryCount < common.MaxTryConnectionCount {
+		event.TryCount++
 
-		client := event.Queue.Pop()
-		if client != nil {
-			targetClient = client.(*common.SmtpClient)
-			logger.By(event.Message.HostnameFrom).Debug("connector%d-%d found free smtp client#%d", c.id, event.Message.Id, targetClient.Id)
+		var mxServer *MxServer
+		mxServer, event.Pool, event.Client, err = c.receiveClient(ctx, event)
+		if err != nil {
+			break
 		}
 
-		// создаем новое соединение к почтовому сервису
-		// если не удалось найти клиента
-		// или клиент разорвал соединение
-		if (targetClient == nil && !event.Queue.HasLimit()) ||
-			(targetClient != nil && targetClient.Status == common.DisconnectedSmtpClientStatus) {
+		// клиент без соединения, значит в пуле есть место для нового соединения
+		if event.Client.Worker == nil {
 			logger.By(event.Message.HostnameFrom).Debug("connector#%d-%d can't find free smtp client for %s", c.id, event.Message.Id, mxServer.hostname)
-			c.createSmtpClient(mxServer, event, &targetClient)
-		}
-
-		if targetClient != nil {
-			break
+			if !c.createSmtpClient(mxServer, event, event.Client) {
+				event.Pool.Failed(event.Client)
+				event.Client = nil
+				continue
+			}
+			event.Pool.Opened(event.Client)
+		} else {
+			logger.By(event.Message.HostnameFrom).Debug("connector#%d-%d found free smtp client#%d", c.id, event.Message.Id, event.Client.Id)
 		}
-	}
 
-	// если клиент не создан, значит мы создали максимум соединений к почтовому сервису
-	if targetClient == nil {
-		// приостановим работу горутины
-		goto waitConnect
-	} else {
-		targetClient.Wakeup()
-		event.Client = targetClient
 		// передаем событие отправителю
 		next := event.Iterator.Next()
 		if next != nil {
 			next.(common.SendingService).Event(event.SendEvent)
 		}
+		return
 	}
-	return
 
-waitConnect:
-	if event.TryCount >= common.MaxTryConnectionCount {
-		mailer.ReturnMail(
-			event.SendEvent,
-			errors.New(fmt.Sprintf("connector#%d can't connect to %s", c.id, event.Message.HostnameTo)),
-		)
-	} else {
-		logger.By(event.Message.HostnameFrom).Debug("connector#%d-%d can't find free connections, wait...", c.id, event.Message.Id)
-		time.Sleep(common.App.Timeout().Sleep)
-		goto receiveConnect
+	if err == nil {
+		err = errors.New("too many connection attempts")
 	}
-	return
+	mailer.ReturnMail(
+		event.SendEvent,
+		fmt.Errorf("connector#%d can't connect to %s: %w", c.id, event.Message.HostnameTo, err),
+	)
+}
+
+// получает клиента из пулов mx серверов почтового сервиса
+// сначала смотрим все mx сервера, не дожидаясь освобождения клиентов,
+// затем ждем освобождения клиента у первого mx сервера, пул которого открывает соединения
+func (c *Connector) receiveClient(ctx context.Context, event *ConnectionEvent) (*MxServer, *common.ClientPool, *common.SmtpClient, error) {
+	var waitServer *MxServer
+	for _, mxServer := range event.server.servers() {
+		logger.By(event.Message.HostnameFrom).Debug("connector#%d-%d try receive connection for %s", c.id, event.Message.Id, mxServer.hostname)
+
+		pool := mxServer.pool(event.Address)
+		client, err := pool.TryGet(event.Message.Priority)
+		if err == nil {
+			return mxServer, pool, client, nil
+		}
+
+		if errors.Is(err, common.ErrPoolBusy) && waitServer == nil {
+			waitServer = mxServer
+		}
+	}
+
+	if waitServer == nil {
+		return nil, nil, nil, common.ErrPoolBroken
+	}
+
+	logger.By(event.Message.HostnameFrom).Debug("connector#%d-%d can't find free connections, wait...", c.id, event.Message.Id)
+	pool := waitServer.pool(event.Address)
+	client, err := pool.Get(ctx, event.Message.Priority)
+	return waitServer, pool, client, err
 }
 
 // создает соединение к почтовому сервису
-func (c *Connector) createSmtpClient(mxServer *MxServer, event *ConnectionEvent, ptrSmtpClient **common.SmtpClient) {
+// возвращает true, если соединение открыто и клиент готов к отправке письма
+func (c *Connector) createSmtpClient(mxServer *MxServer, event *ConnectionEvent, smtpClient *common.SmtpClient) bool {
 	var tcpAddr net.Addr
-	if event.address != "" {
+	if event.Address != "" {
 		var err error
 		// устанавливаем ip, с которого будем отсылать письмо
-		tcpAddr, err = net.ResolveTCPAddr("tcp", net.JoinHostPort(event.address, "0"))
+		tcpAddr, err = net.ResolveTCPAddr("tcp", net.JoinHostPort(event.Address, "0"))
 		if err != nil {
-			logger.By(event.Message.HostnameFrom).WarnWithErr(err, "connector#%d-%d can't resolve tcp address %s", c.id, event.Message.Id, event.address)
-			return
+			logger.By(event.Message.HostnameFrom).WarnWithErr(err, "connector#%d-%d can't resolve tcp address %s", c.id, event.Message.Id, event.Address)
+			return false
 		}
 
 		logger.By(event.Message.HostnameFrom).Debug("connector#%d-%d resolve tcp address %s", c.id, event.Message.Id, tcpAddr.String())
@@ -120,20 +140,25 @@ func (c *Connector) createSmtpClient(mxServer *MxServer, event *ConnectionEvent,
 		Timeout:   common.App.Timeout().Connection,
 		LocalAddr: tcpAddr,
 	}
-	hostname := net.JoinHostPort(mxServer.hostname, "25")
+	hostname := mxServer.addr()
 	// создаем соединение к почтовому сервису
 	connection, err := dialer.Dial("tcp", hostname)
 	if err != nil {
 		// если не удалось установить соединение,
 		// возможно, на почтовом сервисе стоит ограничение на количество соединений
-		// ставим лимит очереди, чтобы не пытаться открывать новые соединения
-		event.Queue.HasLimitOn()
+		// после нескольких неудачных попыток пул перестанет открывать новые соединения
 		logger.By(event.Message.HostnameFrom).WarnWithErr(err, "connector#%d-%d can't dial to %s", c.id, event.Message.Id, hostname)
-		return
+		dialFailures.WithLabelValues(mxServer.hostname, dialStage).Inc()
+		return false
 	}
 
 	logger.By(event.Message.HostnameFrom).Debug("connector#%d-%d connect to %s", c.id, event.Message.Id, hostname)
 
+	// к релею соединение может сразу устанавливаться защищенным
+	if mxServer.relay != nil && mxServer.relay.TLS == ImplicitRelayTLS {
+		connection = tls.Client(connection, mxServer.relay.tlsConfig(service.getTlsConfig(event.Message.HostnameFrom)))
+	}
+
 	if err := connection.SetDeadline(time.Now().Add(common.App.Timeout().Hello)); err != nil {
 		logger.By(event.Message.HostnameFrom).WarnWithErr(err, "can't set connection deadline to %s", time.Now().Add(common.App.Timeout().Hello))
 	}
@@ -142,90 +167,113 @@ func (c *Connector) createSmtpClient(mxServer *MxServer, event *ConnectionEvent,
 	if err != nil {
 		// если не удалось создать клиента,
 		// возможно, на почтовом сервисе стоит ограничение на количество активных клиентов
-		// ставим лимит очереди, чтобы не пытаться открывать новые соединения и не создавать новые клиенты
-		event.Queue.HasLimitOn()
 		if err := connection.Close(); err != nil {
 			logger.By(event.Message.HostnameFrom).WarnWithErr(err, "can't close connector")
 		}
 
 		logger.By(event.Message.HostnameFrom).WarnWithErr(err, "connector#%d-%d can't create client to %s", c.id, event.Message.Id, mxServer.hostname)
-		return
+		dialFailures.WithLabelValues(mxServer.hostname, greetingStage).Inc()
+		return false
 	}
 
 	logger.By(event.Message.HostnameFrom).Debug("connector#%d-%d create client to %s", c.id, event.Message.Id, mxServer.hostname)
+	started := time.Now()
 	err = client.Hello(service.getHostname(event.Message.HostnameFrom))
+	common.ObserveSmtpCommand(common.HeloSmtpCommand, started, err)
 	if err != nil {
 		if err := client.Quit(); err != nil {
 			logger.By(event.Message.HostnameFrom).WarnWithErr(err, "can't quit from client")
 		}
 
 		logger.By(event.Message.HostnameFrom).Debug("connector#%d-%d can't create client to %s, err - %v", c.id, event.Message.Id, mxServer.hostname, err)
-		return
+		dialFailures.WithLabelValues(mxServer.hostname, helloStage).Inc()
+		return false
 	}
 
 	logger.By(event.Message.HostnameFrom).Debug("connector#%d-%d send command HELLO: %s", c.id, event.Message.Id, event.Message.HostnameFrom)
+	if mxServer.relay != nil {
+		return c.initRelaySmtpClient(mxServer, event, smtpClient, connection, client)
+	}
+
 	// проверяем доступно ли TLS
-	if mxServer.useTLS {
-		mxServer.useTLS, _ = client.Extension("STARTTLS")
+	useTLS := mxServer.canUseTLS()
+	if useTLS {
+		if useTLS, _ = client.Extension("STARTTLS"); !useTLS {
+			mxServer.dontUseTLS()
+		}
 	}
-	logger.By(event.Message.HostnameFrom).Debug("connector#%d-%d use TLS %v", c.id, event.Message.Id, mxServer.useTLS)
+	logger.By(event.Message.HostnameFrom).Debug("connector#%d-%d use TLS %v", c.id, event.Message.Id, useTLS)
 	// создаем TLS или обычное соединение
-	if mxServer.useTLS {
-		c.initTlsSmtpClient(mxServer, event, ptrSmtpClient, connection, client)
-	} else {
-		c.initSmtpClient(mxServer, event, ptrSmtpClient, connection, client)
+	if useTLS {
+		return c.initTlsSmtpClient(mxServer, event, smtpClient, connection, client)
 	}
+	return c.initSmtpClient(mxServer, event, smtpClient, connection, client)
 }
 
 // открывает защищенное соединение
-func (c *Connector) initTlsSmtpClient(mxServer *MxServer, event *ConnectionEvent, ptrSmtpClient **common.SmtpClient, connection net.Conn, client *smtp.Client) {
+func (c *Connector) initTlsSmtpClient(mxServer *MxServer, event *ConnectionEvent, smtpClient *common.SmtpClient, connection net.Conn, client *smtp.Client) bool {
 	// если есть какие данные о сертификате и к серверу можно создать TLS соединение
 	conf := service.getTlsConfig(event.Message.HostnameFrom)
-	if conf != nil && mxServer.useTLS {
-		// открываем TLS соединение
-		err := client.StartTLS(conf)
-		// если все нормально, создаем клиента
-		if err == nil {
-			c.initSmtpClient(mxServer, event, ptrSmtpClient, connection, client)
-		} else {
-			// если не удалось создать TLS соединение
-			// говорим, что не надо больше создавать TLS соединение
-			mxServer.dontUseTLS()
-			// разрываем созданое соединение
-			// это необходимо, т.к. не все почтовые сервисы позволяют продолжить отправку письма
-			// после неудачной попытке создать TLS соединение
-			if err := client.Quit(); err != nil {
-				logger.By(event.Message.HostnameFrom).WarnWithErr(err, "can't quit from client")
-			}
-			// создаем обычное соединие
-			c.createSmtpClient(mxServer, event, ptrSmtpClient)
-		}
-	} else {
-		c.initSmtpClient(mxServer, event, ptrSmtpClient, connection, client)
+	if conf == nil || !mxServer.canUseTLS() {
+		return c.initSmtpClient(mxServer, event, smtpClient, connection, client)
+	}
+
+	// открываем TLS соединение
+	// если все нормально, создаем клиента
+	if err := client.StartTLS(conf); err == nil {
+		return c.initSmtpClient(mxServer, event, smtpClient, connection, client)
 	}
+
+	// если не удалось создать TLS соединение
+	// говорим, что не надо больше создавать TLS соединение
+	mxServer.dontUseTLS()
+	// разрываем созданое соединение
+	// это необходимо, т.к. не все почтовые сервисы позволяют продолжить отправку письма
+	// после неудачной попытке создать TLS соединение
+	if err := client.Quit(); err != nil {
+		logger.By(event.Message.HostnameFrom).WarnWithErr(err, "can't quit from client")
+	}
+	// создаем обычное соединие
+	return c.createSmtpClient(mxServer, event, smtpClient)
 }
 
-// создает или инициализирует клиента
-func (c *Connector) initSmtpClient(mxServer *MxServer, event *ConnectionEvent, ptrSmtpClient **common.SmtpClient, connection net.Conn, client *smtp.Client) {
-	isNil := *ptrSmtpClient == nil
-	if isNil {
-		var count int
-		for _, queue := range mxServer.queues {
-			count += queue.MaxLen()
+// открывает защищенное соединение к релею и проходит аутентификацию
+// в отличие от mx серверов, к релею нельзя переходить на обычное соединение, иначе пароль уйдет в открытом виде
+func (c *Connector) initRelaySmtpClient(mxServer *MxServer, event *ConnectionEvent, smtpClient *common.SmtpClient, connection net.Conn, client *smtp.Client) bool {
+	relay := mxServer.relay
+	quit := func(err error, message string) bool {
+		if err := client.Quit(); err != nil {
+			logger.By(event.Message.HostnameFrom).WarnWithErr(err, "can't quit from client")
+		}
+		logger.By(event.Message.HostnameFrom).WarnWithErr(err, "connector#%d-%d %s %s", c.id, event.Message.Id, message, relay.addr())
+		return false
+	}
+
+	if relay.TLS == StartTLSRelayTLS {
+		if ok, _ := client.Extension("STARTTLS"); !ok {
+			return quit(nil, "relay doesn't support STARTTLS")
 		}
-		*ptrSmtpClient = &common.SmtpClient{
-			Id: count + 1,
+
+		if err := client.StartTLS(relay.tlsConfig(service.getTlsConfig(event.Message.HostnameFrom))); err != nil {
+			return quit(err, "can't start tls to relay")
 		}
-		// увеличиваем максимальную длину очереди
-		event.Queue.AddMaxLen()
 	}
-	smtpClient := *ptrSmtpClient
+
+	if auth := relay.smtpAuth(); auth != nil {
+		if err := client.Auth(auth); err != nil {
+			return quit(err, "can't authenticate on relay")
+		}
+		logger.By(event.Message.HostnameFrom).Debug("connector#%d-%d authenticate on relay %s as %s", c.id, event.Message.Id, relay.addr(), relay.Username)
+	}
+
+	return c.initSmtpClient(mxServer, event, smtpClient, connection, client)
+}
+
+// инициализирует клиента открытым соединением
+func (c *Connector) initSmtpClient(mxServer *MxServer, event *ConnectionEvent, smtpClient *common.SmtpClient, connection net.Conn, client *smtp.Client) bool {
 	smtpClient.Conn = connection
 	smtpClient.Worker = client
 	smtpClient.ModifyDate = time.Now()
-	if isNil {
-		logger.By(event.Message.HostnameFrom).Debug("connector#%d-%d create smtp client#%d for %s", c.id, event.Message.Id, smtpClient.Id, mxServer.hostname)
-	} else {
-		logger.By(event.Message.HostnameFrom).Debug("connector#%d-%d reopen smtp client#%d for %s", c.id, event.Message.Id, smtpClient.Id, mxServer.hostname)
-	}
+	logger.By(event.Message.HostnameFrom).Debug("connector#%d-%d create smtp client#%d for %s", c.id, event.Message.Id, smtpClient.Id, mxServer.hostname)
+	return true
 }
@@ -0,0 +1,134 @@
+package connector
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/Halfi/postmanq/common"
+)
+
+// этапы открытия соединения, на которых учитываются ошибки
+const (
+	dialStage     = "dial"
+	greetingStage = "greeting"
+	helloStage    = "hello"
+)
+
+// метка почтового сервиса, имя которого не определилось
+const unknownServerLabel = "unknown"
+
+var (
+	// количество писем, отправленных с ip, по результату отправки
+	sourceAddressMessages = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "postmanq",
+		Subsystem: "connector",
+		Name:      "source_ip_messages_total",
+		Help:      "Messages sent from source ip by result.",
+	}, []string{"ip", "result"})
+
+	// отстранен ли ip от отправки писем
+	sourceAddressSidelined = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "postmanq",
+		Subsystem: "connector",
+		Name:      "source_ip_sidelined",
+		Help:      "Whether source ip is sidelined after blocklist responses.",
+	}, []string{"ip"})
+
+	// количество писем, для которых не нашлось доступного ip
+	sourceAddressUnavailable = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "postmanq",
+		Subsystem: "connector",
+		Name:      "source_ip_unavailable_total",
+		Help:      "Messages delayed because every source ip was capped or sidelined.",
+	}, []string{"postman"})
+
+	// количество приостановок отправки на почтовый сервис после ответов 421 и 451
+	throttledServers = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "postmanq",
+		Subsystem: "connector",
+		Name:      "throttled_total",
+		Help:      "Times sending to mail provider was backed off after throttling responses.",
+	}, []string{"provider"})
+
+	// количество неудачных попыток открыть соединение с mx сервером по этапам
+	dialFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "postmanq",
+		Subsystem: "connector",
+		Name:      "dial_failures_total",
+		Help:      "Failed connection attempts to mx server by stage.",
+	}, []string{"mx", "stage"})
+
+	// время поиска mx серверов
+	dnsLookupDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "postmanq",
+		Subsystem: "connector",
+		Name:      "dns_lookup_duration_seconds",
+		Help:      "MX lookup latency by status.",
+	}, []string{"status"})
+
+	poolConnectionsDesc = prometheus.NewDesc(
+		"postmanq_connector_pool_connections",
+		"Open connections of client pools to mx server from source ip.",
+		[]string{"mx", "ip"}, nil,
+	)
+	poolIdleDesc = prometheus.NewDesc(
+		"postmanq_connector_pool_idle_clients",
+		"Idle clients of client pools to mx server from source ip.",
+		[]string{"mx", "ip"}, nil,
+	)
+	poolBrokenDesc = prometheus.NewDesc(
+		"postmanq_connector_pool_broken",
+		"Whether client pool to mx server from source ip stopped opening connections.",
+		[]string{"mx", "ip"}, nil,
+	)
+)
+
+// собирает размеры пулов клиентов при каждом запросе метрик
+// один mx сервер может обслуживать несколько почтовых сервисов, тогда их пулы складываются
+type poolsCollector struct{}
+
+func (poolsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- poolConnectionsDesc
+	ch <- poolIdleDesc
+	ch <- poolBrokenDesc
+}
+
+func (poolsCollector) Collect(ch chan<- prometheus.Metric) {
+	// почтовые сервисы заменяются при запуске и остановке, поэтому читаются под семафором сервиса
+	mailServers := service.servers()
+	if mailServers == nil {
+		return
+	}
+
+	type poolKey struct{ mx, ip string }
+	pools := make(map[poolKey]*poolInfo)
+	for _, server := range mailServers.all() {
+		for _, mxServer := range server.servers() {
+			for _, pool := range mxServer.info().Pools {
+				key := poolKey{mx: mxServer.hostname, ip: pool.Address}
+				sum, ok := pools[key]
+				if !ok {
+					sum = new(poolInfo)
+					pools[key] = sum
+				}
+				sum.Size += pool.Size
+				sum.Idle += pool.Idle
+				sum.Broken = sum.Broken || pool.Broken
+			}
+		}
+	}
+
+	for key, pool := range pools {
+		ip := key.ip
+		if ip == common.EmptyStr {
+			ip = "default"
+		}
+		broken := 0.0
+		if pool.Broken {
+			broken = 1
+		}
+		ch <- prometheus.MustNewConstMetric(poolConnectionsDesc, prometheus.GaugeValue, float64(pool.Size), key.mx, ip)
+		ch <- prometheus.MustNewConstMetric(poolIdleDesc, prometheus.GaugeValue, float64(pool.Idle), key.mx, ip)
+		ch <- prometheus.MustNewConstMetric(poolBrokenDesc, prometheus.GaugeValue, broken, key.mx, ip)
+	}
+}
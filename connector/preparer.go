@@ -15,13 +15,13 @@ type Preparer struct {
 	// Идентификатор для логов
 	id int
 
-	events          chan *common.SendEvent
+	events          <-chan *common.SendEvent
 	connectorEvents chan *ConnectionEvent
 	seekerEvents    chan *ConnectionEvent
 }
 
 // создает и запускает нового заготовщика
-func newPreparer(id int, events chan *common.SendEvent, connectorEvents, seekerEvents chan *ConnectionEvent) *Preparer {
+func newPreparer(id int, events <-chan *common.SendEvent, connectorEvents, seekerEvents chan *ConnectionEvent) *Preparer {
 	return &Preparer{id: id, events: events, connectorEvents: connectorEvents, seekerEvents: seekerEvents}
 }
 
@@ -36,11 +36,25 @@ func (p *Preparer) run() {
 func (p *Preparer) prepare(event *common.SendEvent) {
 	logger.By(event.Message.HostnameFrom).Info("preparer#%d-%d try create connection", p.id, event.Message.Id)
 
+	// ip мог быть выбран ограничителем
+	address, ok := event.Address, true
+	if address == common.EmptyStr {
+		address, ok = service.getAddress(event, p.id)
+	}
+	if !ok {
+		// все ip превысили ограничения прогрева или отстранены от отправки, пробуем отправить позже
+		mailer.ReturnMail(
+			event,
+			errors.New(fmt.Sprintf("preparer#%d-%d can't find available ip for %s", p.id, event.Message.Id, event.Message.HostnameTo)),
+		)
+		return
+	}
+
+	event.Address = address
 	connectionEvent := &ConnectionEvent{
 		SendEvent:   event,
 		servers:     make(chan *MailServer, 1),
 		connectorId: p.id,
-		address:     service.getAddress(event.Message.HostnameFrom, p.id),
 	}
 	goto connectToMailServer
 
@@ -48,17 +62,19 @@ connectToMailServer:
 	// отправляем событие сбора информации о сервере
 	p.seekerEvents <- connectionEvent
 	server := <-connectionEvent.servers
-	switch server.status {
+	switch server.getStatus() {
 	case LookupMailServerStatus:
 		goto waitLookup
 	case SuccessMailServerStatus:
 		connectionEvent.server = server
 		p.connectorEvents <- connectionEvent
+		return
 	case ErrorMailServerStatus:
 		mailer.ReturnMail(
 			event,
 			errors.New(fmt.Sprintf("511 preparer#%d-%d can't lookup %s", p.id, event.Message.Id, event.Message.HostnameTo)),
 		)
+		return
 	}
 
 waitLookup:
@@ -0,0 +1,219 @@
+package connector
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/smtp"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// RelayTLS способ установки защищенного соединения к релею
+type RelayTLS string
+
+const (
+	// StartTLSRelayTLS соединение переводится в защищенное командой STARTTLS
+	StartTLSRelayTLS RelayTLS = "starttls"
+
+	// ImplicitRelayTLS соединение сразу устанавливается защищенным
+	ImplicitRelayTLS RelayTLS = "implicit"
+
+	// NoneRelayTLS соединение не защищается
+	NoneRelayTLS RelayTLS = "none"
+)
+
+// RelayAuth механизм аутентификации на релее
+type RelayAuth string
+
+const (
+	NoneRelayAuth    RelayAuth = "none"
+	PlainRelayAuth   RelayAuth = "plain"
+	LoginRelayAuth   RelayAuth = "login"
+	XOAuth2RelayAuth RelayAuth = "xoauth2"
+)
+
+var (
+	// порты по умолчанию для каждого способа установки защищенного соединения
+	relayTLSPorts = map[RelayTLS]int{
+		StartTLSRelayTLS: 587,
+		ImplicitRelayTLS: 465,
+		NoneRelayTLS:     25,
+	}
+)
+
+// Relay почтовый сервер, через который отправляются письма вместо mx серверов получателя
+type Relay struct {
+	// Host хост релея
+	Host string `yaml:"host"`
+
+	// Port порт релея, по умолчанию зависит от способа установки защищенного соединения
+	Port int `yaml:"port"`
+
+	// TLS способ установки защищенного соединения, по умолчанию starttls, для 465 порта implicit
+	TLS RelayTLS `yaml:"tls"`
+
+	// Auth механизм аутентификации, по умолчанию plain, если указан пользователь
+	Auth RelayAuth `yaml:"auth"`
+
+	// Username пользователь
+	Username string `yaml:"username"`
+
+	// Password пароль или токен для xoauth2
+	Password string `yaml:"password"`
+
+	// PasswordFile файл, из которого читается пароль
+	PasswordFile string `yaml:"passwordFile"`
+
+	// PasswordEnv переменная окружения, из которой читается пароль
+	PasswordEnv string `yaml:"passwordEnv"`
+
+	// пароль, полученный из настроек, файла или переменной окружения
+	password string
+}
+
+// инициализирует значения по умолчанию и получает пароль
+func (r *Relay) init() error {
+	if r.Host == "" {
+		return errors.New("relay host should be defined")
+	}
+
+	if r.TLS == "" {
+		if r.Port == relayTLSPorts[ImplicitRelayTLS] {
+			r.TLS = ImplicitRelayTLS
+		} else {
+			r.TLS = StartTLSRelayTLS
+		}
+	}
+
+	port, ok := relayTLSPorts[r.TLS]
+	if !ok {
+		return fmt.Errorf("unknown relay tls %s", r.TLS)
+	}
+
+	if r.Port == 0 {
+		r.Port = port
+	}
+
+	r.password = r.Password
+	switch {
+	case r.PasswordFile != "":
+		password, err := ioutil.ReadFile(r.PasswordFile)
+		if err != nil {
+			return fmt.Errorf("can't read relay password file %s: %w", r.PasswordFile, err)
+		}
+		r.password = strings.TrimSpace(string(password))
+	case r.PasswordEnv != "":
+		r.password = os.Getenv(r.PasswordEnv)
+	}
+
+	if r.Auth == "" {
+		if r.Username == "" {
+			r.Auth = NoneRelayAuth
+		} else {
+			r.Auth = PlainRelayAuth
+		}
+	}
+
+	switch r.Auth {
+	case NoneRelayAuth:
+	case PlainRelayAuth, LoginRelayAuth, XOAuth2RelayAuth:
+		if r.Username == "" || r.password == "" {
+			return fmt.Errorf("relay %s auth requires username and password", r.Auth)
+		}
+		if r.TLS == NoneRelayTLS {
+			return fmt.Errorf("relay %s auth requires tls", r.Auth)
+		}
+	default:
+		return fmt.Errorf("unknown relay auth %s", r.Auth)
+	}
+
+	return nil
+}
+
+// адрес релея
+func (r *Relay) addr() string {
+	return net.JoinHostPort(r.Host, strconv.Itoa(r.Port))
+}
+
+// ключ релея, письма через один и тот же релей от одного пользователя используют общие соединения
+func (r *Relay) key() string {
+	return fmt.Sprintf("relay:%s@%s", r.Username, r.addr())
+}
+
+// отдает настройки защищенного соединения к релею
+func (r *Relay) tlsConfig(conf *tls.Config) *tls.Config {
+	tlsConfig := &tls.Config{
+		ServerName: r.Host,
+		MinVersion: tls.VersionTLS12,
+	}
+	if conf != nil {
+		tlsConfig.Certificates = conf.Certificates
+	}
+	return tlsConfig
+}
+
+// отдает механизм аутентификации
+func (r *Relay) smtpAuth() smtp.Auth {
+	switch r.Auth {
+	case PlainRelayAuth:
+		return smtp.PlainAuth("", r.Username, r.password, r.Host)
+	case LoginRelayAuth:
+		return &loginAuth{username: r.Username, password: r.password}
+	case XOAuth2RelayAuth:
+		return &xoauth2Auth{username: r.Username, token: r.password}
+	default:
+		return nil
+	}
+}
+
+// аутентификация LOGIN
+type loginAuth struct {
+	username, password string
+}
+
+func (a *loginAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	if !server.TLS {
+		return "", nil, errors.New("unencrypted connection")
+	}
+	return "LOGIN", nil, nil
+}
+
+func (a *loginAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if !more {
+		return nil, nil
+	}
+
+	prompt := strings.ToLower(strings.TrimSpace(string(fromServer)))
+	switch {
+	case strings.HasPrefix(prompt, "username"):
+		return []byte(a.username), nil
+	case strings.HasPrefix(prompt, "password"):
+		return []byte(a.password), nil
+	default:
+		return nil, fmt.Errorf("unexpected server challenge %s", fromServer)
+	}
+}
+
+// аутентификация XOAUTH2
+type xoauth2Auth struct {
+	username, token string
+}
+
+func (a *xoauth2Auth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	if !server.TLS {
+		return "", nil, errors.New("unencrypted connection")
+	}
+	return "XOAUTH2", []byte(fmt.Sprintf("user=%s\x01auth=Bearer %s\x01\x01", a.username, a.token)), nil
+}
+
+func (a *xoauth2Auth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if more {
+		// сервер прислал описание ошибки, отвечаем пустой строкой, чтобы получить код ошибки
+		return []byte{}, nil
+	}
+	return nil, nil
+}
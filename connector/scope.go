@@ -0,0 +1,123 @@
+package connector
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Halfi/postmanq/common"
+)
+
+// время, в течение которого не повторяется поиск имени почтового сервиса, если mx серверы домена не нашлись
+const serverNameFailureTTL = time.Minute
+
+// реальные имена почтовых сервисов, в качестве ключа используется домен получателя
+type serverNames struct {
+	names map[string]*serverName
+	rwm   sync.RWMutex
+}
+
+// имя почтового сервиса
+type serverName struct {
+	name string
+
+	// дата, после которой имя нужно найти заново, нулевая дата - имя не устаревает
+	expire time.Time
+}
+
+// создает хранилище реальных имен почтовых сервисов
+func newServerNames() *serverNames {
+	return &serverNames{names: make(map[string]*serverName)}
+}
+
+// отдает имя почтового сервиса, если имя не нашлось при последнем поиске, отдается пустое имя
+func (s *serverNames) get(hostname string) (string, bool) {
+	s.rwm.RLock()
+	defer s.rwm.RUnlock()
+	name, ok := s.names[hostname]
+	if !ok || (!name.expire.IsZero() && time.Now().After(name.expire)) {
+		return common.EmptyStr, false
+	}
+	return name.name, true
+}
+
+func (s *serverNames) set(hostname, name string) {
+	s.rwm.Lock()
+	defer s.rwm.Unlock()
+	s.names[hostname] = &serverName{name: name}
+}
+
+// запоминает, что имя не нашлось, чтобы не искать его для каждого письма
+func (s *serverNames) fail(hostname string) {
+	s.rwm.Lock()
+	defer s.rwm.Unlock()
+	s.names[hostname] = &serverName{expire: time.Now().Add(serverNameFailureTTL)}
+}
+
+// SourceAddress отдает ip, с которого будет отправлено письмо
+// используется ограничителем, чтобы учитывать письма по ip, выбранный ip сохраняется в событии и используется заготовщиком
+// если доступных ip нет, вернется false
+func SourceAddress(event *common.SendEvent) (string, bool) {
+	if service == nil {
+		return common.EmptyStr, false
+	}
+	return service.getAddress(event, int(event.Message.Id))
+}
+
+// ServerName отдает реальное имя почтового сервиса получателя, например outlook.com для всех доменов,
+// обслуживаемых mx серверами outlook.com, если письмо отправляется через релей, отдает хост релея
+// имя определяется по первому mx серверу домена и запоминается, если mx серверы не нашлись, отдается пустое имя,
+// а поиск повторяется не раньше, чем через serverNameFailureTTL
+func ServerName(hostnameFrom, hostnameTo string) string {
+	if service == nil {
+		return common.EmptyStr
+	}
+
+	if relay := service.getRelay(hostnameFrom, hostnameTo); relay != nil {
+		return relay.Host
+	}
+
+	if name, ok := service.serverNames.get(hostnameTo); ok {
+		return name
+	}
+
+	mxes, err := lookupMX(hostnameTo)
+	if err != nil || len(mxes) == 0 {
+		service.serverNames.fail(hostnameTo)
+		return common.EmptyStr
+	}
+
+	name := seekRealServerName(mxes[0].Host)
+	service.serverNames.set(hostnameTo, name)
+	return name
+}
+
+// ServerLabel отдает реальное имя почтового сервиса получателя для меток метрик,
+// количество почтовых сервисов намного меньше количества доменов получателей, поэтому рядов метрик немного
+// если имя не определилось, отдается unknown
+func ServerLabel(hostnameFrom, hostnameTo string) string {
+	if name := ServerName(hostnameFrom, hostnameTo); name != common.EmptyStr {
+		return name
+	}
+	return unknownServerLabel
+}
+
+// ищет реальное имя почтового сервиса по имени mx сервера
+func seekRealServerName(hostname string) string {
+	parts := strings.Split(hostname, ".")
+	partsLen := len(parts)
+	if partsLen < 3 {
+		return strings.TrimRight(hostname, ".")
+	}
+	hostname = strings.Join(parts[partsLen-3:partsLen-1], ".")
+	mxes, err := lookupMX(hostname)
+	if err == nil && len(mxes) > 0 {
+		if strings.Contains(mxes[0].Host, hostname) {
+			return hostname
+		} else {
+			return seekRealServerName(mxes[0].Host)
+		}
+	} else {
+		return hostname
+	}
+}
@@ -1,8 +1,12 @@
 package connector
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"net"
 	"strings"
+	"time"
 
 	"github.com/Halfi/postmanq/logger"
 )
@@ -30,57 +34,88 @@ func (s *Seeker) run() {
 
 // ищет информацию о сервере
 func (s *Seeker) seek(event *ConnectionEvent) {
+	if relay := service.getRelay(event.Message.HostnameFrom, event.Message.HostnameTo); relay != nil {
+		s.seekRelay(event, relay)
+		return
+	}
+
 	hostnameTo := event.Message.HostnameTo
 	// добавляем новый почтовый домен
-	mailServer, ok := s.mailServers.Get(hostnameTo)
-	if !ok {
-		logger.By(event.Message.HostnameFrom).Debug("seeker#%d-%d create mail server for %s", event.connectorId, event.Message.Id, hostnameTo)
-		mailServer = &MailServer{
+	mailServer, created := s.mailServers.GetOrSet(hostnameTo, func() *MailServer {
+		return &MailServer{
 			status:      LookupMailServerStatus,
 			connectorId: event.connectorId,
 		}
-		s.mailServers.Set(hostnameTo, mailServer)
+	})
+	if created {
+		logger.By(event.Message.HostnameFrom).Debug("seeker#%d-%d create mail server for %s", event.connectorId, event.Message.Id, hostnameTo)
 	}
 
 	// если пришло несколько несколько писем на один почтовый сервис,
 	// и информация о сервисе еще не собрана,
 	// то таким образом блокируем повторную попытку собрать инфомацию о почтовом сервисе
-	if event.connectorId == mailServer.connectorId && mailServer.status == LookupMailServerStatus {
+	if event.connectorId == mailServer.connectorId && mailServer.getStatus() == LookupMailServerStatus {
 		logger.By(event.Message.HostnameFrom).Debug("seeker#%d-%d look up mx domains for %s...", s.id, event.Message.Id, hostnameTo)
 		// ищем почтовые сервера для домена
-		mxes, err := net.LookupMX(hostnameTo)
+		mxes, err := lookupMX(hostnameTo)
 		if err == nil {
-			mailServer.mxServers = make([]*MxServer, len(mxes))
+			mxServers := make([]*MxServer, len(mxes))
 			for i, mx := range mxes {
 				mxHostname := strings.TrimRight(mx.Host, ".")
 				logger.By(event.Message.HostnameFrom).Debug("seeker#%d-%d look up mx domain %s for %s", s.id, event.Message.Id, mxHostname, hostnameTo)
-				mxServer := newMxServer(mxHostname, event.Message.HostnameFrom)
-				mxServer.realServerName = s.seekRealServerName(mx.Host)
+				mxServer := newMxServer(mxHostname)
+				mxServer.realServerName = seekRealServerName(mx.Host)
 				logger.By(event.Message.HostnameFrom).Debug("seeker#%d-%d look up detect real server name %s", s.id, event.Message.Id, mxServer.realServerName)
-				mailServer.mxServers[i] = mxServer
+				mxServers[i] = mxServer
 			}
-			mailServer.status = SuccessMailServerStatus
+			if len(mxServers) > 0 {
+				service.serverNames.set(hostnameTo, mxServers[0].realServerName)
+			}
+			mailServer.resolve(SuccessMailServerStatus, mxServers)
 			logger.By(event.Message.HostnameFrom).Debug("seeker#%d-%d look up %s success", s.id, event.Message.Id, hostnameTo)
 		} else {
-			mailServer.status = ErrorMailServerStatus
+			mailServer.resolve(ErrorMailServerStatus, nil)
 			logger.By(event.Message.HostnameFrom).Warn("seeker#%d-%d can't look up mx domains for %s", s.id, event.Message.Id, hostnameTo)
 		}
 	}
 	event.servers <- mailServer
 }
 
-func (s *Seeker) seekRealServerName(hostname string) string {
-	parts := strings.Split(hostname, ".")
-	partsLen := len(parts)
-	hostname = strings.Join(parts[partsLen-3:partsLen-1], ".")
-	mxes, err := net.LookupMX(hostname)
-	if err == nil {
-		if strings.Contains(mxes[0].Host, hostname) {
-			return hostname
-		} else {
-			return s.seekRealServerName(mxes[0].Host)
+// отдает почтовый сервис для релея, поиск mx серверов не выполняется
+func (s *Seeker) seekRelay(event *ConnectionEvent, relay *Relay) {
+	key := relay.key()
+	mailServer, created := s.mailServers.GetOrSet(key, func() *MailServer {
+		return &MailServer{
+			mxServers:   []*MxServer{newRelayServer(relay)},
+			connectorId: event.connectorId,
+			status:      SuccessMailServerStatus,
 		}
-	} else {
-		return hostname
+	})
+	if created {
+		logger.By(event.Message.HostnameFrom).Debug("seeker#%d-%d create relay %s for %s", s.id, event.Message.Id, relay.addr(), event.Message.HostnameTo)
+	}
+	event.servers <- mailServer
+}
+
+// ищет mx серверы домена и учитывает время поиска
+func lookupMX(hostname string) ([]*net.MX, error) {
+	started := time.Now()
+	mxes, err := net.LookupMX(hostname)
+	status := "ok"
+	if err != nil {
+		status = "error"
+	}
+	dnsLookupDuration.WithLabelValues(status).Observe(time.Since(started).Seconds())
+	return mxes, err
+}
+
+// проверяет, что DNS сервер отвечает, без него не найти mx серверы получателей
+// запрашиваются NS записи корневой зоны, ответ без записей тоже означает, что DNS сервер доступен
+func checkResolver(ctx context.Context) error {
+	_, err := net.DefaultResolver.LookupNS(ctx, ".")
+	var dnsErr *net.DNSError
+	if err != nil && !(errors.As(err, &dnsErr) && dnsErr.IsNotFound) {
+		return fmt.Errorf("dns server isn't available: %w", err)
 	}
+	return nil
 }
@@ -2,6 +2,7 @@ package connector
 
 import (
 	"net"
+	"sync"
 
 	"github.com/Halfi/postmanq/common"
 )
@@ -20,6 +21,18 @@ const (
 	ErrorMailServerStatus
 )
 
+func (s MailServerStatus) String() string {
+	switch s {
+	case LookupMailServerStatus:
+		return "lookup"
+	case SuccessMailServerStatus:
+		return "success"
+	case ErrorMailServerStatus:
+		return "error"
+	}
+	return "unknown"
+}
+
 // почтовый сервис
 type MailServer struct {
 	// серверы почтового сервиса
@@ -30,6 +43,91 @@ type MailServer struct {
 
 	// статус, говорящий о том, собранали ли информация о почтовом сервисе
 	status MailServerStatus
+
+	// серверы и статус меняет искатель, пока их читают заготовщики, api администрирования и метрики
+	rwm sync.RWMutex
+
+	// приостановка отправки после ответов 421 и 451
+	throttle throttle
+}
+
+// отдает статус почтового сервиса
+func (m *MailServer) getStatus() MailServerStatus {
+	m.rwm.RLock()
+	defer m.rwm.RUnlock()
+	return m.status
+}
+
+// отдает серверы почтового сервиса, найденные серверы не меняются, поэтому срез можно читать без блокировки
+func (m *MailServer) servers() []*MxServer {
+	m.rwm.RLock()
+	defer m.rwm.RUnlock()
+	return m.mxServers
+}
+
+// сохраняет результат поиска серверов почтового сервиса
+func (m *MailServer) resolve(status MailServerStatus, mxServers []*MxServer) {
+	m.rwm.Lock()
+	defer m.rwm.Unlock()
+	m.status = status
+	m.mxServers = mxServers
+}
+
+// закрывает соединения свободных клиентов всех почтовых сервисов
+func (ms *MailServers) closeIdle() {
+	ms.rwm.RLock()
+	defer ms.rwm.RUnlock()
+	for _, server := range ms.servers {
+		server.closeIdle()
+	}
+}
+
+// забывает найденные почтовые сервисы и закрывает соединения их свободных клиентов,
+// при следующей отправке почтовые сервисы ищутся заново
+func (ms *MailServers) reset() {
+	ms.rwm.Lock()
+	servers := ms.servers
+	ms.servers = make(map[string]*MailServer)
+	ms.rwm.Unlock()
+
+	for _, server := range servers {
+		server.closeIdle()
+	}
+}
+
+// отдает копию найденных почтовых сервисов
+func (ms *MailServers) all() map[string]*MailServer {
+	ms.rwm.RLock()
+	defer ms.rwm.RUnlock()
+	servers := make(map[string]*MailServer, len(ms.servers))
+	for hostname, server := range ms.servers {
+		servers[hostname] = server
+	}
+	return servers
+}
+
+// забывает почтовый сервис и закрывает соединения его свободных клиентов
+func (ms *MailServers) forget(hostname string) bool {
+	ms.rwm.Lock()
+	server, ok := ms.servers[hostname]
+	delete(ms.servers, hostname)
+	ms.rwm.Unlock()
+
+	if ok {
+		server.closeIdle()
+	}
+	return ok
+}
+
+// закрывает соединения свободных клиентов всех серверов почтового сервиса
+func (m *MailServer) closeIdle() {
+	for _, mxServer := range m.servers() {
+		mxServer.rwm.RLock()
+		for _, pool := range mxServer.pools {
+			pool.Close()
+		}
+		mxServer.rwm.RUnlock()
+	}
 }
 
 // почтовый сервер
@@ -46,26 +144,71 @@ type MxServer struct {
 	// использоватение TLS
 	useTLS bool
 
-	// очередь клиентов
-	queues map[string]*common.LimitedQueue
+	// пулы клиентов, в качестве ключа используется ip, с которого отправляются письма
+	// блокировка защищает пулы и признак использования TLS
+	pools map[string]*common.ClientPool
+	rwm   sync.RWMutex
+
+	// релей, если письма отправляются через него
+	relay *Relay
 }
 
 // создает новый почтовый сервер
-func newMxServer(hostname, hostnameFrom string) *MxServer {
-	queues := make(map[string]*common.LimitedQueue)
-	for _, address := range service.getAddresses(hostnameFrom) {
-		queues[address] = common.NewLimitQueue()
-	}
-
+// пулы клиентов создаются при первом обращении, т.к. их настройки зависят от реального имени сервера
+func newMxServer(hostname string) *MxServer {
 	return &MxServer{
 		hostname: hostname,
 		ips:      make([]net.IP, 0),
 		useTLS:   true,
-		queues:   queues,
+		pools:    make(map[string]*common.ClientPool),
 	}
 }
 
+// отдает пул клиентов для ip, создает пул, если его еще нет
+func (m *MxServer) pool(address string) *common.ClientPool {
+	m.rwm.RLock()
+	pool, ok := m.pools[address]
+	m.rwm.RUnlock()
+	if ok {
+		return pool
+	}
+
+	m.rwm.Lock()
+	defer m.rwm.Unlock()
+	if pool, ok = m.pools[address]; !ok {
+		pool = service.newClientPool(m.realServerName, m.hostname)
+		m.pools[address] = pool
+	}
+	return pool
+}
+
+// создает почтовый сервер для релея
+func newRelayServer(relay *Relay) *MxServer {
+	mxServer := newMxServer(relay.Host)
+	mxServer.realServerName = relay.Host
+	mxServer.useTLS = relay.TLS == StartTLSRelayTLS
+	mxServer.relay = relay
+	return mxServer
+}
+
+// адрес почтового сервера
+func (m *MxServer) addr() string {
+	if m.relay != nil {
+		return m.relay.addr()
+	}
+	return net.JoinHostPort(m.hostname, "25")
+}
+
 // запрещает использовать TLS соединения
 func (m *MxServer) dontUseTLS() {
+	m.rwm.Lock()
+	defer m.rwm.Unlock()
 	m.useTLS = false
 }
+
+// сигнализирует, что к серверу можно открывать TLS соединения
+func (m *MxServer) canUseTLS() bool {
+	m.rwm.RLock()
+	defer m.rwm.RUnlock()
+	return m.useTLS
+}
@@ -3,12 +3,14 @@ package connector
 import (
 	"crypto/tls"
 	"crypto/x509"
-	"encoding/pem"
-	"io/ioutil"
+	"fmt"
 	"net"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
 	"gopkg.in/yaml.v3"
 
 	"github.com/Halfi/postmanq/common"
@@ -40,19 +42,48 @@ type Service struct {
 	// количество горутин устанавливающих соединения к почтовым сервисам
 	ConnectorsCount int `yaml:"workers"`
 
+	// Pool настройки пулов клиентов к почтовым серверам
+	Pool common.PoolConfig `yaml:"smtpPool"`
+
+	// Pools настройки пулов клиентов для отдельных почтовых сервисов,
+	// в качестве ключа используется реальное имя сервера, например mail.ru, или имя mx сервера
+	Pools map[string]*common.PoolConfig `yaml:"smtpPools"`
+
+	// Throttle настройки приостановки отправки после ответов 421 и 451
+	Throttle ThrottleConfig `yaml:"throttle"`
+
 	Configs map[string]*Config `yaml:"postmans"`
 
 	preparers  []*Preparer
 	seekers    []*Seeker
 	connectors []*Connector
 
+	// работающие заготовщики, события соединений закрываются только после их остановки
+	preparing *sync.WaitGroup
+
 	connectorEvents chan *ConnectionEvent
 	seekerEvents    chan *ConnectionEvent
 
-	events       chan *common.SendEvent
-	eventsClosed bool
+	events *common.EventChannel
 
+	// найденные почтовые сервисы, заменяются при запуске и остановке сервиса, читаются через servers
 	mailServers *MailServers
+
+	// ip, с которых отправляются письма, сохраняются между переконфигурациями
+	addresses *sourceAddresses
+
+	// реальные имена почтовых сервисов получателей, сохраняются между переконфигурациями
+	serverNames *serverNames
+
+	// последний выданный идентификатор клиента
+	clientId int32
+
+	// отпечатки настроек доменов и пулов, по ним определяется, какие настройки изменились
+	fingerprints     map[string]string
+	poolsFingerprint string
+
+	// защищает настройки от замены во время переконфигурации
+	rwm sync.RWMutex
 }
 
 type MailServers struct {
@@ -77,10 +108,27 @@ func (ms *MailServers) Set(hostname string, s *MailServer) {
 	ms.servers[hostname] = s
 }
 
+// GetOrSet отдает почтовый сервис, а если его нет, создает его под той же блокировкой,
+// чтобы несколько искателей не создали разные почтовые сервисы со своими пулами клиентов
+// если почтовый сервис создан, вторым значением вернется true
+func (ms *MailServers) GetOrSet(hostname string, create func() *MailServer) (*MailServer, bool) {
+	ms.rwm.Lock()
+	defer ms.rwm.Unlock()
+	if server, ok := ms.servers[hostname]; ok {
+		return server, false
+	}
+	server := create()
+	ms.servers[hostname] = server
+	return server, true
+}
+
 // Inst создает новый сервис соединений
 func Inst() *Service {
 	if service == nil {
 		service = new(Service)
+		service.registerAdminHandlers()
+		common.RegisterHealthCheck("dns", common.ReadinessProbe, checkResolver)
+		prometheus.MustRegister(poolsCollector{})
 	}
 	return service
 }
@@ -97,6 +145,16 @@ func (s *Service) OnInit(event *common.ApplicationEvent) {
 		return
 	}
 
+	if s.addresses == nil {
+		s.addresses = newSourceAddresses()
+	}
+	if s.serverNames == nil {
+		s.serverNames = newServerNames()
+	}
+
+	s.fingerprint()
+	s.initPools()
+
 	for name, config := range s.Configs {
 		if config.MXHostname != "" {
 			name = config.MXHostname
@@ -108,25 +166,46 @@ func (s *Service) OnInit(event *common.ApplicationEvent) {
 		s.ConnectorsCount = common.DefaultWorkersCount
 	}
 
-	s.mailServers = NewMailServers()
+	mailServers := NewMailServers()
+	s.rwm.Lock()
+	s.mailServers = mailServers
+	s.rwm.Unlock()
 
-	s.events = make(chan *common.SendEvent)
-	s.eventsClosed = false
+	s.events = common.NewEventChannel("connector")
 
 	s.connectorEvents = make(chan *ConnectionEvent)
 	s.seekerEvents = make(chan *ConnectionEvent)
 
+	s.preparing = new(sync.WaitGroup)
 	s.preparers = make([]*Preparer, s.ConnectorsCount)
 	s.seekers = make([]*Seeker, s.ConnectorsCount)
 	s.connectors = make([]*Connector, s.ConnectorsCount)
 	for i := 0; i < s.ConnectorsCount; i++ {
 		id := i + 1
-		s.preparers[i] = newPreparer(id, s.events, s.connectorEvents, s.seekerEvents)
-		s.seekers[i] = newSeeker(id, s.seekerEvents, s.mailServers)
+		s.preparers[i] = newPreparer(id, s.events.Events(), s.connectorEvents, s.seekerEvents)
+		s.seekers[i] = newSeeker(id, s.seekerEvents, mailServers)
 		s.connectors[i] = newConnector(id, s.connectorEvents)
 	}
 }
 
+// снимает отпечатки настроек, отпечатки снимаются до инициализации настроек
+func (s *Service) fingerprint() {
+	s.poolsFingerprint = common.Fingerprint([]interface{}{s.Pool, s.Pools})
+	s.fingerprints = make(map[string]string, len(s.Configs))
+	for name, config := range s.Configs {
+		s.fingerprints[name] = common.Fingerprint(config)
+	}
+}
+
+// инициализирует настройки пулов и приостановки отправки
+func (s *Service) initPools() {
+	s.Pool.Init()
+	for _, pool := range s.Pools {
+		pool.InitBy(&s.Pool)
+	}
+	s.Throttle.init()
+}
+
 func (s *Service) init(conf *Config, hostname string) {
 	conf.tlsConfig = getTLSConfig(conf.CertFilename, conf.PrivateKeyFilename, hostname)
 
@@ -135,6 +214,34 @@ func (s *Service) init(conf *Config, hostname string) {
 		logger.By(hostname).Warn("connection service - ips should be defined")
 	}
 
+	for _, address := range conf.Addresses {
+		s.addresses.set(address, conf.Warmups[address])
+	}
+
+	// в пулах оставляем только ip домена, т.к. очереди клиентов создаются только для них
+	for hostnameTo, pool := range conf.Pools {
+		addresses := make([]string, 0, len(pool))
+		for _, address := range pool {
+			if conf.hasAddress(address) {
+				addresses = append(addresses, address)
+			} else {
+				logger.By(hostname).Warn("connection service - ip %s of pool %s is not defined in ips", address, hostnameTo)
+			}
+		}
+		conf.Pools[hostnameTo] = addresses
+	}
+
+	if conf.SidelineDuration == 0 {
+		conf.SidelineDuration = defaultSidelineDuration
+	}
+
+	for hostnameTo, relay := range conf.Relays {
+		if err := relay.init(); err != nil {
+			delete(conf.Relays, hostnameTo)
+			logger.By(hostname).ErrWithErr(err, "connection service - wrong relay settings for %s", hostnameTo)
+		}
+	}
+
 	mxes, err := net.LookupMX(hostname)
 	if err != nil {
 		logger.By(hostname).Err("connection service - can't lookup mx for %s", hostname)
@@ -150,29 +257,14 @@ func getTLSConfig(certFilename, privateKeyFilename, hostname string) *tls.Config
 		return nil
 	}
 
-	// пытаемся прочитать сертификат
-	pemBytes, err := ioutil.ReadFile(certFilename)
+	key, err := loadKeyPair(certFilename, privateKeyFilename)
 	if err != nil {
-		logger.By(hostname).ErrWithErr(err, "connection service can't read certificate %s", certFilename)
-		return nil
-	}
-
-	// получаем сертификат
-	pemBlock, _ := pem.Decode(pemBytes)
-	cert, err := x509.ParseCertificate(pemBlock.Bytes)
-	if err != nil {
-		logger.By(hostname).ErrWithErr(err, "connection parse certificate %s", certFilename)
+		logger.By(hostname).ErrWithErr(err, "connection service can't load certificate %s, private key %s", common.PEMSource(certFilename), common.PEMSource(privateKeyFilename))
 		return nil
 	}
 
 	pool := x509.NewCertPool()
-	pool.AddCert(cert)
-
-	key, err := tls.LoadX509KeyPair(certFilename, privateKeyFilename)
-	if err != nil {
-		logger.By(hostname).ErrWithErr(err, "connection service can't load certificate %s, private key %s", certFilename, privateKeyFilename)
-		return nil
-	}
+	pool.AddCert(key.Leaf)
 
 	return &tls.Config{
 		ClientAuth:             tls.RequireAndVerifyClientCert,
@@ -187,10 +279,36 @@ func getTLSConfig(certFilename, privateKeyFilename, hostname string) *tls.Config
 	}
 }
 
+// загружает сертификат и закрытый ключ, заданные путями до файлов или в формате PEM
+func loadKeyPair(certFilename, privateKeyFilename string) (tls.Certificate, error) {
+	certPEM, err := common.ReadPEM(certFilename)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("can't read certificate: %w", err)
+	}
+	keyPEM, err := common.ReadPEM(privateKeyFilename)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("can't read private key: %w", err)
+	}
+
+	key, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	key.Leaf, err = x509.ParseCertificate(key.Certificate[0])
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("can't parse certificate: %w", err)
+	}
+	return key, nil
+}
+
 // OnRun запускает горутины
 func (s *Service) OnRun() {
+	s.preparing.Add(len(s.preparers))
 	for i := range s.preparers {
-		go s.preparers[i].run()
+		go func(preparer *Preparer, preparing *sync.WaitGroup) {
+			defer preparing.Done()
+			preparer.run()
+		}(s.preparers[i], s.preparing)
 	}
 	for i := range s.seekers {
 		go s.seekers[i].run()
@@ -202,49 +320,119 @@ func (s *Service) OnRun() {
 
 // Event send event
 func (s *Service) Event(ev *common.SendEvent) bool {
-	if s.eventsClosed {
-		return false
-	}
-
-	s.events <- ev
-	return true
+	return s.events.Send(ev)
 }
 
 // OnFinish завершает работу сервиса соединений
 func (s *Service) OnFinish() {
-	if !s.eventsClosed {
-		s.eventsClosed = true
-		close(s.events)
-		close(s.connectorEvents)
-		close(s.seekerEvents)
-		s.mailServers = nil
-		s.preparers = nil
-		s.seekers = nil
-		s.connectors = nil
+	if s.preparers == nil {
+		return
 	}
+
+	// дожидаемся, пока заготовщики передадут полученные события, и только потом закрываем события соединений
+	s.events.Close()
+	s.preparing.Wait()
+	close(s.connectorEvents)
+	close(s.seekerEvents)
+	// закрываем соединения свободных клиентов, занятые клиенты закроются по истечении времени простоя
+	s.rwm.Lock()
+	mailServers := s.mailServers
+	s.mailServers = nil
+	s.rwm.Unlock()
+	mailServers.closeIdle()
+	s.preparers = nil
+	s.seekers = nil
+	s.connectors = nil
 }
 
-func (s *Service) Reconfigure(event *common.ApplicationEvent) {
-	err := yaml.Unmarshal(event.Data, s)
+// OnReconfigure применяет новые настройки, не останавливая заготовщиков, искателей и соединителей
+// домены, настройки которых не изменились, не перечитывают сертификаты и не ищут заново свой mx сервер,
+// если изменились настройки пулов, найденные почтовые сервисы забываются, чтобы их пулы создались с новыми настройками
+// количество горутин меняется только после перезапуска приложения
+func (s *Service) OnReconfigure(event *common.ApplicationEvent) {
+	service := new(Service)
+	err := yaml.Unmarshal(event.Data, service)
 	if err != nil {
 		logger.All().ErrWithErr(err, "connection service can't unmarshal config")
 		return
 	}
 
-	for name, config := range s.Configs {
+	if len(service.Configs) == 0 {
+		logger.All().Err("connector config is empty, current config is used")
+		return
+	}
+
+	service.fingerprint()
+	service.initPools()
+
+	s.rwm.RLock()
+	configs, fingerprints, poolsFingerprint := s.Configs, s.fingerprints, s.poolsFingerprint
+	s.rwm.RUnlock()
+
+	for name, config := range service.Configs {
+		if conf, ok := configs[name]; ok && fingerprints[name] == service.fingerprints[name] {
+			service.Configs[name] = conf
+			continue
+		}
+
+		logger.By(name).Debug("connection service apply new config")
+		hostname := name
 		if config.MXHostname != "" {
-			name = config.MXHostname
+			hostname = config.MXHostname
 		}
-		s.init(config, name)
+		s.init(config, hostname)
 	}
 
-	if s.ConnectorsCount == 0 {
-		s.ConnectorsCount = common.DefaultWorkersCount
+	s.rwm.Lock()
+	s.Configs = service.Configs
+	s.Pool = service.Pool
+	s.Pools = service.Pools
+	s.Throttle = service.Throttle
+	s.fingerprints = service.fingerprints
+	s.poolsFingerprint = service.poolsFingerprint
+	s.rwm.Unlock()
+
+	mailServers := s.servers()
+	if mailServers == nil {
+		return
+	}
+	if service.poolsFingerprint != poolsFingerprint {
+		logger.All().Debug("connection service apply new pools config")
+		mailServers.reset()
+		return
 	}
+
+	// найденные релеи хранят настройки, с которыми были найдены, поэтому релеи измененных и удаленных доменов забываются,
+	// при следующей отправке релеи создаются с новыми паролями и настройками защищенного соединения
+	for name, conf := range configs {
+		if fingerprint, ok := service.fingerprints[name]; ok && fingerprint == fingerprints[name] {
+			continue
+		}
+		for _, relay := range conf.Relays {
+			if mailServers.forget(relay.key()) {
+				logger.By(name).Debug("connection service forget relay %s", relay.addr())
+			}
+		}
+	}
+}
+
+// отдает найденные почтовые сервисы, nil, если сервис не запущен
+func (s *Service) servers() *MailServers {
+	s.rwm.RLock()
+	defer s.rwm.RUnlock()
+	return s.mailServers
 }
 
-func (s Service) getTlsConfig(hostname string) *tls.Config {
-	if conf, ok := s.Configs[hostname]; ok {
+// отдает настройки домена
+func (s *Service) getConfig(hostname string) (*Config, bool) {
+	s.rwm.RLock()
+	defer s.rwm.RUnlock()
+	conf, ok := s.Configs[hostname]
+	return conf, ok
+}
+
+func (s *Service) getTlsConfig(hostname string) *tls.Config {
+	if conf, ok := s.getConfig(hostname); ok {
 		return conf.tlsConfig
 	} else {
 		logger.By(hostname).Err("connection service can't make tls config by %s", hostname)
@@ -252,26 +440,169 @@ func (s Service) getTlsConfig(hostname string) *tls.Config {
 	}
 }
 
-func (s Service) getAddresses(hostname string) []string {
-	if conf, ok := s.Configs[hostname]; ok {
-		return conf.Addresses
-	} else {
-		logger.By(hostname).Err("connection service can't find ips by %s", hostname)
-		return common.EmptyStrSlice
+// отдает ip, с которого будет отправлено письмо
+// ip выбирается из пула почтового сервиса, если он указан, иначе из всех ip домена
+// ip, превысившие ограничения прогрева или отстраненные от отправки, пропускаются
+// письмо сразу учитывается в ограничениях прогрева выбранного ip, учет снимается, если письмо не будет отправлено
+// если ip домена не указаны, вернется пустой ip, и письмо отправится с ip по умолчанию
+// если ip указаны, но доступных ip нет, или настройки домена не найдены, вернется false
+func (s *Service) getAddress(event *common.SendEvent, id int) (string, bool) {
+	hostnameFrom := event.Message.HostnameFrom
+	conf, ok := s.getConfig(hostnameFrom)
+	if !ok {
+		logger.By(hostnameFrom).Err("connection service can't find ip by %s", hostnameFrom)
+		return common.EmptyStr, false
+	}
+	if conf.addressesLen == 0 {
+		return common.EmptyStr, true
+	}
+
+	addresses := conf.Addresses
+	if pool, ok := conf.Pools[event.Message.HostnameTo]; ok && len(pool) > 0 {
+		addresses = pool
+	}
+
+	now := time.Now()
+	for i := range addresses {
+		address := addresses[(id+i)%len(addresses)]
+		state, ok := s.addresses.get(address)
+		if !ok {
+			return address, true
+		}
+		if available, reserved := state.reserve(now); available {
+			if reserved {
+				event.AddressReservedAt = now
+			}
+			return address, true
+		}
 	}
+
+	sourceAddressUnavailable.WithLabelValues(hostnameFrom).Inc()
+	return common.EmptyStr, false
 }
 
-func (s Service) getAddress(hostname string, id int) string {
-	if conf, ok := s.Configs[hostname]; ok && conf.addressesLen > 0 {
-		return conf.Addresses[id%conf.addressesLen]
-	} else {
-		logger.By(hostname).Err("connection service can't find ip by %s", hostname)
-		return common.EmptyStr
+// OnResult учитывает результат отправки письма для ip и почтового сервиса
+func (s *Service) OnResult(ev *common.SendEvent, result common.SendEventResult) {
+	if ev.Message == nil {
+		return
 	}
+
+	s.onAddressResult(ev, result)
+	s.onServerResult(ev, result)
 }
 
-func (s Service) getHostname(hostname string) string {
-	if conf, ok := s.Configs[hostname]; ok {
+// учитывает результат отправки письма для ip, с которого оно отправлялось
+func (s *Service) onAddressResult(ev *common.SendEvent, result common.SendEventResult) {
+	if ev.Address == "" {
+		return
+	}
+
+	state, ok := s.addresses.get(ev.Address)
+	if !ok {
+		return
+	}
+
+	now := time.Now()
+	sourceAddressMessages.WithLabelValues(ev.Address, result.String()).Inc()
+	// письмо не отправлено, снимаем его учет в ограничениях прогрева
+	if result != common.SuccessSendEventResult && !ev.AddressReservedAt.IsZero() {
+		state.release(ev.AddressReservedAt)
+		ev.AddressReservedAt = time.Time{}
+	}
+	switch result {
+	case common.ErrorSendEventResult, common.DelaySendEventResult:
+		if !isBlocklistResponse(ev.Message.Error) {
+			break
+		}
+
+		duration := defaultSidelineDuration
+		if conf, ok := s.getConfig(ev.Message.HostnameFrom); ok {
+			duration = conf.SidelineDuration
+		}
+		if !state.sidelined(now) {
+			logger.By(ev.Message.HostnameFrom).Warn("connection service sideline ip %s for %v, response: %s", ev.Address, duration, ev.Message.Error.Message)
+		}
+		state.sideline(now, duration)
+		sourceAddressSidelined.WithLabelValues(ev.Address).Set(1)
+		time.AfterFunc(duration, func() {
+			if !state.sidelined(time.Now()) {
+				sourceAddressSidelined.WithLabelValues(ev.Address).Set(0)
+			}
+		})
+	}
+}
+
+// приостанавливает отправку на почтовый сервис, если он просит уменьшить количество соединений или писем
+// и сбрасывает приостановку после успешной отправки
+func (s *Service) onServerResult(ev *common.SendEvent, result common.SendEventResult) {
+	mailServers := s.servers()
+	if mailServers == nil {
+		return
+	}
+
+	key := ev.Message.HostnameTo
+	if relay := s.getRelay(ev.Message.HostnameFrom, ev.Message.HostnameTo); relay != nil {
+		key = relay.key()
+	}
+
+	mailServer, ok := mailServers.Get(key)
+	if !ok {
+		return
+	}
+
+	switch result {
+	case common.SuccessSendEventResult:
+		mailServer.throttle.off()
+	case common.ErrorSendEventResult, common.DelaySendEventResult:
+		if !isThrottleResponse(ev.Message.Error) {
+			break
+		}
+
+		s.rwm.RLock()
+		throttleConfig := s.Throttle
+		s.rwm.RUnlock()
+		backoff := mailServer.throttle.on(&throttleConfig, time.Now())
+		logger.By(ev.Message.HostnameFrom).Warn("connection service throttle %s for %v, response: %s", key, backoff, ev.Message.Error.Message)
+		throttledServers.WithLabelValues(ServerLabel(ev.Message.HostnameFrom, ev.Message.HostnameTo)).Inc()
+		// почтовый сервис просит уменьшить количество соединений, закрываем простаивающие
+		mailServer.closeIdle()
+	}
+}
+
+// создает пул клиентов к почтовому серверу
+// настройки пула ищутся по реальному имени сервера, затем по имени mx сервера
+func (s *Service) newClientPool(realServerName, mxHostname string) *common.ClientPool {
+	s.rwm.RLock()
+	defer s.rwm.RUnlock()
+	config := &s.Pool
+	if pool, ok := s.Pools[realServerName]; ok {
+		config = pool
+	} else if pool, ok := s.Pools[mxHostname]; ok {
+		config = pool
+	}
+
+	return common.NewClientPool(config, func() int {
+		return int(atomic.AddInt32(&s.clientId, 1))
+	})
+}
+
+// отдает релей, через который необходимо отправить письмо
+// релей ищется по домену получателя, затем по *
+// если релей не найден, письмо отправляется напрямую mx серверам получателя
+func (s *Service) getRelay(hostnameFrom, hostnameTo string) *Relay {
+	conf, ok := s.getConfig(hostnameFrom)
+	if !ok {
+		return nil
+	}
+
+	if relay, ok := conf.Relays[hostnameTo]; ok {
+		return relay
+	}
+	return conf.Relays[common.AllDomains]
+}
+
+func (s *Service) getHostname(hostname string) string {
+	if conf, ok := s.getConfig(hostname); ok {
 		return conf.hostname
 	} else {
 		logger.By(hostname).Err("connection service can't find hostname by %s", hostname)
@@ -291,16 +622,13 @@ type ConnectionEvent struct {
 
 	// идентификатор заготовщика запросившего поиск информации о почтовом сервисе
 	connectorId int
-
-	// адрес, с которого будет отправлено письмо
-	address string
 }
 
 type Config struct {
-	// PrivateKeyFilename путь до файла с закрытым ключом
+	// PrivateKeyFilename путь до файла с закрытым ключом или закрытый ключ в формате PEM
 	PrivateKeyFilename string `yaml:"privateKey"`
 
-	// CertFilename путь до файла с сертификатом
+	// CertFilename путь до файла с сертификатом или сертификат в формате PEM
 	CertFilename string `yaml:"certificate"`
 
 	// Addresses ip с которых будем рассылать письма
@@ -309,6 +637,18 @@ type Config struct {
 	// MXHostname hostname, на котором будет слушаться 25 порт
 	MXHostname string `yaml:"mxHostname"`
 
+	// Pools ip, с которых отправляются письма на указанные почтовые сервисы, в качестве ключа используется домен
+	Pools map[string][]string `yaml:"ipPools"`
+
+	// Warmups расписания прогрева ip, в качестве ключа используется ip
+	Warmups map[string]*Warmup `yaml:"ipWarmup"`
+
+	// SidelineDuration время, на которое ip отстраняется от отправки после попадания в черный список
+	SidelineDuration time.Duration `yaml:"ipSideline"`
+
+	// Relays релеи, через которые отправляются письма, в качестве ключа используется домен получателя или *
+	Relays map[string]*Relay `yaml:"relays"`
+
 	// количество ip
 	addressesLen int
 
@@ -316,3 +656,13 @@ type Config struct {
 
 	hostname string
 }
+
+// сигнализирует, что ip принадлежит домену
+func (c *Config) hasAddress(address string) bool {
+	for _, a := range c.Addresses {
+		if a == address {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,117 @@
+package connector
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Halfi/postmanq/common"
+)
+
+var (
+	// признаки ответа почтового сервиса о превышении количества соединений или писем
+	// общие слова, например limit или deferred, встречаются почти в любом временном отказе, поэтому не используются
+	throttleSigns = []string{
+		"too many connections",
+		"too many messages",
+		"too many concurrent",
+		"rate limit",
+		"ratelimit",
+		"rate-limit",
+		"sending rate",
+		"rate exceeded",
+		"throttl",
+		"slow down",
+	}
+)
+
+// ThrottleConfig настройки приостановки отправки на почтовый сервис после ответов 421 и 451
+type ThrottleConfig struct {
+	// MinBackoff время первой приостановки
+	MinBackoff time.Duration `yaml:"minBackoff"`
+
+	// MaxBackoff максимальное время приостановки, время удваивается с каждым ответом подряд
+	MaxBackoff time.Duration `yaml:"maxBackoff"`
+}
+
+// инициализирует значения по умолчанию
+func (c *ThrottleConfig) init() {
+	if c.MinBackoff == 0 {
+		c.MinBackoff = 30 * time.Second
+	}
+	if c.MaxBackoff == 0 {
+		c.MaxBackoff = 30 * time.Minute
+	}
+	if c.MaxBackoff < c.MinBackoff {
+		c.MaxBackoff = c.MinBackoff
+	}
+}
+
+// приостановка отправки на почтовый сервис
+type throttle struct {
+	// дата, до которой отправка приостановлена
+	until time.Time
+
+	// время последней приостановки
+	backoff time.Duration
+
+	mutex sync.Mutex
+}
+
+// приостанавливает отправку, время приостановки удваивается, если предыдущая приостановка не была сброшена
+func (t *throttle) on(config *ThrottleConfig, now time.Time) time.Duration {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	// пока отправка приостановлена, ответы от уже начатых отправок не увеличивают время приостановки
+	if now.Before(t.until) {
+		return t.until.Sub(now)
+	}
+
+	if t.backoff == 0 {
+		t.backoff = config.MinBackoff
+	} else {
+		t.backoff *= 2
+		if t.backoff > config.MaxBackoff {
+			t.backoff = config.MaxBackoff
+		}
+	}
+	t.until = now.Add(t.backoff)
+	return t.backoff
+}
+
+// сбрасывает время приостановки после успешной отправки
+func (t *throttle) off() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.backoff = 0
+}
+
+// отдает оставшееся время приостановки
+func (t *throttle) left(now time.Time) time.Duration {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if now.Before(t.until) {
+		return t.until.Sub(now)
+	}
+	return 0
+}
+
+// сигнализирует, что почтовый сервис просит уменьшить количество соединений или писем
+func isThrottleResponse(err *common.MailError) bool {
+	if err == nil {
+		return false
+	}
+
+	if err.Code != 421 && err.Code != 451 {
+		return false
+	}
+
+	message := strings.ToLower(err.Message)
+	for _, sign := range throttleSigns {
+		if strings.Contains(message, sign) {
+			return true
+		}
+	}
+	return false
+}
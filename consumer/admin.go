@@ -0,0 +1,106 @@
+package consumer
+
+import (
+	"net/http"
+	"sort"
+
+	"github.com/Halfi/postmanq/common"
+	"github.com/Halfi/postmanq/logger"
+)
+
+// получатель в ответе api администрирования
+type consumerInfo struct {
+	URI       string `json:"uri"`
+	Binding   string `json:"binding"`
+	Queue     string `json:"queue"`
+	Workers   int    `json:"workers"`
+	Paused    bool   `json:"paused"`
+	Connected bool   `json:"connected"`
+}
+
+// регистрирует обработчики api администрирования сервиса получения сообщений
+func (s *Service) registerAdminHandlers() {
+	common.RegisterAdminHandler(http.MethodGet, "/consumers", s.adminConsumers)
+	common.RegisterAdminHandler(http.MethodPost, "/consumers/pause", s.adminPause)
+	common.RegisterAdminHandler(http.MethodPost, "/consumers/resume", s.adminResume)
+}
+
+// отдает получателей сообщений
+func (s *Service) adminConsumers(_ *http.Request) (interface{}, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	infos := make([]consumerInfo, 0)
+	for key, consumers := range s.consumers {
+		for _, consumer := range consumers {
+			infos = append(infos, consumer.info(redactKey(key)))
+		}
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		if infos[i].URI != infos[j].URI {
+			return infos[i].URI < infos[j].URI
+		}
+		return infos[i].Binding < infos[j].Binding
+	})
+	return infos, nil
+}
+
+// приостанавливает получение сообщений связки, полученные сообщения отправляются,
+// параметр binding задает имя связки или очереди
+func (s *Service) adminPause(r *http.Request) (interface{}, error) {
+	return s.adminToggle(r, func(consumer *Consumer) {
+		if consumer.pauser.pause() {
+			logger.All().Info("consumer#%d of queue %s is paused", consumer.id, consumer.binding.Queue)
+		}
+	})
+}
+
+// возобновляет получение сообщений связки, параметр binding задает имя связки или очереди
+func (s *Service) adminResume(r *http.Request) (interface{}, error) {
+	return s.adminToggle(r, func(consumer *Consumer) {
+		if consumer.pauser.resume() {
+			logger.All().Info("consumer#%d of queue %s is resumed", consumer.id, consumer.binding.Queue)
+		}
+	})
+}
+
+// приостанавливает или возобновляет получателей связки и отдает их
+func (s *Service) adminToggle(r *http.Request, toggle func(*Consumer)) (interface{}, error) {
+	name := r.URL.Query().Get("binding")
+	if name == common.EmptyStr {
+		return nil, common.NewAdminError(http.StatusBadRequest, "binding isn't set")
+	}
+
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	infos := make([]consumerInfo, 0)
+	for key, consumers := range s.consumers {
+		for _, consumer := range consumers {
+			if consumer.binding.Name == name || consumer.binding.Queue == name {
+				toggle(consumer)
+				infos = append(infos, consumer.info(redactKey(key)))
+			}
+		}
+	}
+	if len(infos) == 0 {
+		return nil, common.NewAdminError(http.StatusNotFound, "binding %s isn't found", name)
+	}
+	return infos, nil
+}
+
+// отдает описание получателя
+func (c *Consumer) info(uri string) consumerInfo {
+	connected := true
+	for _, connector := range c.connectors {
+		connected = connected && connector.Connected()
+	}
+	return consumerInfo{
+		URI:       uri,
+		Binding:   c.binding.Name,
+		Queue:     c.binding.Queue,
+		Workers:   c.binding.Handlers,
+		Paused:    c.pauser.isPaused(),
+		Connected: connected,
+	}
+}
@@ -2,6 +2,7 @@ package consumer
 
 import (
 	"encoding/json"
+	"fmt"
 
 	"github.com/streadway/amqp"
 
@@ -11,23 +12,43 @@ import (
 
 type Assistant struct {
 	id           int
-	connector    *amqpConnector
+	connectors   []*amqpConnector
 	srcBinding   *AssistantBinding
 	destBindings map[string]*Binding
+
+	// останавливает получение сообщений
+	drainer *drainer
 }
 
 func (a *Assistant) run() {
 	for i := 0; i < a.srcBinding.Binding.Handlers; i++ {
-		go a.consume(i)
+		go a.consume(i, a.connectors[i%len(a.connectors)])
+	}
+}
+
+// подключается к очереди, если канал или соединение закрылись, ждет нового соединения и подключается к очереди заново
+func (a *Assistant) consume(id int, connector *amqpConnector) {
+	delay := minReconnectDelay
+	for !a.drainer.isDraining() && connector.Wait() {
+		if a.consumeChannel(id, connector) {
+			delay = minReconnectDelay
+		} else {
+			delay = nextReconnectDelay(delay)
+		}
+		if a.drainer.isDraining() || !connector.Sleep(delay) {
+			return
+		}
 	}
 }
 
-func (a *Assistant) consume(id int) {
-	channel, err := a.connector.GetConnect().Channel()
+// перекладывает сообщения, пока канал не закроется, если подключиться к очереди не удалось, вернется false
+func (a *Assistant) consumeChannel(id int, connector *amqpConnector) bool {
+	channel, err := connector.Channel()
 	if err != nil {
-		logger.All().Warn("consumer#%d, handler#%d can't get channel %s", a.id, id, a.srcBinding.Binding.Queue)
-		return
+		logger.All().WarnWithErr(err, "assistant#%d, handler#%d can't get channel %s", a.id, id, a.srcBinding.Binding.Queue)
+		return false
 	}
+	defer channel.Close()
 
 	// выбираем из очереди сообщения с запасом
 	// это нужно для того, чтобы после отправки письма новое уже было готово к отправке
@@ -35,32 +56,71 @@ func (a *Assistant) consume(id int) {
 	err = channel.Qos(a.srcBinding.Binding.PrefetchCount, 0, false)
 	if err != nil {
 		logger.All().Warn("consumer#%d, handler#%d can't set qos %s", a.id, id, a.srcBinding.Binding.Queue)
-		return
+		return false
+	}
+
+	// сообщения публикуются с настройками связки, в которую перекладываются
+	publisher, err := newConfirmPublisher(channel, amqp.Transient, a.confirm())
+	if err != nil {
+		logger.All().WarnWithErr(err, "assistant#%d, handler#%d can't enable publisher confirms %s", a.id, id, a.srcBinding.Binding.Queue)
+		return false
 	}
 
+	consumerTag := fmt.Sprintf("postmanq-assistant#%d-%d", a.id, id)
 	deliveries, err := channel.Consume(
 		a.srcBinding.Binding.Queue,
-		"",
+		consumerTag,
 		false,
 		false,
 		false,
 		false,
 		nil,
 	)
-	if err == nil {
-		go a.publishWorker(id, channel, deliveries)
-	} else {
+	if err != nil {
 		logger.All().Warn("assistant#%d, handler#%d can't consume queue %s", a.id, id, a.srcBinding.Binding.Queue)
+		return false
 	}
+
+	// при остановке сервиса отменяем подписку, чтобы брокер перестал присылать сообщения
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-a.drainer.draining:
+			if err := channel.Cancel(consumerTag, false); err != nil {
+				logger.All().WarnWithErr(err, "assistant#%d, handler#%d can't cancel consuming queue %s", a.id, id, a.srcBinding.Binding.Queue)
+			}
+		case <-done:
+		}
+	}()
+
+	a.publishWorker(id, publisher, deliveries)
+	return true
 }
 
-func (a *Assistant) publishWorker(id int, channel *amqp.Channel, deliveries <-chan amqp.Delivery) {
+// нужны ли подтверждения брокера хотя бы одной связке, в которую перекладываются сообщения
+func (a *Assistant) confirm() bool {
+	for _, binding := range a.destBindings {
+		if binding.Confirm {
+			return true
+		}
+	}
+	return false
+}
+
+func (a *Assistant) publishWorker(id int, publisher *publisher, deliveries <-chan amqp.Delivery) {
 	for delivery := range deliveries {
-		a.publish(id, channel, &delivery)
+		// сообщения, полученные после начала остановки, возвращаем в очередь не обрабатывая
+		if !a.drainer.begin() {
+			_ = delivery.Nack(false, true)
+			continue
+		}
+		a.publish(id, publisher, &delivery)
+		a.drainer.end()
 	}
 }
 
-func (a *Assistant) publish(id int, channel *amqp.Channel, delivery *amqp.Delivery) {
+func (a *Assistant) publish(id int, publisher *publisher, delivery *amqp.Delivery) {
 	var err error
 	message := new(common.MailMessage)
 	defer func() {
@@ -92,15 +152,13 @@ func (a *Assistant) publish(id int, channel *amqp.Channel, delivery *amqp.Delive
 		)
 
 	if binding, ok := a.destBindings[message.HostnameFrom]; ok {
-		err = channel.Publish(
-			binding.Exchange,
-			binding.Routing,
-			false,
-			false,
+		err = publisher.publish(
+			binding,
 			amqp.Publishing{
 				ContentType:  "text/plain",
 				Body:         delivery.Body,
-				DeliveryMode: amqp.Transient,
+				Priority:     delivery.Priority,
+				DeliveryMode: binding.deliveryMode(),
 			},
 		)
 		if err != nil {
@@ -2,6 +2,7 @@ package consumer
 
 import (
 	"fmt"
+	"math"
 	"time"
 
 	"github.com/streadway/amqp"
@@ -19,6 +20,28 @@ const (
 	TopicExchangeType  ExchangeType = "topic"
 )
 
+// тип очереди
+// потоки не поддерживаются: получатель возвращает сообщения в очередь, а отложенные очереди используют ttl и dlx,
+// которые потоки не поддерживают
+type QueueType string
+
+const (
+	ClassicQueueType QueueType = "classic"
+	QuorumQueueType  QueueType = "quorum"
+
+	// тип очереди потока, указывается только для понятной ошибки в настройках
+	streamQueueType QueueType = "stream"
+)
+
+// поведение очереди при превышении максимальной длины
+type OverflowType string
+
+const (
+	DropHeadOverflowType         OverflowType = "drop-head"
+	RejectPublishOverflowType    OverflowType = "reject-publish"
+	RejectPublishDLXOverflowType OverflowType = "reject-publish-dlx"
+)
+
 // тип точки обмена для неотправленного письма
 type FailureBindingType int
 
@@ -34,6 +57,9 @@ const (
 
 	// неизвестная проблема
 	UnknownFailureBindingType
+
+	// истек срок отправки письма
+	ExpiredFailureBindingType
 )
 
 var (
@@ -42,6 +68,7 @@ var (
 		TechnicalFailureBindingType:  "%s.failure.technical",
 		ConnectionFailureBindingType: "%s.failure.connection",
 		UnknownFailureBindingType:    "%s.failure.unknown",
+		ExpiredFailureBindingType:    "%s.failure.expired",
 	}
 
 	// отложенные очереди вообще
@@ -119,16 +146,69 @@ type Binding struct {
 	// количество сообщений, получаемых одновременно
 	PrefetchCount int `yaml:"prefetchCount"`
 
+	// приоритет писем, у которых приоритет не указан
+	Priority int `yaml:"priority"`
+
+	// максимальный приоритет сообщений в очереди, если указан, очередь объявляется с аргументом x-max-priority
+	// у существующей очереди аргумент поменять нельзя, очередь нужно удалить и объявить заново
+	MaxPriority int `yaml:"maxPriority"`
+
+	// сохранять ли на диск сообщения, которые обработчики очереди публикуют в отложенные очереди и очереди для ошибок
+	Persistent bool `yaml:"persistent"`
+
+	// ждать ли подтверждения брокера после публикации,
+	// если включено, полученное сообщение подтверждается только после подтверждения публикации
+	Confirm bool `yaml:"confirm"`
+
+	// тип очереди, классическая или кворумная, отложенные очереди и очереди для ошибок кворумной очереди тоже кворумные
+	QueueType QueueType `yaml:"queueType"`
+
+	// точка обмена для отброшенных сообщений
+	DeadLetterExchange string `yaml:"deadLetterExchange"`
+
+	// ключ маршрутизации для отброшенных сообщений
+	DeadLetterRoutingKey string `yaml:"deadLetterRoutingKey"`
+
+	// максимальное количество сообщений в очереди
+	MaxLength int64 `yaml:"maxLength"`
+
+	// максимальный размер сообщений в очереди в байтах
+	MaxLengthBytes int64 `yaml:"maxLengthBytes"`
+
+	// поведение очереди при превышении максимальной длины
+	Overflow OverflowType `yaml:"overflow"`
+
+	// хранить ли сообщения классической очереди на диске, а не в памяти
+	Lazy bool `yaml:"lazy"`
+
+	// время жизни сообщений в очереди
+	MessageTTL time.Duration `yaml:"messageTTL"`
+
+	// разбирать ли очередь только одним получателем, остальные получатели ждут своей очереди
+	SingleActiveConsumer bool `yaml:"singleActiveConsumer"`
+
+	// только проверять, что точка обмена и очередь существуют, не объявляя и не связывая их,
+	// используется, если точки обмена и очереди создаются администраторами RabbitMQ
+	// отложенные очереди и очереди для ошибок тоже только проверяются
+	Passive bool `yaml:"passive"`
+
+	// время, через которое письмо из отложенной очереди вернется в основную
+	delay time.Duration
+
 	// отложенные очереди
 	delayedBindings map[common.DelayedBindingType]*Binding
 
 	// очереди для ошибок
 	failureBindings map[FailureBindingType]*Binding
+
+	// отпечаток настроек связки, по нему определяется, изменилась ли связка при переконфигурации
+	hash string
 }
 
 // создает связку обложенной точки обмена и очереди
 func newDelayedBinding(name string, duration time.Duration) *Binding {
 	binding := newBinding(name)
+	binding.delay = duration
 	binding.QueueArgs = amqp.Table{
 		"x-message-ttl": int64(duration.Seconds()) * 1000,
 	}
@@ -156,10 +236,109 @@ func (b *Binding) init() {
 	if b.PrefetchCount == 0 {
 		b.PrefetchCount = 2
 	}
+	if b.MaxPriority > math.MaxUint8 {
+		b.MaxPriority = math.MaxUint8
+	}
+	b.initQueueArgs()
+}
+
+// дополняет аргументы очереди параметрами объявления
+func (b *Binding) initQueueArgs() {
+	args := make(amqp.Table, len(b.QueueArgs))
+	for key, value := range b.QueueArgs {
+		args[key] = value
+	}
+
+	switch b.QueueType {
+	case "":
+	case ClassicQueueType, QuorumQueueType:
+		args["x-queue-type"] = string(b.QueueType)
+	default:
+		logger.All().Warn("consumer queue %s has unknown type %s", b.Queue, b.QueueType)
+	}
+	if b.MaxPriority > 0 {
+		if b.QueueType == QuorumQueueType {
+			logger.All().Warn("consumer queue %s of type %s doesn't support priorities", b.Queue, b.QueueType)
+		} else {
+			args["x-max-priority"] = int32(b.MaxPriority)
+		}
+	}
+	if len(b.DeadLetterExchange) > 0 {
+		args["x-dead-letter-exchange"] = b.DeadLetterExchange
+	}
+	if len(b.DeadLetterRoutingKey) > 0 {
+		args["x-dead-letter-routing-key"] = b.DeadLetterRoutingKey
+	}
+	if b.MaxLength > 0 {
+		args["x-max-length"] = b.MaxLength
+	}
+	if b.MaxLengthBytes > 0 {
+		args["x-max-length-bytes"] = b.MaxLengthBytes
+	}
+	switch b.Overflow {
+	case "":
+	case DropHeadOverflowType, RejectPublishOverflowType, RejectPublishDLXOverflowType:
+		args["x-overflow"] = string(b.Overflow)
+	default:
+		logger.All().Warn("consumer queue %s has unknown overflow %s", b.Queue, b.Overflow)
+	}
+	if b.Lazy {
+		if b.QueueType == QuorumQueueType {
+			logger.All().Warn("consumer queue %s of type %s can't be lazy", b.Queue, b.QueueType)
+		} else {
+			args["x-queue-mode"] = "lazy"
+		}
+	}
+	if b.MessageTTL > 0 {
+		args["x-message-ttl"] = b.MessageTTL.Milliseconds()
+	}
+	if b.SingleActiveConsumer {
+		args["x-single-active-consumer"] = true
+	}
+
+	if len(args) > 0 {
+		b.QueueArgs = args
+	}
+}
+
+// создает связку для очереди с ошибками основной связки
+func (b *Binding) newFailureBinding(tplName string) *Binding {
+	failureBinding := new(Binding)
+	failureBinding.Exchange = fmt.Sprintf(tplName, b.Exchange)
+	failureBinding.Queue = fmt.Sprintf(tplName, b.Queue)
+	failureBinding.Type = b.Type
+	failureBinding.inherit(b)
+	return failureBinding
+}
+
+// перенимает у основной связки параметры объявления, общие для всех очередей связки
+func (b *Binding) inherit(binding *Binding) {
+	b.Passive = binding.Passive
+	if binding.QueueType == QuorumQueueType {
+		if b.QueueArgs == nil {
+			b.QueueArgs = amqp.Table{}
+		}
+		b.QueueType = binding.QueueType
+		b.QueueArgs["x-queue-type"] = string(binding.QueueType)
+	}
+}
+
+// отдает режим доставки публикуемых сообщений
+func (b *Binding) deliveryMode() uint8 {
+	if b.Persistent {
+		return amqp.Persistent
+	}
+	return amqp.Transient
 }
 
 // объявляет точку обмена и очередь и связывает их
-func (b *Binding) declare(channel *amqp.Channel) {
+// в пассивном режиме только проверяет, что точка обмена и очередь существуют
+// после ошибки брокер закрывает канал, поэтому канал после ошибки использовать нельзя
+func (b *Binding) declare(channel *amqp.Channel) error {
+	if b.Passive {
+		return b.check(channel)
+	}
+
 	err := channel.ExchangeDeclare(
 		b.Exchange,     // name of the exchange
 		string(b.Type), // type
@@ -170,8 +349,7 @@ func (b *Binding) declare(channel *amqp.Channel) {
 		b.ExchangeArgs, // arguments
 	)
 	if err != nil {
-		logger.All().ErrWithErr(err, "consumer can't declare exchange %s", b.Exchange)
-		return
+		return fmt.Errorf("can't declare exchange %s: %w", b.Exchange, err)
 	}
 
 	_, err = channel.QueueDeclare(
@@ -183,8 +361,7 @@ func (b *Binding) declare(channel *amqp.Channel) {
 		b.QueueArgs, // arguments
 	)
 	if err != nil {
-		logger.All().ErrWithErr(err, "consumer can't declare queue %s", b.Queue)
-		return
+		return fmt.Errorf("can't declare queue %s: %w", b.Queue, err)
 	}
 
 	err = channel.QueueBind(
@@ -195,20 +372,88 @@ func (b *Binding) declare(channel *amqp.Channel) {
 		nil,        // arguments
 	)
 	if err != nil {
-		logger.All().ErrWithErr(err, "consumer can't bind queue %s to exchange %s", b.Queue, b.Exchange)
-		return
+		return fmt.Errorf("can't bind queue %s to exchange %s: %w", b.Queue, b.Exchange, err)
+	}
+	return nil
+}
+
+// проверяет, что точка обмена и очередь существуют
+func (b *Binding) check(channel *amqp.Channel) error {
+	err := channel.ExchangeDeclarePassive(
+		b.Exchange,     // name of the exchange
+		string(b.Type), // type
+		true,           // durable
+		false,          // delete when complete
+		false,          // internal
+		false,          // noWait
+		b.ExchangeArgs, // arguments
+	)
+	if err != nil {
+		return fmt.Errorf("can't find exchange %s: %w", b.Exchange, err)
+	}
+
+	_, err = channel.QueueDeclarePassive(
+		b.Queue,     // name of the queue
+		true,        // durable
+		false,       // delete when usused
+		false,       // exclusive
+		false,       // noWait
+		b.QueueArgs, // arguments
+	)
+	if err != nil {
+		return fmt.Errorf("can't find queue %s: %w", b.Queue, err)
+	}
+	return nil
+}
+
+// объявляет связку со всеми отложенными очередями и очередями для ошибок на отдельном канале,
+// чтобы ошибка объявления одной связки не закрыла канал остальным
+func (b *Binding) declareAll(connect *amqp.Connection) error {
+	channel, err := connect.Channel()
+	if err != nil {
+		return err
+	}
+	defer channel.Close()
+
+	if err = b.declare(channel); err != nil {
+		return err
+	}
+	for _, delayedBinding := range b.delayedBindings {
+		if err = delayedBinding.declare(channel); err != nil {
+			return err
+		}
+	}
+	for _, failureBinding := range b.failureBindings {
+		if err = failureBinding.declare(channel); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// создает копию отложенной связки для основной связки
+// шаблоны отложенных связок общие, поэтому у каждой основной связки свои копии
+func (b *Binding) cloneDelayed(binding *Binding) *Binding {
+	delayed := *b
+	if b.QueueArgs != nil {
+		delayed.QueueArgs = make(amqp.Table, len(b.QueueArgs))
+		for key, value := range b.QueueArgs {
+			delayed.QueueArgs[key] = value
+		}
 	}
+	delayed.initDelayed(binding)
+	return &delayed
 }
 
-// объявляет отложенную точку обмена и очередь и связывает их
-func (b *Binding) declareDelayed(binding *Binding, channel *amqp.Channel) {
+// инициализирует отложенную точку обмена и очередь именами основной связки
+func (b *Binding) initDelayed(binding *Binding) {
 	b.Exchange = fmt.Sprintf(b.Name, binding.Exchange)
 	b.Queue = fmt.Sprintf(b.Name, binding.Queue)
 	if b.QueueArgs != nil {
 		b.QueueArgs["x-dead-letter-exchange"] = binding.Exchange
 	}
 	b.Type = binding.Type
-	b.declare(channel)
+	b.inherit(binding)
 }
 
 type AssistantBinding struct {
@@ -0,0 +1,137 @@
+package consumer
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/streadway/amqp"
+	"gopkg.in/yaml.v3"
+
+	"github.com/Halfi/postmanq/common"
+)
+
+// OnCheck проверяет адреса серверов очередей, связки и помощников
+func (s *Service) OnCheck(event *common.ApplicationEvent) []error {
+	service := new(Service)
+	if err := yaml.Unmarshal(event.Data, service); err != nil {
+		return []error{err}
+	}
+
+	errs := make([]error, 0)
+	if len(service.Configs) == 0 {
+		errs = append(errs, common.NewConfigError("consumers", "consumers should be defined"))
+	}
+	for i, config := range service.Configs {
+		if config != nil {
+			errs = append(errs, config.check(fmt.Sprintf("consumers[%d]", i))...)
+		}
+	}
+	return errs
+}
+
+// проверяет настройки получателя
+func (c *Config) check(path string) []error {
+	errs := make([]error, 0)
+	uris := c.uris()
+	if len(uris) == 0 {
+		errs = append(errs, common.NewConfigError(path, "uri or uris should be defined"))
+	}
+	for _, uri := range uris {
+		if _, err := amqp.ParseURI(uri); err != nil {
+			errs = append(errs, common.NewConfigError(path, "wrong uri %s: %v", redact(uri), err))
+		}
+	}
+
+	// очереди и точки обмена связок, в качестве значения используется путь к связке
+	queues := make(map[string]string)
+	exchanges := make(map[string]bool)
+	for i, binding := range c.Bindings {
+		bindingPath := fmt.Sprintf("%s.bindings[%d]", path, i)
+		if binding == nil {
+			continue
+		}
+		errs = append(errs, binding.checkConfig(bindingPath)...)
+
+		exchange, queue := binding.names()
+		if other, ok := queues[queue]; ok && queue != common.EmptyStr {
+			errs = append(errs, common.NewConfigError(bindingPath, "queue %s is already consumed by %s", queue, other))
+		}
+		queues[queue] = bindingPath
+		exchanges[exchange] = true
+	}
+
+	for i, assistant := range c.Assistants {
+		assistantPath := fmt.Sprintf("%s.assistants[%d]", path, i)
+		if assistant == nil {
+			continue
+		}
+		errs = append(errs, assistant.Binding.checkConfig(assistantPath)...)
+		for domain, exchange := range assistant.Dest {
+			if !exchanges[exchange] {
+				errs = append(errs, common.NewConfigError(fmt.Sprintf("%s.dest.%s", assistantPath, domain), "exchange %s isn't defined in bindings", exchange))
+			}
+		}
+	}
+	return errs
+}
+
+// отдает имена точки обмена и очереди так же, как их выбирает инициализация связки
+func (b *Binding) names() (string, string) {
+	if len(b.Name) > 0 {
+		return b.Name, b.Name
+	}
+	return b.Exchange, b.Queue
+}
+
+// проверяет настройки связки
+func (b *Binding) checkConfig(path string) []error {
+	errs := make([]error, 0)
+	exchange, queue := b.names()
+	if exchange == common.EmptyStr || queue == common.EmptyStr {
+		errs = append(errs, common.NewConfigError(path, "name or exchange and queue should be defined"))
+	}
+
+	switch b.Type {
+	case "", DirectExchangeType, FanoutExchangeType, TopicExchangeType:
+	default:
+		errs = append(errs, common.NewConfigError(path+".type", "unknown exchange type %q, should be one of %s, %s or %s", b.Type, DirectExchangeType, FanoutExchangeType, TopicExchangeType))
+	}
+
+	switch b.QueueType {
+	case "", ClassicQueueType, QuorumQueueType:
+	case streamQueueType:
+		errs = append(errs, common.NewConfigError(path+".queueType", "queue of type %s isn't supported, messages are requeued and delayed with ttl and dlx", b.QueueType))
+	default:
+		errs = append(errs, common.NewConfigError(path+".queueType", "unknown queue type %q, should be %s or %s", b.QueueType, ClassicQueueType, QuorumQueueType))
+	}
+
+	switch b.Overflow {
+	case "", DropHeadOverflowType, RejectPublishOverflowType, RejectPublishDLXOverflowType:
+	default:
+		errs = append(errs, common.NewConfigError(path+".overflow", "unknown overflow %q, should be one of %s, %s or %s", b.Overflow, DropHeadOverflowType, RejectPublishOverflowType, RejectPublishDLXOverflowType))
+	}
+
+	replicated := b.QueueType == QuorumQueueType
+	if b.MaxPriority < 0 || b.MaxPriority > math.MaxUint8 {
+		errs = append(errs, common.NewConfigError(path+".maxPriority", "max priority should be between 0 and %d", math.MaxUint8))
+	}
+	if b.MaxPriority > 0 && replicated {
+		errs = append(errs, common.NewConfigError(path+".maxPriority", "queue of type %s doesn't support priorities", b.QueueType))
+	}
+	if b.Priority < 0 || b.Priority > math.MaxUint8 {
+		errs = append(errs, common.NewConfigError(path+".priority", "priority should be between 0 and %d", math.MaxUint8))
+	}
+	if b.Lazy && replicated {
+		errs = append(errs, common.NewConfigError(path+".lazy", "queue of type %s can't be lazy", b.QueueType))
+	}
+	if b.Handlers < 0 {
+		errs = append(errs, common.NewConfigError(path+".workers", "workers shouldn't be negative"))
+	}
+	if b.PrefetchCount < 0 {
+		errs = append(errs, common.NewConfigError(path+".prefetchCount", "prefetch count shouldn't be negative"))
+	}
+	if b.MaxLength < 0 || b.MaxLengthBytes < 0 || b.MessageTTL < 0 {
+		errs = append(errs, common.NewConfigError(path, "max length, max length bytes and message ttl shouldn't be negative"))
+	}
+	return errs
+}
@@ -0,0 +1,202 @@
+package consumer
+
+import (
+	"errors"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/streadway/amqp"
+
+	"github.com/Halfi/postmanq/logger"
+)
+
+const (
+	// минимальное время ожидания перед повторным подключением
+	minReconnectDelay = time.Second
+
+	// максимальное время ожидания перед повторным подключением
+	maxReconnectDelay = time.Minute
+)
+
+var (
+	// ErrNotConnected нет соединения с сервером очередей
+	ErrNotConnected = errors.New("amqp server is not connected")
+)
+
+// соединение с сервером очередей
+// соединение заменяется новым после переподключения, поэтому получатели берут его через Wait
+// если указано несколько адресов узлов кластера, при потере соединения подключается к следующему узлу
+type amqpConnector struct {
+	// адреса узлов кластера
+	uris []string
+
+	// индекс адреса, к которому подключено соединение
+	current int
+
+	connect *amqp.Connection
+
+	// закрывается при появлении нового соединения
+	connected chan struct{}
+
+	// закрывается при остановке сервиса
+	done chan struct{}
+
+	rwm sync.RWMutex
+}
+
+// создает соединение без подключения к серверу, первым пробуется адрес с индексом current
+func newAmqpConnector(uris []string, current int) *amqpConnector {
+	return &amqpConnector{
+		uris:      uris,
+		current:   current % len(uris),
+		connected: make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+}
+
+// Dial подключается к первому доступному узлу кластера
+// узлы перебираются по кругу, начиная с текущего, если failover - начиная со следующего за текущим
+// после подключения вызывается prepare, если prepare вернет ошибку, пробуется следующий узел
+func (ac *amqpConnector) Dial(failover bool, prepare func(*amqp.Connection) error) (*amqp.Connection, error) {
+	ac.rwm.RLock()
+	start := ac.current
+	ac.rwm.RUnlock()
+	if failover {
+		start++
+	}
+
+	var err error
+	for i := 0; i < len(ac.uris); i++ {
+		index := (start + i) % len(ac.uris)
+		var connect *amqp.Connection
+		connect, err = amqp.Dial(ac.uris[index])
+		if err == nil {
+			err = prepare(connect)
+			if err == nil {
+				ac.rwm.Lock()
+				ac.current = index
+				ac.rwm.Unlock()
+				return connect, nil
+			}
+			_ = connect.Close()
+		}
+		if len(ac.uris) > 1 {
+			logger.All().WarnWithErr(err, "consumer service can't connect to node %s", redact(ac.uris[index]))
+		}
+	}
+	return nil, err
+}
+
+// SetConnect заменяет соединение и будит ожидающих соединения, nil означает, что соединение потеряно
+func (ac *amqpConnector) SetConnect(connect *amqp.Connection) {
+	ac.rwm.Lock()
+	defer ac.rwm.Unlock()
+	ac.connect = connect
+	if connect != nil {
+		close(ac.connected)
+		ac.connected = make(chan struct{})
+	}
+}
+
+// GetConnect отдает текущее соединение, если соединения нет, отдает nil
+func (ac *amqpConnector) GetConnect() *amqp.Connection {
+	ac.rwm.RLock()
+	defer ac.rwm.RUnlock()
+	return ac.connect
+}
+
+// Channel открывает канал в текущем соединении
+func (ac *amqpConnector) Channel() (*amqp.Channel, error) {
+	connect := ac.GetConnect()
+	if connect == nil || connect.IsClosed() {
+		return nil, ErrNotConnected
+	}
+	return connect.Channel()
+}
+
+// Wait ждет рабочего соединения, если сервис остановлен, вернется false
+func (ac *amqpConnector) Wait() bool {
+	for {
+		ac.rwm.RLock()
+		connect, connected := ac.connect, ac.connected
+		ac.rwm.RUnlock()
+		if connect != nil && !connect.IsClosed() {
+			return true
+		}
+
+		select {
+		case <-ac.done:
+			return false
+		case <-connected:
+		}
+	}
+}
+
+// Sleep ждет delay, если сервис остановлен раньше, вернется false
+func (ac *amqpConnector) Sleep(delay time.Duration) bool {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ac.done:
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+// Connected сообщает, есть ли рабочее соединение
+func (ac *amqpConnector) Connected() bool {
+	connect := ac.GetConnect()
+	return connect != nil && !connect.IsClosed()
+}
+
+// Close закрывает соединение и останавливает переподключение
+func (ac *amqpConnector) Close() error {
+	ac.rwm.Lock()
+	defer ac.rwm.Unlock()
+	select {
+	case <-ac.done:
+	default:
+		close(ac.done)
+	}
+	if ac.connect == nil || ac.connect.IsClosed() {
+		return nil
+	}
+	return ac.connect.Close()
+}
+
+// отдает адрес текущего узла без пароля, чтобы его можно было писать в журнал
+func (ac *amqpConnector) String() string {
+	ac.rwm.RLock()
+	defer ac.rwm.RUnlock()
+	return redact(ac.uris[ac.current])
+}
+
+// убирает пароль из адреса
+func redact(uri string) string {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return uri
+	}
+	return u.Redacted()
+}
+
+// убирает пароли из адресов, перечисленных через запятую
+func redactKey(key string) string {
+	uris := strings.Split(key, ",")
+	for i, uri := range uris {
+		uris[i] = redact(uri)
+	}
+	return strings.Join(uris, ",")
+}
+
+// отдает следующее время ожидания перед повторным подключением
+func nextReconnectDelay(delay time.Duration) time.Duration {
+	delay *= 2
+	if delay > maxReconnectDelay {
+		delay = maxReconnectDelay
+	}
+	return delay
+}
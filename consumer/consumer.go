@@ -2,9 +2,12 @@ package consumer
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"math"
 	"regexp"
 	"sync"
+	"time"
 
 	"github.com/streadway/amqp"
 
@@ -14,7 +17,7 @@ import (
 
 var (
 	// обработчики результата отправки письма
-	resultHandlers = map[common.SendEventResult]func(*Consumer, *amqp.Channel, *common.MailMessage){
+	resultHandlers = map[common.SendEventResult]func(*Consumer, *publisher, *common.MailMessage) error{
 		common.ErrorSendEventResult:     (*Consumer).handleErrorSend,
 		common.DelaySendEventResult:     (*Consumer).handleDelaySend,
 		common.OverlimitSendEventResult: (*Consumer).handleOverlimitSend,
@@ -23,16 +26,26 @@ var (
 
 // получатель сообщений из очереди
 type Consumer struct {
-	id        int
-	connector *amqpConnector
-	binding   *Binding
+	id      int
+	binding *Binding
+
+	// соединения с узлами кластера, обработчики очереди распределяются по соединениям
+	connectors []*amqpConnector
+
+	// останавливает получение сообщений
+	drainer *drainer
+
+	// приостанавливает получение сообщений по запросу к api администрирования
+	pauser *pauser
 }
 
 // создает нового получателя
-func NewConsumer(id int, connect *amqpConnector, binding *Binding) *Consumer {
+func NewConsumer(id int, connectors []*amqpConnector, binding *Binding) *Consumer {
 	app := new(Consumer)
 	app.id = id
-	app.connector = connect
+	app.connectors = connectors
+	app.drainer = newDrainer()
+	app.pauser = newPauser()
 	app.binding = binding
 	return app
 }
@@ -40,17 +53,36 @@ func NewConsumer(id int, connect *amqpConnector, binding *Binding) *Consumer {
 // запускает получение сообщений из очереди в заданное количество потоков
 func (c *Consumer) run() {
 	for i := 0; i < c.binding.Handlers; i++ {
-		go c.consume(i)
+		go c.consume(i, c.connectors[i%len(c.connectors)])
 	}
 }
 
 // подключается к очереди для получения сообщений
-func (c *Consumer) consume(id int) {
-	channel, err := c.connector.GetConnect().Channel()
+// если канал или соединение закрылись, ждет нового соединения и подключается к очереди заново
+// после начала остановки сервиса к очереди больше не подключается, пока получение приостановлено, ждет возобновления
+func (c *Consumer) consume(id int, connector *amqpConnector) {
+	delay := minReconnectDelay
+	for !c.drainer.isDraining() && c.pauser.wait(c.drainer.draining) && connector.Wait() {
+		if c.consumeChannel(id, connector) {
+			delay = minReconnectDelay
+		} else {
+			delay = nextReconnectDelay(delay)
+		}
+		if c.drainer.isDraining() || !connector.Sleep(delay) {
+			return
+		}
+	}
+}
+
+// получает сообщения из очереди, пока канал не закроется
+// если подключиться к очереди не удалось, вернется false
+func (c *Consumer) consumeChannel(id int, connector *amqpConnector) bool {
+	channel, err := connector.Channel()
 	if err != nil {
-		logger.All().Warn("consumer#%d, handler#%d can't get channel %s", c.id, id, c.binding.Queue)
-		return
+		logger.All().WarnWithErr(err, "consumer#%d, handler#%d can't get channel %s", c.id, id, c.binding.Queue)
+		return false
 	}
+	defer channel.Close()
 
 	// выбираем из очереди сообщения с запасом
 	// это нужно для того, чтобы после отправки письма новое уже было готово к отправке
@@ -58,80 +90,212 @@ func (c *Consumer) consume(id int) {
 	err = channel.Qos(c.binding.PrefetchCount, 0, false)
 	if err != nil {
 		logger.All().Warn("consumer#%d, handler#%d can't set qos %s", c.id, id, c.binding.Queue)
-		return
+		return false
 	}
 
+	publisher, err := newPublisher(channel, c.binding)
+	if err != nil {
+		logger.All().WarnWithErr(err, "consumer#%d, handler#%d can't enable publisher confirms %s", c.id, id, c.binding.Queue)
+		return false
+	}
+
+	consumerTag := fmt.Sprintf("postmanq-consumer#%d-%d", c.id, id)
 	deliveries, err := channel.Consume(
 		c.binding.Queue, // name
-		"",              // consumerTag,
+		consumerTag,     // consumerTag,
 		false,           // noAck
 		false,           // exclusive
 		false,           // noLocal
 		false,           // noWait
 		nil,             // arguments
 	)
-	if err == nil {
-		go c.consumeDeliveries(id, channel, deliveries)
-	} else {
+	if err != nil {
 		logger.All().Warn("consumer#%d, handler#%d can't consume queue %s", c.id, id, c.binding.Queue)
+		return false
 	}
+
+	// при остановке сервиса и приостановке получения отменяем подписку, чтобы брокер перестал присылать сообщения
+	done := make(chan struct{})
+	defer close(done)
+	pausing := c.pauser.pauses()
+	go func() {
+		select {
+		case <-c.drainer.draining:
+		case <-pausing:
+		case <-done:
+			return
+		}
+		if err := channel.Cancel(consumerTag, false); err != nil {
+			logger.All().WarnWithErr(err, "consumer#%d, handler#%d can't cancel consuming queue %s", c.id, id, c.binding.Queue)
+		}
+	}()
+
+	c.consumeDeliveries(id, publisher, deliveries)
+	logger.All().Debug("consumer#%d, handler#%d channel of queue %s is closed", c.id, id, c.binding.Queue)
+	return true
 }
 
 // получает сообщения из очереди и отправляет их другим сервисам
-func (c *Consumer) consumeDeliveries(id int, channel *amqp.Channel, deliveries <-chan amqp.Delivery) {
+func (c *Consumer) consumeDeliveries(id int, publisher *publisher, deliveries <-chan amqp.Delivery) {
 	for delivery := range deliveries {
-		message := new(common.MailMessage)
-		err := json.Unmarshal(delivery.Body, message)
+		consumedMessages.WithLabelValues(c.binding.Queue).Inc()
+		// сообщения, полученные после начала остановки, возвращаем в очередь не обрабатывая
+		if !c.drainer.begin() {
+			_ = delivery.Nack(false, true)
+			continue
+		}
+
+		// подтверждаем получение сообщения, даже если во время отправки письма возникли ошибки,
+		// т.к. мы уже положили это письмо в другую очередь
+		// если переложить письмо не удалось, возвращаем сообщение в очередь, чтобы не потерять письмо
+		// если при остановке письмо уже передавалось почтовому серверу, результат отправки неизвестен,
+		// сообщение подтверждаем, чтобы не отправить письмо повторно, и учитываем в метрике
+		err := c.consumeDelivery(id, publisher, &delivery)
 		if err == nil {
-			// инициализируем параметры письма
-			message.Init()
-			logger.
-				By(message.HostnameFrom).
-				Info(
-					"consumer#%d-%d, handler#%d send mail#%d: envelope - %s, recipient - %s to mailer",
-					c.id,
-					message.Id,
-					id,
-					message.Id,
-					message.Envelope,
-					message.Recipient,
-				)
-
-			event := common.NewSendEvent(message)
-			logger.By(message.HostnameFrom).Debug("consumer#%d-%d send event", c.id, message.Id)
-			event.Iterator.Next().(common.SendingService).Event(event)
-			// ждем результата,
-			// во время ожидания поток блокируется
-			// если этого не сделать, тогда невозможно будет подтвердить получение сообщения из очереди
-			if handler, ok := resultHandlers[<-event.Result]; ok {
-				handler(c, channel, message)
-			}
-			message = nil
-			event = nil
+			_ = delivery.Ack(true)
+		} else if errors.Is(err, ErrDrainTransmitting) {
+			logger.All().ErrWithErr(err, "consumer#%d, handler#%d result of mail is unknown, delivery isn't requeued", c.id, id)
+			drainUnknownResults.WithLabelValues(c.binding.Queue).Inc()
+			_ = delivery.Ack(true)
 		} else {
-			failureBinding := c.binding.failureBindings[TechnicalFailureBindingType]
-			err := channel.Publish(
-				failureBinding.Exchange,
-				failureBinding.Routing,
-				false,
-				false,
-				amqp.Publishing{
-					ContentType:  "text/plain",
-					Body:         delivery.Body,
-					DeliveryMode: amqp.Transient,
-				},
-			)
-			logger.All().WarnWithErr(err, "consumer#%d can't unmarshal delivery body, body should be json, %s given", c.id, string(delivery.Body))
+			logger.All().WarnWithErr(err, "consumer#%d, handler#%d can't handle mail, requeue delivery", c.id, id)
+			_ = delivery.Nack(true, true)
 		}
-		// всегда подтверждаем получение сообщения
-		// даже если во время отправки письма возникли ошибки,
-		// мы уже положили это письмо в другую очередь
-		_ = delivery.Ack(true)
+		c.drainer.end()
 	}
 }
 
+// обрабатывает сообщение из очереди
+func (c *Consumer) consumeDelivery(id int, publisher *publisher, delivery *amqp.Delivery) error {
+	message := new(common.MailMessage)
+	err := json.Unmarshal(delivery.Body, message)
+	if err != nil {
+		logger.All().WarnWithErr(err, "consumer#%d can't unmarshal delivery body, body should be json, %s given", c.id, string(delivery.Body))
+		return publisher.publish(
+			c.binding.failureBindings[TechnicalFailureBindingType],
+			amqp.Publishing{
+				ContentType: "text/plain",
+				Body:        delivery.Body,
+				Priority:    delivery.Priority,
+			},
+		)
+	}
+
+	// инициализируем параметры письма
+	message.Init()
+	if message.Priority == 0 {
+		message.Priority = int(delivery.Priority)
+	}
+	if message.Priority == 0 {
+		message.Priority = c.binding.Priority
+	}
+	scheduled, err := c.schedule(publisher, message)
+	if scheduled || err != nil {
+		return err
+	}
+	return c.send(id, publisher, message)
+}
+
+// отправляет письмо другим сервисам и обрабатывает результат отправки
+func (c *Consumer) send(id int, publisher *publisher, message *common.MailMessage) error {
+	logger.
+		By(message.HostnameFrom).
+		Info(
+			"consumer#%d-%d, handler#%d send mail#%d: envelope - %s, recipient - %s to mailer",
+			c.id,
+			message.Id,
+			id,
+			message.Id,
+			message.Envelope,
+			message.Recipient,
+		)
+
+	event := common.NewSendEvent(message)
+	logger.By(message.HostnameFrom).Debug("consumer#%d-%d send event", c.id, message.Id)
+	event.Iterator.Next().(common.SendingService).Event(event)
+	// ждем результата,
+	// во время ожидания поток блокируется
+	// если этого не сделать, тогда невозможно будет подтвердить получение сообщения из очереди
+	// если при остановке сервиса результата не дождались, возвращаем сообщение в очередь,
+	// но только если письмо еще не начали передавать почтовому серверу, иначе письмо может быть отправлено дважды
+	var result common.SendEventResult
+	select {
+	case result = <-event.Result:
+	case <-c.drainer.aborted:
+		if event.Cancel() {
+			return ErrDrainAborted
+		}
+		// передача уже началась, но результат мог прийти одновременно с окончанием ожидания
+		select {
+		case result = <-event.Result:
+		default:
+			return ErrDrainTransmitting
+		}
+	}
+	common.NotifyResult(event, result)
+	observeResult(message, result)
+	if handler, ok := resultHandlers[result]; ok {
+		return handler(c, publisher, message)
+	}
+	return nil
+}
+
+// проверяет дату отправки письма
+// просроченные письма перекладываются в очередь для просроченных писем,
+// письма, которые еще рано отправлять, перекладываются в ближайшую отложенную очередь и проверяются снова по возвращении
+// если письмо не нужно отправлять сейчас, вернется true
+func (c *Consumer) schedule(publisher *publisher, message *common.MailMessage) (bool, error) {
+	now := time.Now()
+	if message.ExpireAt != nil && now.After(*message.ExpireAt) {
+		message.Error = &common.MailError{
+			Message: fmt.Sprintf("mail is expired at %s", message.ExpireAt.Format(time.RFC3339)),
+		}
+		return true, c.publishFailureMessage(publisher, c.binding.failureBindings[ExpiredFailureBindingType], message)
+	}
+
+	if message.SendAt == nil {
+		return false, nil
+	}
+
+	// выбираем самую долгую отложенную очередь, из которой письмо вернется не позже даты отправки
+	var scheduledBinding *Binding
+	wait := message.SendAt.Sub(now)
+	for _, delayedBinding := range c.binding.delayedBindings {
+		if delayedBinding.delay > 0 &&
+			delayedBinding.delay <= wait &&
+			(scheduledBinding == nil || delayedBinding.delay > scheduledBinding.delay) {
+			scheduledBinding = delayedBinding
+		}
+	}
+	if scheduledBinding == nil {
+		return false, nil
+	}
+
+	jsonMessage, err := json.Marshal(message)
+	if err != nil {
+		logger.All().Warn("consumer#%d-%d can't marshal mail to json", c.id, message.Id)
+		return false, nil
+	}
+
+	err = publisher.publish(
+		scheduledBinding,
+		amqp.Publishing{
+			ContentType: "text/plain",
+			Body:        jsonMessage,
+			Priority:    publishingPriority(message),
+		},
+	)
+	if err != nil {
+		logger.All().WarnWithErr(err, "consumer#%d-%d can't publish scheduled mail to queue %s", c.id, message.Id, scheduledBinding.Queue)
+		return true, err
+	}
+
+	logger.By(message.HostnameFrom).Debug("consumer#%d-%d mail is scheduled at %s, publish to queue %s", c.id, message.Id, message.SendAt.Format(time.RFC3339), scheduledBinding.Queue)
+	return true, nil
+}
+
 // обрабатывает письма, которые не удалось отправить
-func (c *Consumer) handleErrorSend(channel *amqp.Channel, message *common.MailMessage) {
+func (c *Consumer) handleErrorSend(publisher *publisher, message *common.MailMessage) error {
 	// если есть ошибка при отправке, значит мы попали в серый список
 	// https://ru.wikipedia.org/wiki/%D0%A1%D0%B5%D1%80%D1%8B%D0%B9_%D1%81%D0%BF%D0%B8%D1%81%D0%BE%D0%BA
 	// или получили какую то ошибку от почтового сервиса, что он не может
@@ -144,56 +308,15 @@ func (c *Consumer) handleErrorSend(channel *amqp.Channel, message *common.MailMe
 	case message.Error.Code >= 500 && message.Error.Code < 600:
 		failureBinding = c.binding.failureBindings[errorSignsMap.BindingType(message)]
 	case message.Error.Code == 450 || message.Error.Code == 451:
-		failureBinding = delayedBindings[common.ThirtyMinutesDelayedBinding]
+		failureBinding = c.binding.delayedBindings[common.ThirtyMinutesDelayedBinding]
 	default:
 		failureBinding = c.binding.failureBindings[UnknownFailureBindingType]
 	}
-	jsonMessage, err := json.Marshal(message)
-	if err == nil {
-		// кладем в очередь
-		err = channel.Publish(
-			failureBinding.Exchange,
-			failureBinding.Routing,
-			false,
-			false,
-			amqp.Publishing{
-				ContentType:  "text/plain",
-				Body:         jsonMessage,
-				DeliveryMode: amqp.Transient,
-			},
-		)
-		if err == nil {
-			logger.
-				By(message.HostnameFrom).
-				Debug(
-					"consumer#%d-%d publish failure mail to queue %s, message: %s, code: %d",
-					c.id,
-					message.Id,
-					failureBinding.Queue,
-					message.Error.Message,
-					message.Error.Code,
-				)
-		} else {
-			logger.
-				By(message.HostnameFrom).
-				Debug(
-					"consumer#%d-%d can't publish failure mail to queue %s, message: %s, code: %d, publish error %v",
-					c.id,
-					message.Id,
-					failureBinding.Queue,
-					message.Error.Message,
-					message.Error.Code,
-					err,
-				)
-			logger.By(message.HostnameFrom).WarnErr(err)
-		}
-	} else {
-		logger.By(message.HostnameFrom).WarnErr(err)
-	}
+	return c.publishFailureMessage(publisher, failureBinding, message)
 }
 
 // обрабатывает письма, которые нужно отправить позже
-func (c *Consumer) handleDelaySend(channel *amqp.Channel, message *common.MailMessage) {
+func (c *Consumer) handleDelaySend(publisher *publisher, message *common.MailMessage) error {
 	logger.
 		By(message.HostnameFrom).
 		Debug(
@@ -225,11 +348,11 @@ func (c *Consumer) handleDelaySend(channel *amqp.Channel, message *common.MailMe
 	if chainBinding, ok := bindingsChain[message.BindingType]; ok {
 		bindingType = chainBinding
 	}
-	c.publishDelayedMessage(channel, bindingType, message)
+	return c.publishDelayedMessage(publisher, bindingType, message)
 }
 
 // обрабатывает письма, которые превысили лимит отправки
-func (c *Consumer) handleOverlimitSend(channel *amqp.Channel, message *common.MailMessage) {
+func (c *Consumer) handleOverlimitSend(publisher *publisher, message *common.MailMessage) error {
 	bindingType := common.UnknownDelayedBinding
 	logger.By(message.HostnameFrom).Debug("consumer#%d-%d detect overlimit, find dlx queue", c.id, message.Id)
 	for i := 0; i < limitBindingsLen; i++ {
@@ -238,45 +361,92 @@ func (c *Consumer) handleOverlimitSend(channel *amqp.Channel, message *common.Ma
 			break
 		}
 	}
-	c.publishDelayedMessage(channel, bindingType, message)
+	return c.publishDelayedMessage(publisher, bindingType, message)
+}
+
+// кладет письмо в очередь для писем с ошибками
+func (c *Consumer) publishFailureMessage(publisher *publisher, failureBinding *Binding, message *common.MailMessage) error {
+	jsonMessage, err := json.Marshal(message)
+	if err != nil {
+		logger.By(message.HostnameFrom).WarnErr(err)
+		return nil
+	}
+
+	// кладем в очередь
+	err = publisher.publish(
+		failureBinding,
+		amqp.Publishing{
+			ContentType: "text/plain",
+			Body:        jsonMessage,
+			Priority:    publishingPriority(message),
+		},
+	)
+	if err == nil {
+		logger.
+			By(message.HostnameFrom).
+			Debug(
+				"consumer#%d-%d publish failure mail to queue %s, message: %s, code: %d",
+				c.id,
+				message.Id,
+				failureBinding.Queue,
+				message.Error.Message,
+				message.Error.Code,
+			)
+	} else {
+		logger.
+			By(message.HostnameFrom).
+			Debug(
+				"consumer#%d-%d can't publish failure mail to queue %s, message: %s, code: %d, publish error %v",
+				c.id,
+				message.Id,
+				failureBinding.Queue,
+				message.Error.Message,
+				message.Error.Code,
+				err,
+			)
+		logger.By(message.HostnameFrom).WarnErr(err)
+	}
+	return err
 }
 
 // кладет письмо обратно в одну из отложенных очередей
-func (c *Consumer) publishDelayedMessage(channel *amqp.Channel, bindingType common.DelayedBindingType, message *common.MailMessage) {
+func (c *Consumer) publishDelayedMessage(publisher *publisher, bindingType common.DelayedBindingType, message *common.MailMessage) error {
 	// получаем очередь, проверяем, что она реально есть
 	// а что? а вдруг нет)
-	if delayedBinding, ok := c.binding.delayedBindings[bindingType]; ok {
-		message.BindingType = bindingType
-		jsonMessage, err := json.Marshal(message)
-		if err == nil {
-			// кладем в очередь
-			err = channel.Publish(
-				delayedBinding.Exchange,
-				delayedBinding.Routing,
-				false,
-				false,
-				amqp.Publishing{
-					ContentType:  "text/plain",
-					Body:         jsonMessage,
-					DeliveryMode: amqp.Transient,
-				},
-			)
-			if err == nil {
-				logger.By(message.HostnameFrom).Debug("consumer#%d-%d publish failure mail to queue %s", c.id, message.Id, delayedBinding.Queue)
-			} else {
-				logger.All().WarnWithErr(err, "consumer#%d-%d can't publish failure mail to queue %s", c.id, message.Id, delayedBinding.Queue)
-			}
-		} else {
-			logger.All().Warn("consumer#%d-%d can't marshal mail to json", c.id, message.Id)
-		}
-	} else {
+	delayedBinding, ok := c.binding.delayedBindings[bindingType]
+	if !ok {
 		logger.All().Warn("consumer#%d-%d unknow delayed type#%v", c.id, message.Id, bindingType)
+		return nil
 	}
+
+	message.BindingType = bindingType
+	jsonMessage, err := json.Marshal(message)
+	if err != nil {
+		logger.All().Warn("consumer#%d-%d can't marshal mail to json", c.id, message.Id)
+		return nil
+	}
+
+	// кладем в очередь
+	err = publisher.publish(
+		delayedBinding,
+		amqp.Publishing{
+			ContentType: "text/plain",
+			Body:        jsonMessage,
+			Priority:    publishingPriority(message),
+		},
+	)
+	if err == nil {
+		logger.By(message.HostnameFrom).Debug("consumer#%d-%d publish failure mail to queue %s", c.id, message.Id, delayedBinding.Queue)
+	} else {
+		logger.All().WarnWithErr(err, "consumer#%d-%d can't publish failure mail to queue %s", c.id, message.Id, delayedBinding.Queue)
+	}
+	return err
 }
 
 // получает письма из всех очередей с ошибками
 func (c *Consumer) consumeFailureMessages(group *sync.WaitGroup) {
-	channel, err := c.connector.GetConnect().Channel()
+	defer group.Done()
+	channel, err := c.connectors[0].Channel()
 	if err == nil {
 		for _, failureBinding := range c.binding.failureBindings {
 			for {
@@ -293,7 +463,6 @@ func (c *Consumer) consumeFailureMessages(group *sync.WaitGroup) {
 				}
 			}
 		}
-		group.Done()
 	} else {
 		logger.All().WarnErr(err)
 	}
@@ -301,7 +470,8 @@ func (c *Consumer) consumeFailureMessages(group *sync.WaitGroup) {
 
 // получает сообщения из одной очереди и кладет их в другую
 func (c *Consumer) consumeAndPublishMessages(event *common.ApplicationEvent, group *sync.WaitGroup) {
-	channel, err := c.connector.GetConnect().Channel()
+	defer group.Done()
+	channel, err := c.connectors[0].Channel()
 	if err == nil {
 		var envelopeRegex, recipientRegex *regexp.Regexp
 		srcBinding := c.findBindingByQueueName(event.GetStringArg("srcQueue"))
@@ -325,6 +495,12 @@ func (c *Consumer) consumeAndPublishMessages(event *common.ApplicationEvent, gro
 			recipientRegex, _ = regexp.Compile(event.GetStringArg("recipient"))
 		}
 
+		publisher, err := newPublisher(channel, destBinding)
+		if err != nil {
+			logger.All().WarnWithErr(err, "can't enable publisher confirms %s", destBinding.Queue)
+			return
+		}
+
 		publishDeliveries := make([]amqp.Delivery, 0)
 		for {
 			delivery, ok, _ := channel.Get(srcBinding.Queue, false)
@@ -355,15 +531,12 @@ func (c *Consumer) consumeAndPublishMessages(event *common.ApplicationEvent, gro
 		}
 
 		for _, delivery := range publishDeliveries {
-			err = channel.Publish(
-				destBinding.Exchange,
-				destBinding.Routing,
-				false,
-				false,
+			err = publisher.publish(
+				destBinding,
 				amqp.Publishing{
-					ContentType:  "text/plain",
-					Body:         delivery.Body,
-					DeliveryMode: amqp.Transient,
+					ContentType: "text/plain",
+					Body:        delivery.Body,
+					Priority:    delivery.Priority,
 				},
 			)
 			if err == nil {
@@ -378,7 +551,6 @@ func (c *Consumer) consumeAndPublishMessages(event *common.ApplicationEvent, gro
 				}
 			}
 		}
-		group.Done()
 	} else {
 		logger.All().WarnErr(err)
 	}
@@ -412,3 +584,15 @@ func (c *Consumer) findBindingByQueueName(queueName string) *Binding {
 
 	return binding
 }
+
+// приводит приоритет письма к приоритету сообщения AMQP
+func publishingPriority(message *common.MailMessage) uint8 {
+	switch {
+	case message.Priority < 0:
+		return 0
+	case message.Priority > math.MaxUint8:
+		return math.MaxUint8
+	default:
+		return uint8(message.Priority)
+	}
+}
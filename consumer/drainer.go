@@ -0,0 +1,137 @@
+package consumer
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrDrainAborted время ожидания отправки писем при остановке истекло
+	ErrDrainAborted = errors.New("consumer drain is aborted")
+
+	// ErrDrainTransmitting время ожидания отправки писем при остановке истекло, когда письмо уже передавалось почтовому серверу
+	ErrDrainTransmitting = errors.New("consumer drain is aborted while mail is transmitting")
+)
+
+// останавливает получение сообщений и дожидается отправки уже полученных писем
+type drainer struct {
+	// количество сообщений, которые обрабатываются в данный момент
+	inflight int
+
+	// признак начала остановки
+	stopped bool
+
+	// закрывается в начале остановки, получатели отменяют подписку на очереди
+	draining chan struct{}
+
+	// закрывается, когда все сообщения обработаны после начала остановки
+	idle chan struct{}
+
+	// закрывается, когда время ожидания истекло, получатели перестают ждать результат отправки
+	aborted chan struct{}
+
+	mutex sync.Mutex
+}
+
+// создает остановщика
+func newDrainer() *drainer {
+	return &drainer{
+		draining: make(chan struct{}),
+		idle:     make(chan struct{}),
+		aborted:  make(chan struct{}),
+	}
+}
+
+// регистрирует начало обработки сообщения, если остановка уже началась, вернется false
+func (d *drainer) begin() bool {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.stopped {
+		return false
+	}
+	d.inflight++
+	return true
+}
+
+// регистрирует окончание обработки сообщения
+func (d *drainer) end() {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.inflight--
+	if d.stopped && d.inflight == 0 {
+		close(d.idle)
+	}
+}
+
+// сообщает, началась ли остановка
+func (d *drainer) isDraining() bool {
+	select {
+	case <-d.draining:
+		return true
+	default:
+		return false
+	}
+}
+
+// останавливает получение сообщений и ждет окончания обработки полученных сообщений, пока не закончится контекст
+// по окончании контекста получатели перестают ждать результат отправки и возвращают сообщения в очередь,
+// на это им дается еще grace
+func (d *drainer) drain(ctx context.Context, grace time.Duration) bool {
+	d.mutex.Lock()
+	if !d.stopped {
+		d.stopped = true
+		close(d.draining)
+		if d.inflight == 0 {
+			close(d.idle)
+		}
+	}
+	d.mutex.Unlock()
+
+	select {
+	case <-d.idle:
+		return true
+	default:
+	}
+	select {
+	case <-d.idle:
+		return true
+	case <-ctx.Done():
+	}
+
+	select {
+	case <-d.aborted:
+	default:
+		close(d.aborted)
+	}
+	timer := time.NewTimer(grace)
+	defer timer.Stop()
+	select {
+	case <-d.idle:
+	case <-timer.C:
+	}
+	return false
+}
+
+// останавливает получение сообщений всеми остановщиками и ждет окончания обработки полученных сообщений,
+// сообщает, успели ли все получатели обработать сообщения до окончания контекста
+func drainAll(ctx context.Context, drainers []*drainer, grace time.Duration) bool {
+	group := new(sync.WaitGroup)
+	results := make(chan bool, len(drainers))
+	for _, d := range drainers {
+		group.Add(1)
+		go func(d *drainer) {
+			defer group.Done()
+			results <- d.drain(ctx, grace)
+		}(d)
+	}
+	group.Wait()
+	close(results)
+
+	drained := true
+	for result := range results {
+		drained = drained && result
+	}
+	return drained
+}
@@ -0,0 +1,48 @@
+package consumer
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/Halfi/postmanq/common"
+	"github.com/Halfi/postmanq/connector"
+)
+
+var (
+	// количество сообщений, полученных из очереди связки
+	consumedMessages = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "postmanq",
+		Subsystem: "consumer",
+		Name:      "messages_total",
+		Help:      "Messages consumed from queue of binding.",
+	}, []string{"binding"})
+
+	// количество писем по результату отправки и классу кода ответа почтового сервера
+	sendResults = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "postmanq",
+		Subsystem: "consumer",
+		Name:      "results_total",
+		Help:      "Mails by postman, mail provider, result and reply code class.",
+	}, []string{"postman", "provider", "result", "code"})
+
+	// количество писем, результат отправки которых неизвестен, т.к. время ожидания при остановке истекло во время передачи письма
+	drainUnknownResults = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "postmanq",
+		Subsystem: "consumer",
+		Name:      "drain_unknown_results_total",
+		Help:      "Mails acknowledged without send result because drain timed out while mail was transmitting.",
+	}, []string{"binding"})
+)
+
+// учитывает результат отправки письма, у успешно отправленного письма нет ошибки, а почтовый сервер ответил 250
+// письма учитываются по почтовому сервису, а не по домену получателя, чтобы количество рядов метрики не росло с количеством доменов
+func observeResult(message *common.MailMessage, result common.SendEventResult) {
+	code := 0
+	if message.Error != nil {
+		code = message.Error.Code
+	} else if result == common.SuccessSendEventResult {
+		code = 250
+	}
+	provider := connector.ServerLabel(message.HostnameFrom, message.HostnameTo)
+	sendResults.WithLabelValues(message.HostnameFrom, provider, result.String(), common.CodeClass(code)).Inc()
+}
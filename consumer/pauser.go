@@ -0,0 +1,81 @@
+package consumer
+
+import "sync"
+
+// приостанавливает и возобновляет получение сообщений
+type pauser struct {
+	// признак приостановки
+	paused bool
+
+	// закрывается при приостановке, получатели отменяют подписку на очередь
+	pausing chan struct{}
+
+	// закрывается при возобновлении, получатели подписываются на очередь заново
+	resuming chan struct{}
+
+	mutex sync.Mutex
+}
+
+// создает приостановщика, получение сообщений не приостановлено
+func newPauser() *pauser {
+	resuming := make(chan struct{})
+	close(resuming)
+	return &pauser{
+		pausing:  make(chan struct{}),
+		resuming: resuming,
+	}
+}
+
+// приостанавливает получение сообщений, если получение уже приостановлено, вернется false
+func (p *pauser) pause() bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.paused {
+		return false
+	}
+	p.paused = true
+	close(p.pausing)
+	p.resuming = make(chan struct{})
+	return true
+}
+
+// возобновляет получение сообщений, если получение не приостановлено, вернется false
+func (p *pauser) resume() bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if !p.paused {
+		return false
+	}
+	p.paused = false
+	close(p.resuming)
+	p.pausing = make(chan struct{})
+	return true
+}
+
+// сообщает, приостановлено ли получение сообщений
+func (p *pauser) isPaused() bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.paused
+}
+
+// отдает канал, закрываемый при приостановке
+func (p *pauser) pauses() <-chan struct{} {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.pausing
+}
+
+// ждет возобновления получения сообщений, если раньше закрылся stop, вернется false
+func (p *pauser) wait(stop <-chan struct{}) bool {
+	p.mutex.Lock()
+	resuming := p.resuming
+	p.mutex.Unlock()
+
+	select {
+	case <-resuming:
+		return true
+	case <-stop:
+		return false
+	}
+}
@@ -0,0 +1,89 @@
+package consumer
+
+import (
+	"errors"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// время, в течение которого ждем подтверждения брокера
+const confirmTimeout = 30 * time.Second
+
+var (
+	// ErrNotConfirmed брокер не подтвердил получение сообщения
+	ErrNotConfirmed = errors.New("amqp broker didn't confirm publishing")
+
+	// ErrConfirmsClosed канал закрылся раньше, чем брокер подтвердил получение сообщения
+	ErrConfirmsClosed = errors.New("amqp channel is closed before publishing confirmation")
+
+	// ErrConfirmTimeout брокер не подтвердил получение сообщения за confirmTimeout
+	ErrConfirmTimeout = errors.New("amqp broker didn't confirm publishing in time")
+)
+
+// публикует сообщения в канал
+// если включены подтверждения, после публикации ждет подтверждения брокера,
+// поэтому исходное сообщение можно подтверждать только после успешной публикации
+// канал используется одним потоком, поэтому подтверждения приходят в порядке публикации
+type publisher struct {
+	channel *amqp.Channel
+
+	// режим доставки публикуемых сообщений, если режим не указан в самом сообщении
+	deliveryMode uint8
+
+	// подтверждения брокера, nil, если подтверждения выключены
+	confirms chan amqp.Confirmation
+}
+
+// создает публикатора, если binding требует подтверждений, переводит канал в режим подтверждений
+func newPublisher(channel *amqp.Channel, binding *Binding) (*publisher, error) {
+	return newConfirmPublisher(channel, binding.deliveryMode(), binding.Confirm)
+}
+
+// создает публикатора, если confirm включен, переводит канал в режим подтверждений
+// в режиме подтверждений брокер подтверждает все сообщения канала, поэтому подтверждения ждем после каждой публикации
+func newConfirmPublisher(channel *amqp.Channel, deliveryMode uint8, confirm bool) (*publisher, error) {
+	p := &publisher{channel: channel, deliveryMode: deliveryMode}
+	if confirm {
+		if err := channel.Confirm(false); err != nil {
+			return nil, err
+		}
+		p.confirms = channel.NotifyPublish(make(chan amqp.Confirmation, 1))
+	}
+	return p, nil
+}
+
+// публикует сообщение в точку обмена связки и ждет подтверждения брокера
+// если брокер не подтвердил сообщение за confirmTimeout, канал закрывается,
+// иначе запоздавшее подтверждение было бы принято за подтверждение следующего сообщения
+func (p *publisher) publish(binding *Binding, publishing amqp.Publishing) error {
+	if publishing.DeliveryMode == 0 {
+		publishing.DeliveryMode = p.deliveryMode
+	}
+	err := p.channel.Publish(
+		binding.Exchange,
+		binding.Routing,
+		false,
+		false,
+		publishing,
+	)
+	if err != nil || p.confirms == nil {
+		return err
+	}
+
+	timer := time.NewTimer(confirmTimeout)
+	defer timer.Stop()
+	select {
+	case confirmation, ok := <-p.confirms:
+		if !ok {
+			return ErrConfirmsClosed
+		}
+		if !confirmation.Ack {
+			return ErrNotConfirmed
+		}
+		return nil
+	case <-timer.C:
+		_ = p.channel.Close()
+		return ErrConfirmTimeout
+	}
+}
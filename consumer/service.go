@@ -1,8 +1,12 @@
 package consumer
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"net/url"
+	"sort"
+	"strings"
 	"sync"
 
 	"github.com/streadway/amqp"
@@ -12,46 +16,41 @@ import (
 	"github.com/Halfi/postmanq/logger"
 )
 
-type amqpConnector struct {
-	connect *amqp.Connection
-	rwm     sync.RWMutex
-}
-
-func (ac *amqpConnector) SetConnect(connect *amqp.Connection) {
-	ac.rwm.Lock()
-	defer ac.rwm.Unlock()
-	ac.connect = connect
-}
-
-func (ac *amqpConnector) GetConnect() *amqp.Connection {
-	ac.rwm.RLock()
-	defer ac.rwm.RUnlock()
-	return ac.connect
-}
-
 // сервис получения сообщений
 type Service struct {
 	// настройка получателей сообщений
 	Configs []*Config `yaml:"consumers"`
 
+	// настройки, с которыми работают соединения и получатели
+	configs map[string]*Config
+
 	// подключения к очередям
-	connections map[string]*amqpConnector
+	connections map[string][]*amqpConnector
 
 	// получатели сообщений из очереди
 	consumers map[string][]*Consumer
 
 	assistants map[string][]*Assistant
 
-	finish bool
+	// защищает соединения и получателей от одновременного изменения и проверки состояния
+	mutex sync.RWMutex
+
+	// последние выданные идентификаторы получателей и помощников
+	consumersCount  int
+	assistantsCount int
 }
 
 // создает новый сервис получения сообщений
 func Inst() common.SendingService {
-	return &Service{
-		connections: make(map[string]*amqpConnector),
+	service := &Service{
+		configs:     make(map[string]*Config),
+		connections: make(map[string][]*amqpConnector),
 		consumers:   make(map[string][]*Consumer),
 		assistants:  make(map[string][]*Assistant),
 	}
+	common.RegisterHealthCheck("amqp", common.ReadinessProbe, service.checkConnections)
+	service.registerAdminHandlers()
+	return service
 }
 
 // OnInit инициализирует сервис
@@ -68,125 +67,365 @@ func (s *Service) OnInit(event *common.ApplicationEvent) {
 		return
 	}
 
-	consumersCount := 0
-	assistantsCount := 0
 	for _, config := range s.Configs {
-		connect, err := amqp.Dial(config.URI)
-		if err != nil {
-			logger.All().ErrWithErr(err, "consumer service can't connect to %s", config.URI)
+		if len(config.uris()) == 0 {
+			logger.All().Err("consumer config has no uri")
 			continue
 		}
+		s.initConfig(config)
+	}
+}
 
-		connector := new(amqpConnector)
-		connector.SetConnect(connect)
+// создает соединения, получателей и помощников для настроек и подключается к серверу очередей
+func (s *Service) initConfig(config *Config) {
+	config.fingerprint()
 
-		channel, err := connector.GetConnect().Channel()
-		if err != nil {
-			logger.All().ErrWithErr(err, "consumer service can't get channel to %s", config.URI)
-			continue
+	uris := config.uris()
+	// если обработчики распределяются по узлам кластера, к каждому узлу открывается свое соединение,
+	// иначе все обработчики используют одно соединение
+	connectorsCount := 1
+	if config.Spread {
+		connectorsCount = len(uris)
+	}
+	connectors := make([]*amqpConnector, connectorsCount)
+	for i := range connectors {
+		connectors[i] = newAmqpConnector(uris, i)
+	}
+
+	consumers := make([]*Consumer, len(config.Bindings))
+	for i, binding := range config.Bindings {
+		consumers[i] = s.newConsumer(connectors, binding)
+	}
+	assistants := s.newAssistants(connectors, config, consumers)
+
+	key := config.key()
+	s.mutex.Lock()
+	s.configs[key] = config
+	s.connections[key] = connectors
+	s.consumers[key] = consumers
+	s.assistants[key] = assistants
+	s.mutex.Unlock()
+
+	for _, connector := range connectors {
+		// если подключиться не удалось, переподключаемся в фоне,
+		// получатели начнут разбирать очереди, как только появится соединение
+		connect, err := connector.Dial(false, s.declarer(key))
+		if err == nil {
+			connector.SetConnect(connect)
+		} else {
+			logger.All().ErrWithErr(err, "consumer service can't connect to %s, reconnecting", connector)
 		}
+		// слушаем закрытие соединения
+		go s.reconnect(connector, key)
+	}
+}
 
-		consumers := make([]*Consumer, len(config.Bindings))
-		for i, binding := range config.Bindings {
-			binding.init()
-			// объявляем очередь
-			binding.declare(channel)
-
-			binding.delayedBindings = make(map[common.DelayedBindingType]*Binding)
-			// объявляем отложенные очереди
-			for delayedBindingType, delayedBinding := range delayedBindings {
-				delayedBinding.declareDelayed(binding, channel)
-				binding.delayedBindings[delayedBindingType] = delayedBinding
-			}
+// создает получателя сообщений из очереди
+func (s *Service) newConsumer(connectors []*amqpConnector, binding *Binding) *Consumer {
+	binding.init()
 
-			binding.failureBindings = make(map[FailureBindingType]*Binding)
-			for failureBindingType, tplName := range failureBindingTypeTplNames {
-				failureBinding := new(Binding)
-				failureBinding.Exchange = fmt.Sprintf(tplName, binding.Exchange)
-				failureBinding.Queue = fmt.Sprintf(tplName, binding.Queue)
-				failureBinding.Type = binding.Type
-				failureBinding.declare(channel)
-				binding.failureBindings[failureBindingType] = failureBinding
-			}
+	binding.delayedBindings = make(map[common.DelayedBindingType]*Binding)
+	for delayedBindingType, delayedBinding := range delayedBindings {
+		binding.delayedBindings[delayedBindingType] = delayedBinding.cloneDelayed(binding)
+	}
 
-			consumersCount++
-			consumers[i] = NewConsumer(consumersCount, connector, binding)
-		}
+	binding.failureBindings = make(map[FailureBindingType]*Binding)
+	for failureBindingType, tplName := range failureBindingTypeTplNames {
+		binding.failureBindings[failureBindingType] = binding.newFailureBinding(tplName)
+	}
+
+	s.consumersCount++
+	return NewConsumer(s.consumersCount, connectors, binding)
+}
 
-		assistants := make([]*Assistant, len(config.Assistants))
-		for i, assistantBinding := range config.Assistants {
-			assistantBinding.Binding.init()
-			// объявляем очередь
-			assistantBinding.Binding.declare(channel)
-
-			destBindings := make(map[string]*Binding)
-			for domain, exchange := range assistantBinding.Dest {
-				for _, consumer := range consumers {
-					if consumer.binding.Exchange == exchange {
-						destBindings[domain] = consumer.binding
-						break
-					}
+// создает помощников, перекладывающих сообщения в очереди получателей
+func (s *Service) newAssistants(connectors []*amqpConnector, config *Config, consumers []*Consumer) []*Assistant {
+	assistants := make([]*Assistant, len(config.Assistants))
+	for i, assistantBinding := range config.Assistants {
+		assistantBinding.Binding.init()
+
+		destBindings := make(map[string]*Binding)
+		for domain, exchange := range assistantBinding.Dest {
+			for _, consumer := range consumers {
+				if consumer.binding.Exchange == exchange {
+					destBindings[domain] = consumer.binding
+					break
 				}
 			}
+		}
+
+		s.assistantsCount++
+		assistants[i] = &Assistant{
+			id:           s.assistantsCount,
+			connectors:   connectors,
+			srcBinding:   assistantBinding,
+			destBindings: destBindings,
+			drainer:      newDrainer(),
+		}
+	}
+	return assistants
+}
+
+// OnReconfigure применяет новые настройки, не останавливая получателей, настройки которых не изменились
+// соединения создаются и закрываются только для добавленных и удаленных серверов очередей,
+// для измененных связок останавливаются старые получатели и запускаются новые,
+// помощники измененных настроек всегда запускаются заново, т.к. ссылаются на связки получателей
+func (s *Service) OnReconfigure(event *common.ApplicationEvent) {
+	service := new(Service)
+	err := yaml.Unmarshal(event.Data, service)
+	if err != nil {
+		logger.All().ErrWithErr(err, "consumer service can't unmarshal config")
+		return
+	}
+
+	if len(service.Configs) == 0 {
+		logger.All().Err("consumer config is empty, current config is used")
+		return
+	}
+
+	keys := make(map[string]bool)
+	configs := make([]*Config, 0, len(service.Configs))
+	for _, config := range service.Configs {
+		if len(config.uris()) == 0 {
+			logger.All().Err("consumer config has no uri")
+			continue
+		}
+
+		key := config.key()
+		keys[key] = true
+		s.mutex.RLock()
+		current, ok := s.configs[key]
+		s.mutex.RUnlock()
+
+		switch {
+		case !ok:
+			logger.All().Debug("consumer service add consumers of %s", redactKey(key))
+			s.initConfig(config)
+			s.run(key)
+		case current.hash == common.Fingerprint(config):
+			config = current
+		case current.Spread != config.Spread:
+			logger.All().Debug("consumer service restart consumers of %s", redactKey(key))
+			s.stop(key)
+			s.initConfig(config)
+			s.run(key)
+		default:
+			s.reconfigureBindings(key, config)
+		}
+		configs = append(configs, config)
+	}
+
+	s.mutex.RLock()
+	removed := make([]string, 0)
+	for key := range s.configs {
+		if !keys[key] {
+			removed = append(removed, key)
+		}
+	}
+	s.mutex.RUnlock()
+	for _, key := range removed {
+		logger.All().Debug("consumer service remove consumers of %s", redactKey(key))
+		s.stop(key)
+	}
+
+	s.Configs = configs
+}
+
+// применяет изменения связок, не меняя соединения
+// получатели связок, настройки которых не изменились, продолжают работать
+func (s *Service) reconfigureBindings(key string, config *Config) {
+	config.fingerprint()
 
-			assistantsCount++
-			assistants[i] = &Assistant{
-				id:           assistantsCount,
-				connector:    connector,
-				srcBinding:   assistantBinding,
-				destBindings: destBindings,
+	s.mutex.RLock()
+	connectors := s.connections[key]
+	currentConsumers := s.consumers[key]
+	currentAssistants := s.assistants[key]
+	s.mutex.RUnlock()
+
+	unchanged := make(map[string][]*Consumer)
+	for _, consumer := range currentConsumers {
+		unchanged[consumer.binding.hash] = append(unchanged[consumer.binding.hash], consumer)
+	}
+
+	consumers := make([]*Consumer, len(config.Bindings))
+	added := make([]*Consumer, 0)
+	for i, binding := range config.Bindings {
+		if same := unchanged[binding.hash]; len(same) > 0 {
+			consumers[i] = same[0]
+			unchanged[binding.hash] = same[1:]
+			config.Bindings[i] = same[0].binding
+			continue
+		}
+		consumers[i] = s.newConsumer(connectors, binding)
+		added = append(added, consumers[i])
+		logger.All().Debug("consumer service add consumer of queue %s", binding.Queue)
+	}
+
+	removed := make([]*Consumer, 0)
+	for _, same := range unchanged {
+		for _, consumer := range same {
+			removed = append(removed, consumer)
+			logger.All().Debug("consumer service remove consumer of queue %s", consumer.binding.Queue)
+		}
+	}
+
+	assistants := s.newAssistants(connectors, config, consumers)
+
+	s.mutex.Lock()
+	s.configs[key] = config
+	s.consumers[key] = consumers
+	s.assistants[key] = assistants
+	s.mutex.Unlock()
+
+	// объявляем очереди добавленных связок, если соединения сейчас нет, очереди объявятся при переподключении
+	if len(added) > 0 {
+		for _, connector := range connectors {
+			if connect := connector.GetConnect(); connect != nil && !connect.IsClosed() {
+				if err := config.declare(connect); err != nil {
+					logger.All().WarnWithErr(err, "consumer service can't declare bindings on %s", connector)
+				}
+				break
 			}
 		}
+	}
 
-		s.connections[config.URI] = connector
-		s.consumers[config.URI] = consumers
-		s.assistants[config.URI] = assistants
-		// слушаем закрытие соединения
-		s.reconnect(connector, config)
+	s.runConsumers(added)
+	s.runAssistants(assistants)
+	go s.shutdown(removed, currentAssistants, nil)
+}
+
+// объявляет точки обмена и очереди, каждую связку на своем канале
+// ошибка одной связки не мешает объявить остальные, отдает ошибки всех связок
+func (c *Config) declare(connect *amqp.Connection) error {
+	errs := make([]string, 0)
+	for _, binding := range c.Bindings {
+		if err := binding.declareAll(connect); err != nil {
+			errs = append(errs, err.Error())
+		}
 	}
+	for _, assistantBinding := range c.Assistants {
+		if err := assistantBinding.Binding.declareAll(connect); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if connect.IsClosed() {
+		return amqp.ErrClosed
+	}
+	if len(errs) > 0 {
+		return &declareError{message: strings.Join(errs, "; ")}
+	}
+	return nil
 }
 
-// объявляет слушателя закрытия соединения
-func (s *Service) reconnect(connector *amqpConnector, config *Config) {
-	closeErrors := connector.GetConnect().NotifyClose(make(chan *amqp.Error))
-	go s.notifyCloseError(config, closeErrors)
+// ошибка объявления связок, соединение после нее остается рабочим
+type declareError struct {
+	message string
 }
 
-// слушает закрытие соединения
-func (s *Service) notifyCloseError(config *Config, closeErrors chan *amqp.Error) {
-	for closeError := range closeErrors {
-		if s.finish {
-			return
+func (e *declareError) Error() string {
+	return "can't declare bindings: " + e.message
+}
+
+// отдает функцию, объявляющую точки обмена и очереди текущих настроек
+// после переконфигурации соединение объявляет очереди уже новых настроек
+// ошибки объявления связок пишутся в лог и не мешают подключению, получатели остальных связок продолжают работу
+func (s *Service) declarer(key string) func(*amqp.Connection) error {
+	return func(connect *amqp.Connection) error {
+		s.mutex.RLock()
+		config, ok := s.configs[key]
+		s.mutex.RUnlock()
+		if !ok {
+			return nil
 		}
 
-		logger.All().Warn("consumer service close connection %s with error - %v, restart...", config.URI, closeError)
-		connect, err := amqp.Dial(config.URI)
-		if err == nil {
-			connector, ok := s.connections[config.URI]
-			if !ok {
-				s.connections[config.URI] = new(amqpConnector)
+		err := config.declare(connect)
+		var declareErr *declareError
+		if errors.As(err, &declareErr) {
+			logger.All().ErrWithErr(err, "consumer service can't declare bindings")
+			return nil
+		}
+		return err
+	}
+}
+
+// слушает закрытие соединения и переподключается к серверу очередей
+// пока подключиться не удается, попытки повторяются с увеличивающейся паузой
+func (s *Service) reconnect(connector *amqpConnector, key string) {
+	for {
+		if connect := connector.GetConnect(); connect != nil {
+			closeErrors := connect.NotifyClose(make(chan *amqp.Error, 1))
+			select {
+			case <-connector.done:
+				return
+			case closeError := <-closeErrors:
+				logger.All().Warn("consumer service close connection %s with error - %v, restart...", connector, closeError)
 			}
-			connector.SetConnect(connect)
+			connector.SetConnect(nil)
+		}
 
-			s.reconnect(connector, config)
-			logger.All().Debug("consumer service reconnect to amqp server %s", config.URI)
-		} else {
-			logger.All().WarnWithErr(err, "consumer service can't reconnect to amqp server %s", config.URI)
+		delay := minReconnectDelay
+		for {
+			if !connector.Sleep(delay) {
+				return
+			}
+
+			connect, err := connector.Dial(true, s.declarer(key))
+			if err == nil {
+				connector.SetConnect(connect)
+				logger.All().Debug("consumer service reconnect to amqp server %s", connector)
+				break
+			}
+
+			logger.All().WarnWithErr(err, "consumer service can't reconnect to amqp server %s", connector)
+			delay = nextReconnectDelay(delay)
 		}
 	}
 }
 
+// проверяет соединения с серверами очередей, ошибка перечисляет все серверы без соединения
+func (s *Service) checkConnections(_ context.Context) error {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	disconnected := make([]string, 0)
+	for _, connectors := range s.connections {
+		for _, connector := range connectors {
+			if !connector.Connected() {
+				disconnected = append(disconnected, connector.String())
+			}
+		}
+	}
+	if len(disconnected) > 0 {
+		sort.Strings(disconnected)
+		return fmt.Errorf("%w: %s", ErrNotConnected, strings.Join(disconnected, ", "))
+	}
+	return nil
+}
+
 // запускает сервис
 func (s *Service) OnRun() {
 	logger.All().Debug("run consumers...")
-	for _, consumers := range s.consumers {
-		s.runConsumers(consumers)
+	s.mutex.RLock()
+	keys := make([]string, 0, len(s.consumers))
+	for key := range s.consumers {
+		keys = append(keys, key)
 	}
-	for _, assistants := range s.assistants {
-		s.runAssistants(assistants)
+	s.mutex.RUnlock()
+
+	for _, key := range keys {
+		s.run(key)
 	}
 }
 
+// запускает получателей и помощников настроек
+func (s *Service) run(key string) {
+	s.mutex.RLock()
+	consumers, assistants := s.consumers[key], s.assistants[key]
+	s.mutex.RUnlock()
+
+	s.runConsumers(consumers)
+	s.runAssistants(assistants)
+}
+
 // запускает получателей
 func (s *Service) runConsumers(consumers []*Consumer) {
 	for _, consumer := range consumers {
@@ -200,20 +439,82 @@ func (s *Service) runAssistants(assistants []*Assistant) {
 	}
 }
 
+// останавливает получателей и помощников настроек и закрывает их соединения
+// получатели останавливаются в фоне, пока новые получатели уже работают
+func (s *Service) stop(key string) {
+	s.mutex.Lock()
+	connectors, consumers, assistants := s.connections[key], s.consumers[key], s.assistants[key]
+	delete(s.configs, key)
+	delete(s.connections, key)
+	delete(s.consumers, key)
+	delete(s.assistants, key)
+	s.mutex.Unlock()
+
+	go s.shutdown(consumers, assistants, connectors)
+}
+
+// ждет, пока получатели и помощники обработают полученные сообщения, и закрывает соединения
+func (s *Service) shutdown(consumers []*Consumer, assistants []*Assistant, connectors []*amqpConnector) {
+	ctx, cancel := context.WithTimeout(context.Background(), common.App.Timeout().Drain)
+	defer cancel()
+
+	if !drainAll(ctx, collectDrainers(consumers, assistants), common.App.Timeout().Sleep) {
+		logger.All().Warn("removed consumers aren't drained in time, unhandled mails are requeued")
+	}
+
+	for _, connector := range connectors {
+		if err := connector.Close(); err != nil {
+			logger.All().WarnErr(err)
+		}
+	}
+}
+
+// отдает остановщиков получателей и помощников
+func collectDrainers(consumers []*Consumer, assistants []*Assistant) []*drainer {
+	drainers := make([]*drainer, 0, len(consumers)+len(assistants))
+	for _, consumer := range consumers {
+		drainers = append(drainers, consumer.drainer)
+	}
+	for _, assistant := range assistants {
+		drainers = append(drainers, assistant.drainer)
+	}
+	return drainers
+}
+
+// OnDrain отменяет подписки на очереди и ждет, пока получатели обработают полученные сообщения
+// если контекст закончился раньше, необработанные сообщения возвращаются в очередь
+func (s *Service) OnDrain(ctx context.Context) {
+	s.mutex.RLock()
+	drainers := make([]*drainer, 0)
+	for key := range s.consumers {
+		drainers = append(drainers, collectDrainers(s.consumers[key], s.assistants[key])...)
+	}
+	s.mutex.RUnlock()
+
+	logger.All().Debug("drain consumers...")
+	if drainAll(ctx, drainers, common.App.Timeout().Sleep) {
+		logger.All().Debug("consumers are drained")
+	} else {
+		logger.All().Warn("consumers aren't drained in time, unhandled mails are requeued")
+	}
+}
+
 // останавливает получателей
 func (s *Service) OnFinish() {
 	logger.All().Debug("stop consumers...")
-	s.finish = true
-	for _, connector := range s.connections {
-		if connector != nil && connector.GetConnect() != nil {
-			err := connector.GetConnect().Close()
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, connectors := range s.connections {
+		for _, connector := range connectors {
+			err := connector.Close()
 			if err != nil {
 				logger.All().WarnErr(err)
 			}
 		}
 	}
 
-	s.connections = make(map[string]*amqpConnector)
+	s.configs = make(map[string]*Config)
+	s.connections = make(map[string][]*amqpConnector)
 	s.consumers = make(map[string][]*Consumer)
 	s.assistants = make(map[string][]*Assistant)
 }
@@ -254,29 +555,16 @@ func (s *Service) OnShowReport() {
 // перекладывает сообщения из очереди в очередь
 func (s *Service) OnPublish(event *common.ApplicationEvent) {
 	group := new(sync.WaitGroup)
-	delta := 0
-	for uri, apps := range s.consumers {
-		var necessaryPublish bool
-		if len(event.GetStringArg("host")) > 0 {
-			parsedUri, err := url.Parse(uri)
-			if err == nil && parsedUri.Host == event.GetStringArg("host") {
-				necessaryPublish = true
-			} else {
-				necessaryPublish = false
-			}
-		} else {
-			necessaryPublish = true
-		}
-		if necessaryPublish {
-			for _, app := range apps {
-				delta += app.binding.Handlers
+	for _, config := range s.Configs {
+		if len(event.GetStringArg("host")) == 0 || config.hasHost(event.GetStringArg("host")) {
+			for _, app := range s.consumers[config.key()] {
+				group.Add(app.binding.Handlers)
 				for i := 0; i < app.binding.Handlers; i++ {
 					go app.consumeAndPublishMessages(event, group)
 				}
 			}
 		}
 	}
-	group.Add(delta)
 	group.Wait()
 	fmt.Println("done")
 	common.App.SendEvents(common.NewApplicationEvent(common.FinishApplicationEventKind))
@@ -284,7 +572,55 @@ func (s *Service) OnPublish(event *common.ApplicationEvent) {
 
 // получатель сообщений из очереди
 type Config struct {
-	URI        string              `yaml:"uri"`
+	URI string `yaml:"uri"`
+
+	// адреса узлов кластера, при потере соединения получатель подключается к следующему узлу
+	URIs []string `yaml:"uris"`
+
+	// распределять ли обработчики очередей по узлам кластера
+	Spread bool `yaml:"spread"`
+
 	Assistants []*AssistantBinding `yaml:"assistants"`
 	Bindings   []*Binding          `yaml:"bindings"`
+
+	// отпечаток настроек, по нему определяется, изменились ли настройки при переконфигурации
+	hash string
+}
+
+// снимает отпечатки настроек и связок, отпечатки снимаются до инициализации связок
+func (c *Config) fingerprint() {
+	c.hash = common.Fingerprint(c)
+	for _, binding := range c.Bindings {
+		binding.hash = common.Fingerprint(binding)
+	}
+}
+
+// отдает адреса узлов, адрес uri пробуется первым
+func (c *Config) uris() []string {
+	uris := make([]string, 0, len(c.URIs)+1)
+	if c.URI != "" {
+		uris = append(uris, c.URI)
+	}
+	for _, uri := range c.URIs {
+		if uri != c.URI {
+			uris = append(uris, uri)
+		}
+	}
+	return uris
+}
+
+// отдает ключ, по которому хранятся соединения и получатели
+func (c *Config) key() string {
+	return strings.Join(c.uris(), ",")
+}
+
+// сообщает, есть ли среди узлов узел с указанным хостом
+func (c *Config) hasHost(host string) bool {
+	for _, uri := range c.uris() {
+		parsedUri, err := url.Parse(uri)
+		if err == nil && parsedUri.Host == host {
+			return true
+		}
+	}
+	return false
 }
@@ -0,0 +1,34 @@
+package guardian
+
+import (
+	"fmt"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/Halfi/postmanq/common"
+)
+
+// OnCheck проверяет настройки блокировок
+func (s *Service) OnCheck(event *common.ApplicationEvent) []error {
+	service := new(Service)
+	if err := yaml.Unmarshal(event.Data, service); err != nil {
+		return []error{err}
+	}
+
+	errs := make([]error, 0)
+	if len(service.Configs) == 0 {
+		errs = append(errs, common.NewConfigError("postmans", "postmans should be defined"))
+	}
+	for name, config := range service.Configs {
+		if config == nil {
+			continue
+		}
+		for i, exclude := range config.Excludes {
+			if strings.TrimSpace(exclude) == common.EmptyStr {
+				errs = append(errs, common.NewConfigError(fmt.Sprintf("postmans.%s.exclude[%d]", name, i), "domain should be defined"))
+			}
+		}
+	}
+	return errs
+}
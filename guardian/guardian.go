@@ -20,7 +20,7 @@ func newGuardian(id int, s *Service) {
 
 // запускает прослушивание событий отправки писем
 func (g *Guardian) run() {
-	for event := range g.s.events {
+	for event := range g.s.events.Events() {
 		g.guard(event)
 	}
 }
@@ -1,6 +1,9 @@
 package guardian
 
 import (
+	"net/http"
+	"sync"
+
 	"gopkg.in/yaml.v3"
 
 	"github.com/Halfi/postmanq/common"
@@ -14,13 +17,17 @@ type Service struct {
 
 	Configs map[string]*Config `yaml:"postmans"`
 
-	events       chan *common.SendEvent
-	eventsClosed bool
+	events *common.EventChannel
+
+	// защищает настройки от замены во время переконфигурации
+	rwm sync.RWMutex
 }
 
 // Inst создает новый сервис блокировок
 func Inst() common.SendingService {
-	return new(Service)
+	service := new(Service)
+	common.RegisterAdminHandler(http.MethodGet, "/excludes", service.adminExcludes)
+	return service
 }
 
 // OnInit инициализирует сервис блокировок
@@ -37,8 +44,7 @@ func (s *Service) OnInit(event *common.ApplicationEvent) {
 		return
 	}
 
-	s.events = make(chan *common.SendEvent)
-	s.eventsClosed = false
+	s.events = common.NewEventChannel("guardian")
 
 	if s.GuardiansCount == 0 {
 		s.GuardiansCount = common.DefaultWorkersCount
@@ -52,25 +58,62 @@ func (s *Service) OnRun() {
 	}
 }
 
-// Event send event
-func (s *Service) Event(ev *common.SendEvent) bool {
-	if s.eventsClosed {
-		return false
+// OnReconfigure заменяет блокировки, не останавливая защитников
+// количество защитников меняется только после перезапуска приложения
+func (s *Service) OnReconfigure(event *common.ApplicationEvent) {
+	service := new(Service)
+	err := yaml.Unmarshal(event.Data, service)
+	if err != nil {
+		logger.All().ErrWithErr(err, "guardian service can't unmarshal config")
+		return
+	}
+
+	if len(service.Configs) == 0 {
+		logger.All().Err("guardians config is empty, current config is used")
+		return
 	}
 
-	s.events <- ev
-	return true
+	s.rwm.Lock()
+	defer s.rwm.Unlock()
+	s.Configs = service.Configs
+}
+
+// Event send event
+func (s *Service) Event(ev *common.SendEvent) bool {
+	return s.events.Send(ev)
 }
 
 // OnFinish завершает работу сервиса соединений
 func (s *Service) OnFinish() {
-	if !s.eventsClosed {
-		s.eventsClosed = true
-		close(s.events)
+	s.events.Close()
+}
+
+// отдает почтовые сервисы, на которые блокируется отправка писем, параметр postman выбирает один домен
+func (s *Service) adminExcludes(r *http.Request) (interface{}, error) {
+	s.rwm.RLock()
+	defer s.rwm.RUnlock()
+
+	excludes := make(map[string][]string, len(s.Configs))
+	for name, conf := range s.Configs {
+		excludes[name] = conf.Excludes
+		if excludes[name] == nil {
+			excludes[name] = common.EmptyStrSlice
+		}
+	}
+
+	if name := r.URL.Query().Get("postman"); name != common.EmptyStr {
+		postmanExcludes, ok := excludes[name]
+		if !ok {
+			return nil, common.NewAdminError(http.StatusNotFound, "postman %s isn't found", name)
+		}
+		return map[string][]string{name: postmanExcludes}, nil
 	}
+	return excludes, nil
 }
 
-func (s Service) getExcludes(hostname string) []string {
+func (s *Service) getExcludes(hostname string) []string {
+	s.rwm.RLock()
+	defer s.rwm.RUnlock()
 	if conf, ok := s.Configs[hostname]; ok {
 		return conf.Excludes
 	}
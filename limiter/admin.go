@@ -0,0 +1,106 @@
+package limiter
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/Halfi/postmanq/common"
+	"github.com/Halfi/postmanq/storage"
+)
+
+// ограничение в ответе api администрирования
+type limitInfo struct {
+	Scope
+	Value  int32  `json:"value"`
+	Period string `json:"period"`
+	Mode   Mode   `json:"mode"`
+	Window Window `json:"window"`
+
+	Counters []counterInfo `json:"counters"`
+}
+
+// счетчик ограничения в ответе api администрирования
+type counterInfo struct {
+	// значения параметров письма, отмеченных *
+	Key string `json:"key"`
+
+	// количество писем за текущий календарный период, скользящие окна не отдают количество писем
+	Sent *int64 `json:"sent,omitempty"`
+
+	// доля от заданной скорости отправки корзины токенов
+	Factor float64 `json:"factor,omitempty"`
+}
+
+// регистрирует обработчики api администрирования сервиса ограничений
+func (s *Service) registerAdminHandlers() {
+	common.RegisterAdminHandler(http.MethodGet, "/limits", s.adminLimits)
+}
+
+// отдает ограничения доменов и их счетчики, параметр postman выбирает один домен
+func (s *Service) adminLimits(r *http.Request) (interface{}, error) {
+	s.rwm.RLock()
+	configs := s.Configs
+	s.rwm.RUnlock()
+
+	if name := r.URL.Query().Get("postman"); name != common.EmptyStr {
+		conf, ok := configs[name]
+		if !ok {
+			return nil, common.NewAdminError(http.StatusNotFound, "postman %s isn't found", name)
+		}
+		configs = map[string]*Config{name: conf}
+	}
+
+	now := time.Now()
+	infos := make(map[string][]limitInfo, len(configs))
+	for name, conf := range configs {
+		limits := make([]limitInfo, 0, len(conf.limits))
+		for _, limit := range conf.limits {
+			limits = append(limits, limit.info(now))
+		}
+		infos[name] = limits
+	}
+	return infos, nil
+}
+
+// отдает описание ограничения и его счетчиков
+func (l *Limit) info(now time.Time) limitInfo {
+	info := limitInfo{
+		Scope:  l.Scope,
+		Value:  l.Value,
+		Period: l.duration.String(),
+		Mode:   l.Mode,
+		Window: l.Window,
+	}
+
+	l.mutex.Lock()
+	counters := make([]*counter, 0, len(l.counters))
+	keys := make(map[*counter]string, len(l.counters))
+	for key, c := range l.counters {
+		counters = append(counters, c)
+		keys[c] = key
+	}
+	l.mutex.Unlock()
+
+	info.Counters = make([]counterInfo, 0, len(counters))
+	for _, c := range counters {
+		counter := counterInfo{Key: keys[c]}
+		switch {
+		case c.bucket != nil:
+			c.bucket.mutex.Lock()
+			counter.Factor = c.bucket.factor
+			c.bucket.mutex.Unlock()
+		case l.Window == CalendarWindow:
+			window := l.windowStart(now)
+			if sent, err := storage.Inst().Get(c.key + ":" + strconv.FormatInt(window.Unix(), 10)); err == nil {
+				counter.Sent = &sent
+			}
+		}
+		info.Counters = append(info.Counters, counter)
+	}
+	sort.Slice(info.Counters, func(i, j int) bool {
+		return info.Counters[i].Key < info.Counters[j].Key
+	})
+	return info
+}
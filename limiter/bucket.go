@@ -0,0 +1,105 @@
+package limiter
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/Halfi/postmanq/storage"
+)
+
+const (
+	// вес последнего результата при подсчете доли отложенных писем
+	deferralWeight = 0.1
+
+	// доля отложенных писем, после которой скорость отправки снижается
+	deferralThreshold = 0.1
+
+	// минимальный промежуток времени между снижениями скорости
+	decreaseInterval = time.Second
+
+	// во сколько раз снижается скорость отправки
+	decreaseFactor = 0.5
+
+	// на сколько увеличивается скорость отправки после каждого успешно отправленного письма
+	increaseStep = 0.01
+
+	// минимальная доля от заданной скорости отправки
+	minFactor = 0.05
+)
+
+// корзина токенов, равномерно распределяет отправку писем по периоду ограничения
+// токены хранятся в хранилище счетчиков, чтобы ограничение было общим для нескольких экземпляров приложения,
+// скорость отправки адаптивного ограничения подстраивается каждым экземпляром отдельно
+type bucket struct {
+	// ключ корзины в хранилище
+	key string
+
+	// время появления одного токена
+	interval time.Duration
+
+	// максимальное количество токенов
+	burst int64
+
+	// доля от заданной скорости отправки, используется адаптивным ограничением
+	factor float64
+
+	// доля отложенных писем
+	deferrals float64
+
+	// дата последнего снижения скорости
+	decreased time.Time
+
+	mutex sync.Mutex
+}
+
+// создает корзину, заполненную токенами
+func newBucket(key string, value int32, duration time.Duration, burst int32) *bucket {
+	if burst <= 0 {
+		burst = 1
+	}
+	return &bucket{
+		key:      key,
+		interval: duration / time.Duration(value),
+		burst:    int64(burst),
+		factor:   1,
+	}
+}
+
+// забирает токен из корзины
+// если токенов нет, но токен появится не позже, чем через hold, резервирует его и возвращает время ожидания
+// если токен появится позже, возвращает время ожидания и false
+func (b *bucket) take(now time.Time, hold time.Duration) (time.Duration, bool) {
+	wait, ok, _ := storage.Inst().Take(b.key, now, b.currentInterval(), b.burst, hold)
+	return wait, ok
+}
+
+// возвращает токен в корзину
+func (b *bucket) put() {
+	_ = storage.Inst().Put(b.key, b.currentInterval())
+}
+
+// отдает время появления одного токена с учетом снижения скорости
+func (b *bucket) currentInterval() time.Duration {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return time.Duration(float64(b.interval) / b.factor)
+}
+
+// учитывает результат отправки письма
+// если доля отложенных писем растет, скорость отправки снижается, после успешных отправок медленно восстанавливается
+func (b *bucket) observe(now time.Time, deferred bool) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if deferred {
+		b.deferrals = b.deferrals*(1-deferralWeight) + deferralWeight
+		if b.deferrals > deferralThreshold && now.Sub(b.decreased) >= decreaseInterval {
+			b.factor = math.Max(minFactor, b.factor*decreaseFactor)
+			b.decreased = now
+		}
+	} else {
+		b.deferrals *= 1 - deferralWeight
+		b.factor = math.Min(1, b.factor+increaseStep)
+	}
+}
@@ -0,0 +1,83 @@
+package limiter
+
+import (
+	"fmt"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/Halfi/postmanq/common"
+)
+
+// OnCheck проверяет настройки ограничений
+func (s *Service) OnCheck(event *common.ApplicationEvent) []error {
+	service := new(Service)
+	if err := yaml.Unmarshal(event.Data, service); err != nil {
+		return []error{err}
+	}
+
+	errs := make([]error, 0)
+	if len(service.Configs) == 0 {
+		errs = append(errs, common.NewConfigError("postmans", "postmans should be defined"))
+	}
+	for i, limit := range service.ScopedLimits {
+		errs = append(errs, checkLimit(limit, common.AllDomains, fmt.Sprintf("scopedLimits[%d]", i))...)
+	}
+	for name, config := range service.Configs {
+		if config == nil {
+			continue
+		}
+		for host, limit := range config.Limits {
+			errs = append(errs, checkLimit(limit, name, fmt.Sprintf("postmans.%s.limits.%s", name, host))...)
+		}
+		for i, limit := range config.ScopedLimits {
+			errs = append(errs, checkLimit(limit, name, fmt.Sprintf("postmans.%s.scopedLimits[%d]", name, i))...)
+		}
+	}
+	return errs
+}
+
+// проверяет ограничение, описывая, что именно в нем настроено неправильно
+func checkLimit(limit *Limit, hostname, path string) []error {
+	errs := make([]error, 0)
+	if limit == nil {
+		return append(errs, common.NewConfigError(path, "limit should be defined"))
+	}
+
+	if limit.Period != common.EmptyStr {
+		if duration, err := parsePeriod(limit.Period); err != nil || duration <= 0 {
+			errs = append(errs, common.NewConfigError(path, "wrong period %q", limit.Period))
+		}
+	} else if _, ok := limitDurations[limit.Type]; !ok {
+		errs = append(errs, common.NewConfigError(path, "unknown type %q, should be one of %v or period should be defined", limit.Type, limitKinds))
+	}
+
+	if _, err := time.LoadLocation(limit.Timezone); err != nil {
+		errs = append(errs, common.NewConfigError(path, "unknown timezone %q", limit.Timezone))
+	}
+
+	switch limit.Mode {
+	case "", FixedMode:
+		if limit.Window != "" && limit.Window != CalendarWindow && limit.Window != SlidingWindow {
+			errs = append(errs, common.NewConfigError(path, "unknown window %q, should be %s or %s", limit.Window, CalendarWindow, SlidingWindow))
+		}
+	case BucketMode, AdaptiveMode:
+		if limit.Value <= 0 {
+			errs = append(errs, common.NewConfigError(path, "value should be positive for mode %s", limit.Mode))
+		}
+		if limit.Window != "" && limit.Window != CalendarWindow {
+			errs = append(errs, common.NewConfigError(path, "mode %s supports only %s window", limit.Mode, CalendarWindow))
+		}
+	default:
+		errs = append(errs, common.NewConfigError(path, "unknown mode %q, should be one of %s, %s or %s", limit.Mode, FixedMode, BucketMode, AdaptiveMode))
+	}
+
+	// на случай, если проверки выше разошлись с инициализацией
+	if len(errs) == 0 {
+		limit.init(hostname)
+		if !limit.isValid() {
+			errs = append(errs, common.NewConfigError(path, "wrong limit settings"))
+		}
+	}
+	return errs
+}
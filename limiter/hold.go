@@ -0,0 +1,98 @@
+package limiter
+
+import (
+	"sync"
+	"time"
+
+	"github.com/Halfi/postmanq/common"
+	"github.com/Halfi/postmanq/logger"
+)
+
+// задержанные письма, ожидающие появления токена в корзине
+// письмо ждет в таймере, а не в ограничителе, чтобы задержка писем одного почтового сервиса
+// не останавливала проверку писем других доменов и почтовых сервисов
+type holds struct {
+	pending map[*hold]struct{}
+
+	// признак остановки сервиса, после остановки письма не задерживаются
+	closed bool
+
+	mutex sync.Mutex
+}
+
+// задержанное письмо
+type hold struct {
+	event *common.SendEvent
+
+	// счетчики, в которых учтено письмо, и запись письма в журналах скользящих окон
+	counters []*counter
+	member   string
+
+	// время учета письма и время, до которого письмо задержано
+	takenAt time.Time
+	until   time.Time
+
+	timer *time.Timer
+}
+
+// создает список задержанных писем
+func newHolds() *holds {
+	return &holds{pending: make(map[*hold]struct{})}
+}
+
+// задерживает письмо и передает его следующему сервису по истечении задержки
+// если сервис уже остановлен, письмо сразу возвращается в отложенную очередь
+func (h *holds) add(event *common.SendEvent, counters []*counter, member string, now time.Time, duration time.Duration) {
+	held := &hold{event: event, counters: counters, member: member, takenAt: now, until: now.Add(duration)}
+
+	h.mutex.Lock()
+	if h.closed {
+		h.mutex.Unlock()
+		held.cancel(now)
+		return
+	}
+	h.pending[held] = struct{}{}
+	held.timer = time.AfterFunc(duration, func() {
+		h.release(held)
+	})
+	h.mutex.Unlock()
+}
+
+// передает письмо следующему сервису, если задержку не отменили
+func (h *holds) release(held *hold) {
+	h.mutex.Lock()
+	_, ok := h.pending[held]
+	delete(h.pending, held)
+	h.mutex.Unlock()
+
+	if ok {
+		held.event.Iterator.Next().(common.SendingService).Event(held.event)
+	}
+}
+
+// отменяет все задержки и запрещает новые, задержанные письма возвращаются в отложенные очереди
+func (h *holds) close() {
+	h.mutex.Lock()
+	pending := h.pending
+	h.pending = make(map[*hold]struct{})
+	h.closed = true
+	h.mutex.Unlock()
+
+	now := time.Now()
+	for held := range pending {
+		held.timer.Stop()
+		held.cancel(now)
+	}
+}
+
+// возвращает письмо в счетчики и отправляет его в отложенную очередь, из которой оно вернется после задержки
+func (held *hold) cancel(now time.Time) {
+	for _, c := range held.counters {
+		c.put(held.takenAt, held.member)
+	}
+
+	message := held.event.Message
+	logger.By(message.HostnameFrom).Debug("limiter service cancel hold of mail#%d", message.Id)
+	message.BindingType = bindingTypeByDuration(held.until.Sub(now))
+	held.event.Result <- common.OverlimitSendEventResult
+}
@@ -1,14 +1,24 @@
 package limiter
 
 import (
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/Halfi/postmanq/common"
+	"github.com/Halfi/postmanq/storage"
 )
 
 // тип ограничения
 type Kind string
 
+// Mode способ подсчета отправленных писем
+type Mode string
+
+// Window способ отсчета периода ограничения
+type Window string
+
 const (
 	SecondKind Kind = "second"
 	MinuteKind Kind = "minute"
@@ -16,7 +26,29 @@ const (
 	DayKind    Kind = "day"
 )
 
+const (
+	// FixedMode количество писем считается за период, по окончании периода счетчик обнуляется
+	FixedMode Mode = "fixed"
+
+	// BucketMode письма отправляются равномерно в течение периода
+	BucketMode Mode = "bucket"
+
+	// AdaptiveMode письма отправляются равномерно, скорость снижается, если почтовый сервис откладывает письма
+	AdaptiveMode Mode = "adaptive"
+)
+
+const (
+	// CalendarWindow периоды начинаются в начале секунды, минуты, часа, суток или недели в часовом поясе ограничения
+	CalendarWindow Window = "calendar"
+
+	// SlidingWindow учитываются письма, отправленные за период до текущего момента
+	SlidingWindow Window = "sliding"
+)
+
 var (
+	// типы ограничений, упорядоченные по промежутку времени
+	limitKinds = []Kind{SecondKind, MinuteKind, HourKind, DayKind}
+
 	// возможные промежутки времени для каждого ограничения
 	limitDurations = map[Kind]time.Duration{
 		SecondKind: time.Second,
@@ -33,40 +65,248 @@ var (
 	}
 )
 
+// Scope область действия ограничения
+// пустое значение - ограничение не зависит от параметра письма,
+// * - письма считаются отдельно для каждого значения параметра,
+// любое другое значение - ограничение действует только для писем с указанным значением параметра
+type Scope struct {
+	// Address ip, с которого отправляется письмо
+	Address string `yaml:"ip" json:"ip,omitempty"`
+
+	// Server реальное имя почтового сервиса получателя, например outlook.com
+	Server string `yaml:"mx" json:"mx,omitempty"`
+
+	// Sender отправитель письма
+	Sender string `yaml:"sender" json:"sender,omitempty"`
+
+	// Recipient домен получателя
+	Recipient string `yaml:"recipient" json:"recipient,omitempty"`
+}
+
+// отдает ключ счетчика для параметров письма
+// если ограничение не действует для письма, вернется false
+func (s Scope) key(values Scope) (string, bool) {
+	scopes := []string{s.Address, s.Server, s.Sender, s.Recipient}
+	current := []string{values.Address, values.Server, values.Sender, values.Recipient}
+	parts := make([]string, len(scopes))
+	for i, scope := range scopes {
+		switch {
+		case scope == common.EmptyStr:
+		case current[i] == common.EmptyStr:
+			return common.EmptyStr, false
+		case scope == common.AllDomains:
+			parts[i] = strings.ToLower(current[i])
+		case !strings.EqualFold(scope, current[i]):
+			return common.EmptyStr, false
+		}
+	}
+	return strings.Join(parts, "|"), true
+}
+
 // ограничение
 type Limit struct {
+	// область действия ограничения
+	Scope `yaml:",inline"`
+
 	// максимально допустимое количество писем
 	Value int32 `json:"value"`
 
 	// тип ограничения
 	Type Kind `json:"type"`
 
-	// текущее количество писем
-	currentValue int32
+	// промежуток времени, за который учитываются письма, например 15m, 7d или 1d12h, используется вместо type
+	Period string `json:"period"`
+
+	// способ отсчета периода, по умолчанию calendar, используется только способом подсчета fixed
+	Window Window `json:"window"`
+
+	// часовой пояс, в котором отсчитываются календарные периоды, например Europe/Moscow, по умолчанию UTC
+	Timezone string `json:"timezone"`
+
+	// способ подсчета отправленных писем, по умолчанию fixed
+	Mode Mode `json:"mode"`
+
+	// количество писем, которое может быть отправлено без задержки, используется корзиной токенов
+	Burst int32 `json:"burst"`
+
+	// максимальное время, на которое письмо задерживается в ограничителе, вместо отправки в отложенную очередь
+	Hold time.Duration `json:"hold"`
+
+	// идентификатор ограничения, одинаковый у всех экземпляров приложения с одинаковыми настройками
+	id string
 
 	// промежуток времени, за который проверяется количество отправленных писем
 	duration time.Duration
 
-	// дата последнего обнуления количества отправленных писем
-	modifyDate time.Time
+	// часовой пояс календарных периодов
+	location *time.Location
 
 	// тип очереди, в которую необходимо положить письмо, если превышено количество отправленных писем
 	bindingType common.DelayedBindingType
+
+	// счетчики писем, в качестве ключа используются значения параметров письма, отмеченных *
+	counters map[string]*counter
+	mutex    sync.Mutex
+
+	// время последнего удаления неиспользуемых счетчиков
+	evicted time.Time
 }
 
 // инициализирует значения по умолчанию
-func (l *Limit) init() {
+func (l *Limit) init(hostname string) {
 	if duration, ok := limitDurations[l.Type]; ok {
 		l.duration = duration
 	}
 	if bindingType, ok := limitBindingTypes[l.Type]; ok {
 		l.bindingType = bindingType
 	}
+	if l.Period != "" {
+		l.duration, _ = parsePeriod(l.Period)
+		l.bindingType = bindingTypeByDuration(l.duration)
+	}
+	if l.Mode == "" {
+		l.Mode = FixedMode
+	}
+	if l.Window == "" {
+		l.Window = CalendarWindow
+	}
+	l.location, _ = time.LoadLocation(l.Timezone)
+	l.counters = make(map[string]*counter)
+	l.id = strings.Join([]string{
+		hostname, string(l.Type), l.Period, string(l.Window), l.Timezone, string(l.Mode),
+		l.Address, l.Server, l.Sender, l.Recipient,
+	}, "|")
 }
 
-// сигнализирует о том, что надо ли обнулять текущее количество отправленных писем
-// если вернулось true, текущее количество отправленных писем не обнуляется
-// если вернулось false, текущее количество отправленных писем обнуляется
-func (l *Limit) isValidDuration(now time.Time) bool {
-	return now.Sub(l.modifyDate) <= l.duration
+// сигнализирует, что ограничение настроено правильно
+func (l *Limit) isValid() bool {
+	if l.duration <= 0 || l.location == nil {
+		return false
+	}
+
+	switch l.Mode {
+	case FixedMode:
+		return l.Window == CalendarWindow || l.Window == SlidingWindow
+	case BucketMode, AdaptiveMode:
+		return l.Value > 0 && l.Window == CalendarWindow
+	default:
+		return false
+	}
+}
+
+// отдает начало календарного периода, в который попадает now
+// периоды отсчитываются от полуночи в часовом поясе ограничения, недельные периоды начинаются с понедельника
+func (l *Limit) windowStart(now time.Time) time.Time {
+	_, offset := now.In(l.location).Zone()
+	shift := time.Duration(offset) * time.Second
+	// время округляется от 1 января 1 года, это понедельник
+	return now.Add(shift).Truncate(l.duration).Add(-shift)
+}
+
+// отдает счетчик по ключу, создает счетчик, если его еще нет
+func (l *Limit) counter(key string) *counter {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	now := time.Now()
+	c, ok := l.counters[key]
+	if !ok {
+		l.evict(now)
+		c = &counter{limit: l, key: "limit:" + l.id + ":" + key}
+		if l.Mode != FixedMode {
+			c.bucket = newBucket(c.key, l.Value, l.duration, l.Burst)
+		}
+		l.counters[key] = c
+	}
+	c.used = now
+	return c
+}
+
+// удаляет счетчики, которые не использовались дольше периода ограничения, не чаще раза в период
+// у ограничений с * счетчик создается для каждого значения параметра письма, например для каждого отправителя,
+// период счетчика уже закончился, поэтому значения в хранилище истекли, а корзина токенов заполнилась
+func (l *Limit) evict(now time.Time) {
+	if now.Sub(l.evicted) < l.duration {
+		return
+	}
+	l.evicted = now
+	for key, c := range l.counters {
+		if now.Sub(c.used) > l.duration {
+			delete(l.counters, key)
+		}
+	}
+}
+
+// счетчик писем ограничения
+// значения счетчиков хранятся в хранилище счетчиков, чтобы ограничение было общим для нескольких экземпляров приложения
+type counter struct {
+	limit *Limit
+
+	// ключ счетчика в хранилище
+	key string
+
+	// корзина токенов
+	bucket *bucket
+
+	// время последнего обращения к счетчику
+	used time.Time
+}
+
+// прибавляет письма к счетчику за календарный период, в который попадает now, и отдает количество писем за период
+func (c *counter) add(now time.Time, delta int64) int64 {
+	window := c.limit.windowStart(now)
+	value, _ := storage.Inst().Add(c.key+":"+strconv.FormatInt(window.Unix(), 10), delta, c.limit.duration)
+	return value
+}
+
+// добавляет письмо в скользящее окно, если за период до now отправлено меньше писем, чем разрешено
+// если ограничение превышено, отдает время, через которое можно будет отправить письмо
+func (c *counter) push(now time.Time, member string) (time.Duration, bool) {
+	wait, ok, _ := storage.Inst().Push(c.key, member, now, c.limit.duration, int64(c.limit.Value))
+	return wait, ok
+}
+
+// возвращает письмо в счетчик, если письмо не было отправлено из-за другого ограничения
+func (c *counter) put(now time.Time, member string) {
+	switch {
+	case c.bucket != nil:
+		c.bucket.put()
+	case c.limit.Window == SlidingWindow:
+		_ = storage.Inst().Remove(c.key, member)
+	default:
+		c.add(now, -1)
+	}
+}
+
+// разбирает промежуток времени, кроме единиц time.ParseDuration поддерживаются сутки, например 7d или 1d12h
+func parsePeriod(period string) (time.Duration, error) {
+	var days int64
+	if i := strings.Index(period, "d"); i > 0 {
+		var err error
+		days, err = strconv.ParseInt(period[:i], 10, 64)
+		if err != nil {
+			return 0, err
+		}
+		period = period[i+1:]
+	}
+
+	duration := time.Duration(days) * 24 * time.Hour
+	if period != "" {
+		rest, err := time.ParseDuration(period)
+		if err != nil {
+			return 0, err
+		}
+		duration += rest
+	}
+	return duration, nil
+}
+
+// отдает тип очереди, письма из которой вернутся не раньше, чем через указанное время
+func bindingTypeByDuration(duration time.Duration) common.DelayedBindingType {
+	for _, kind := range limitKinds {
+		if limitDurations[kind] >= duration {
+			return limitBindingTypes[kind]
+		}
+	}
+	return common.DayDelayedBinding
 }
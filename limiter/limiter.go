@@ -1,12 +1,33 @@
 package limiter
 
 import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
 	"sync/atomic"
+	"time"
 
 	"github.com/Halfi/postmanq/common"
 	"github.com/Halfi/postmanq/logger"
 )
 
+var (
+	// случайный идентификатор экземпляра приложения, pid в контейнерах у всех экземпляров одинаковый
+	instanceId = newInstanceId()
+
+	// номер учета письма в журналах скользящих окон экземпляра
+	memberSeq uint64
+)
+
+// создает случайный идентификатор экземпляра приложения
+func newInstanceId() string {
+	data := make([]byte, 8)
+	if _, err := rand.Read(data); err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(data)
+}
+
 // Limiter ограничитель, проверяет количество отправленных писем почтовому сервису
 type Limiter struct {
 	// идентификатор для логов
@@ -21,7 +42,7 @@ func newLimiter(id int, service *Service) {
 
 // запускает ограничителя
 func (l *Limiter) run() {
-	for event := range l.service.events {
+	for event := range l.service.events.Events() {
 		l.check(event)
 	}
 }
@@ -30,31 +51,111 @@ func (l *Limiter) run() {
 // если количество превышено, отправляет письмо в отложенную очередь
 func (l *Limiter) check(event *common.SendEvent) {
 	logger.By(event.Message.HostnameFrom).Info("limiter#%d-%d check limit for mail", l.id, event.Message.Id)
-	limit := l.service.getLimit(event.Message.HostnameFrom, event.Message.HostnameTo)
-	// пытаемся найти ограничения для почтового сервиса
-	if limit == nil {
+	// пытаемся найти ограничения для письма
+	counters := l.service.getCounters(event, true)
+	if len(counters) == 0 {
 		logger.By(event.Message.HostnameFrom).Debug("limiter#%d-%d not found limit for %s", l.id, event.Message.Id, event.Message.HostnameTo)
 	} else {
-		logger.By(event.Message.HostnameFrom).Debug("limiter#%d-%d found limit for %s", l.id, event.Message.Id, event.Message.HostnameTo)
-		// если оно нашлось, проверяем, что отправка нового письма происходит в тот промежуток времени,
-		// в который нам необходимо следить за ограничениями
-		if limit.isValidDuration(event.Message.CreatedDate) {
-			atomic.AddInt32(&limit.currentValue, 1)
-			currentValue := atomic.LoadInt32(&limit.currentValue)
-			logger.By(event.Message.HostnameFrom).Debug("limiter#%d-%d detect current value %d, const value %d", l.id, event.Message.Id, currentValue, limit.Value)
-			// если ограничение превышено
-			if currentValue > limit.Value {
-				logger.By(event.Message.HostnameFrom).Debug("limiter#%d-%d current value is exceeded for %s", l.id, event.Message.Id, event.Message.HostnameTo)
-				// определяем очередь, в которое переложем письмо
-				event.Message.BindingType = limit.bindingType
-				// говорим получателю, что у нас превышение ограничения,
-				// разблокируем поток получателя
-				event.Result <- common.OverlimitSendEventResult
-				return
-			}
-		} else {
-			logger.By(event.Message.HostnameFrom).Debug("limiter#%d-%d duration great then %v", l.id, event.Message.Id, limit.duration)
+		logger.By(event.Message.HostnameFrom).Debug("limiter#%d-%d found %d limits for %s", l.id, event.Message.Id, len(counters), event.Message.HostnameTo)
+		allowed, held := l.take(event, counters)
+		if !allowed {
+			// говорим получателю, что у нас превышение ограничения,
+			// разблокируем поток получателя
+			event.Result <- common.OverlimitSendEventResult
+			return
+		}
+		// задержанное письмо будет передано следующему сервису по истечении задержки
+		if held {
+			return
 		}
 	}
 	event.Iterator.Next().(common.SendingService).Event(event)
 }
+
+// учитывает письмо во всех подходящих ограничениях
+// письмо отправляется, только если не превышено ни одно ограничение,
+// иначе письмо возвращается в уже учтенные счетчики
+// если токен корзины появится скоро, письмо задерживается до его появления, тогда второе значение равно true
+func (l *Limiter) take(event *common.SendEvent, counters []*counter) (bool, bool) {
+	now := time.Now()
+	// запись письма в журналах скользящих окон, идентификатор экземпляра отличает записи разных экземпляров,
+	// а номер учета - записи одного экземпляра, идентификатор письма оставлен для удобства отладки
+	member := fmt.Sprintf("%s:%d:%d", instanceId, atomic.AddUint64(&memberSeq, 1), event.Message.Id)
+	taken := make([]*counter, 0, len(counters))
+	var hold time.Duration
+	for _, c := range counters {
+		var allowed bool
+		switch {
+		case c.bucket != nil:
+			var wait time.Duration
+			wait, allowed = l.checkBucket(event, c, now)
+			if allowed {
+				taken = append(taken, c)
+				if wait > hold {
+					hold = wait
+				}
+			}
+		case c.limit.Window == SlidingWindow:
+			allowed = l.checkSliding(event, c, now, member)
+			if allowed {
+				taken = append(taken, c)
+			}
+		default:
+			allowed = l.checkFixed(event, c, now)
+			taken = append(taken, c)
+		}
+
+		if !allowed {
+			rejectedMessages.WithLabelValues(event.Message.HostnameFrom, string(c.limit.Mode)).Inc()
+			for _, t := range taken {
+				t.put(now, member)
+			}
+			return false, false
+		}
+	}
+
+	if hold > 0 {
+		logger.By(event.Message.HostnameFrom).Debug("limiter#%d-%d hold mail for %v", l.id, event.Message.Id, hold)
+		l.service.holds.add(event, taken, member, now, hold)
+		return true, true
+	}
+	return true, false
+}
+
+// проверяет количество отправленных писем за период
+func (l *Limiter) checkFixed(event *common.SendEvent, c *counter, now time.Time) bool {
+	currentValue := c.add(now, 1)
+	logger.By(event.Message.HostnameFrom).Debug("limiter#%d-%d detect current value %d, const value %d", l.id, event.Message.Id, currentValue, c.limit.Value)
+	// если ограничение превышено
+	if currentValue > int64(c.limit.Value) {
+		logger.By(event.Message.HostnameFrom).Debug("limiter#%d-%d current value is exceeded for %s", l.id, event.Message.Id, event.Message.HostnameTo)
+		// определяем очередь, в которое переложем письмо
+		event.Message.BindingType = c.limit.bindingType
+		return false
+	}
+	return true
+}
+
+// проверяет количество писем, отправленных за период до текущего момента
+func (l *Limiter) checkSliding(event *common.SendEvent, c *counter, now time.Time, member string) bool {
+	wait, ok := c.push(now, member)
+	if !ok {
+		logger.By(event.Message.HostnameFrom).Debug("limiter#%d-%d sliding window is exceeded for %s, next mail in %v", l.id, event.Message.Id, event.Message.HostnameTo, wait)
+		event.Message.BindingType = bindingTypeByDuration(wait)
+		return false
+	}
+	return true
+}
+
+// забирает токен из корзины
+// если токен скоро появится, отдает время, на которое необходимо задержать письмо,
+// иначе отправляет письмо в отложенную очередь, письма из которой вернутся, когда токен уже появится
+func (l *Limiter) checkBucket(event *common.SendEvent, c *counter, now time.Time) (time.Duration, bool) {
+	wait, ok := c.bucket.take(now, c.limit.Hold)
+	if !ok {
+		logger.By(event.Message.HostnameFrom).Debug("limiter#%d-%d bucket is empty for %s, next token in %v", l.id, event.Message.Id, event.Message.HostnameTo, wait)
+		event.Message.BindingType = bindingTypeByDuration(wait)
+		return 0, false
+	}
+	return wait, true
+}
@@ -0,0 +1,16 @@
+package limiter
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	// количество писем, отправленных в отложенную очередь из-за превышения ограничения
+	rejectedMessages = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "postmanq",
+		Subsystem: "limiter",
+		Name:      "rejections_total",
+		Help:      "Mails delayed by limiter by postman and limit mode.",
+	}, []string{"postman", "mode"})
+)
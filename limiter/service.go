@@ -1,9 +1,13 @@
 package limiter
 
 import (
+	"sync"
+	"time"
+
 	"gopkg.in/yaml.v3"
 
 	"github.com/Halfi/postmanq/common"
+	"github.com/Halfi/postmanq/connector"
 	"github.com/Halfi/postmanq/logger"
 )
 
@@ -12,16 +16,29 @@ type Service struct {
 	// LimitersCount количество горутин проверяющих количество отправленных писем
 	LimitersCount int `yaml:"workers"`
 
+	// ScopedLimits ограничения для всех доменов, с которых рассылаются письма
+	ScopedLimits []*Limit `yaml:"scopedLimits"`
+
 	Configs map[string]*Config `yaml:"postmans"`
 
-	cleaner      *Cleaner
-	events       chan *common.SendEvent
-	eventsClosed bool
+	events *common.EventChannel
+
+	// письма, задержанные до появления токена в корзине
+	holds *holds
+
+	// отпечатки настроек доменов и общих ограничений, по ним определяется, какие ограничения изменились
+	fingerprints      map[string]string
+	scopedFingerprint string
+
+	// защищает ограничения от замены во время переконфигурации
+	rwm sync.RWMutex
 }
 
 // Inst создает сервис ограничений
 func Inst() common.SendingService {
-	return &Service{}
+	service := &Service{}
+	service.registerAdminHandlers()
+	return service
 }
 
 // OnInit инициализирует сервис
@@ -38,11 +55,11 @@ func (s *Service) OnInit(event *common.ApplicationEvent) {
 		return
 	}
 
-	s.events = make(chan *common.SendEvent)
-	s.eventsClosed = false
-
-	s.cleaner = newCleaner(s)
+	s.events = common.NewEventChannel("limiter")
+	s.holds = newHolds()
 
+	s.fingerprint()
+	s.ScopedLimits = s.initScoped(s.ScopedLimits, common.AllDomains)
 	for name, config := range s.Configs {
 		s.init(config, name)
 	}
@@ -53,59 +70,198 @@ func (s *Service) OnInit(event *common.ApplicationEvent) {
 }
 
 func (s *Service) init(conf *Config, hostname string) {
+	conf.limits = make([]*Limit, 0, len(conf.Limits)+len(conf.ScopedLimits)+len(s.ScopedLimits))
 	// инициализируем ограничения
 	for host, limit := range conf.Limits {
-		if limit.duration == 0 {
+		limit.Scope = Scope{Recipient: host}
+		limit.init(hostname)
+		if !limit.isValid() {
 			delete(conf.Limits, host)
-			logger.By(hostname).Warn("wrong limits settings")
+			logger.By(hostname).Warn("wrong limits settings for %s", host)
+			continue
+		}
+		conf.limits = append(conf.limits, limit)
+		logger.By(hostname).Debug("create limit for %s with type %v, mode %s and duration %v", host, limit.bindingType, limit.Mode, limit.duration)
+	}
+	conf.ScopedLimits = s.initScoped(conf.ScopedLimits, hostname)
+	conf.limits = append(conf.limits, conf.ScopedLimits...)
+	conf.limits = append(conf.limits, s.ScopedLimits...)
+
+	for _, limit := range conf.limits {
+		conf.byAddress = conf.byAddress || limit.Address != common.EmptyStr
+		conf.byServer = conf.byServer || limit.Server != common.EmptyStr
+	}
+}
+
+// снимает отпечатки настроек, отпечатки снимаются до инициализации ограничений
+func (s *Service) fingerprint() {
+	s.scopedFingerprint = common.Fingerprint(s.ScopedLimits)
+	s.fingerprints = make(map[string]string, len(s.Configs))
+	for name, config := range s.Configs {
+		s.fingerprints[name] = common.Fingerprint(config)
+	}
+}
+
+// инициализирует ограничения по параметрам письма, неправильно настроенные ограничения пропускаются
+func (s *Service) initScoped(limits []*Limit, hostname string) []*Limit {
+	valid := make([]*Limit, 0, len(limits))
+	for _, limit := range limits {
+		limit.init(hostname)
+		if !limit.isValid() {
+			logger.By(hostname).Warn("wrong scoped limits settings %+v", limit.Scope)
+			continue
 		}
-		limit.init()
-		logger.By(hostname).Debug("create limit for %s with type %v and duration %v", host, limit.bindingType, limit.duration)
+		valid = append(valid, limit)
+		logger.By(hostname).Debug("create limit for %+v with type %v, mode %s and duration %v", limit.Scope, limit.bindingType, limit.Mode, limit.duration)
 	}
+	return valid
 }
 
-// OnRun запускает проверку ограничений и очистку значений лимитов
+// OnRun запускает проверку ограничений
 func (s *Service) OnRun() {
-	// сразу запускаем проверку значений ограничений
-	go s.cleaner.run()
 	for i := 0; i < s.LimitersCount; i++ {
 		go newLimiter(i+1, s)
 	}
 }
 
-// Event send event
-func (s *Service) Event(ev *common.SendEvent) bool {
-	if s.eventsClosed {
-		return false
+// OnReconfigure применяет новые ограничения, не останавливая ограничителей
+// ограничения доменов, настройки которых не изменились, сохраняют счетчики,
+// если изменились общие ограничения, заново создаются ограничения всех доменов
+// количество ограничителей меняется только после перезапуска приложения
+func (s *Service) OnReconfigure(event *common.ApplicationEvent) {
+	service := new(Service)
+	err := yaml.Unmarshal(event.Data, service)
+	if err != nil {
+		logger.All().ErrWithErr(err, "limiter service can't unmarshal config")
+		return
+	}
+
+	if len(service.Configs) == 0 {
+		logger.All().Err("limiter config is empty, current config is used")
+		return
 	}
 
-	s.events <- ev
-	return true
+	service.fingerprint()
+
+	s.rwm.RLock()
+	configs, fingerprints, scopedFingerprint, scopedLimits := s.Configs, s.fingerprints, s.scopedFingerprint, s.ScopedLimits
+	s.rwm.RUnlock()
+
+	scopedChanged := service.scopedFingerprint != scopedFingerprint
+	if scopedChanged {
+		logger.All().Debug("limiter service apply new scoped limits")
+		service.ScopedLimits = service.initScoped(service.ScopedLimits, common.AllDomains)
+	} else {
+		service.ScopedLimits = scopedLimits
+	}
+
+	for name, config := range service.Configs {
+		if conf, ok := configs[name]; ok && !scopedChanged && fingerprints[name] == service.fingerprints[name] {
+			service.Configs[name] = conf
+			continue
+		}
+		logger.By(name).Debug("limiter service apply new limits")
+		service.init(config, name)
+	}
+	for name := range configs {
+		if _, ok := service.Configs[name]; !ok {
+			logger.By(name).Debug("limiter service remove limits")
+		}
+	}
+
+	s.rwm.Lock()
+	defer s.rwm.Unlock()
+	s.Configs = service.Configs
+	s.ScopedLimits = service.ScopedLimits
+	s.fingerprints = service.fingerprints
+	s.scopedFingerprint = service.scopedFingerprint
+}
+
+// Event send event
+func (s *Service) Event(ev *common.SendEvent) bool {
+	return s.events.Send(ev)
 }
 
 // OnFinish завершает работу сервиса соединений
+// задержанные письма возвращаются в отложенные очереди, чтобы не ждать их при остановке
 func (s *Service) OnFinish() {
-	if !s.eventsClosed {
-		s.eventsClosed = true
-		close(s.events)
-		s.cleaner.stop()
-		s.cleaner = nil
-	}
+	s.holds.close()
+	s.events.Close()
 }
 
-func (s *Service) getLimit(hostnameFrom, hostnameTo string) *Limit {
-	if config, ok := s.Configs[hostnameFrom]; ok {
-		if limit, has := config.Limits[hostnameTo]; has {
-			return limit
-		} else {
-			return nil
+// OnResult учитывает результат отправки письма в адаптивных ограничениях
+// письмо считается отложенным, если его необходимо отправить позже или почтовый сервис ответил 4XX
+func (s *Service) OnResult(ev *common.SendEvent, result common.SendEventResult) {
+	if ev.Message == nil {
+		return
+	}
+
+	for _, c := range s.getCounters(ev, false) {
+		if c.limit.Mode != AdaptiveMode {
+			continue
 		}
-	} else {
+
+		switch result {
+		case common.SuccessSendEventResult:
+			c.bucket.observe(time.Now(), false)
+		case common.DelaySendEventResult:
+			c.bucket.observe(time.Now(), true)
+		case common.ErrorSendEventResult:
+			if ev.Message.Error != nil && ev.Message.Error.Code >= 400 && ev.Message.Error.Code < 500 {
+				c.bucket.observe(time.Now(), true)
+			}
+		}
+	}
+}
+
+// отдает счетчики всех ограничений, действующих для письма
+// если ограничения учитывают ip, а ip письма еще не выбран, и selectAddress равен true, выбирает ip для письма
+func (s *Service) getCounters(ev *common.SendEvent, selectAddress bool) []*counter {
+	s.rwm.RLock()
+	conf, ok := s.Configs[ev.Message.HostnameFrom]
+	s.rwm.RUnlock()
+	if !ok || len(conf.limits) == 0 {
 		return nil
 	}
+
+	values := Scope{
+		Sender:    ev.Message.Envelope,
+		Recipient: ev.Message.HostnameTo,
+	}
+	if conf.byAddress {
+		if ev.Address == common.EmptyStr && selectAddress {
+			if address, ok := connector.SourceAddress(ev); ok {
+				ev.Address = address
+			}
+		}
+		values.Address = ev.Address
+	}
+	if conf.byServer {
+		values.Server = connector.ServerName(ev.Message.HostnameFrom, ev.Message.HostnameTo)
+	}
+
+	counters := make([]*counter, 0, len(conf.limits))
+	for _, limit := range conf.limits {
+		if key, ok := limit.key(values); ok {
+			counters = append(counters, limit.counter(key))
+		}
+	}
+	return counters
 }
 
 type Config struct {
 	// ограничения для почтовых сервисов, в качестве ключа используется домен
 	Limits map[string]*Limit `yaml:"limits"`
+
+	// ScopedLimits ограничения по ip, почтовому сервису, отправителю и домену получателя
+	ScopedLimits []*Limit `yaml:"scopedLimits"`
+
+	// все ограничения домена, включая общие
+	limits []*Limit
+
+	// учитывают ли ограничения ip
+	byAddress bool
+
+	// учитывают ли ограничения почтовый сервис
+	byServer bool
 }
@@ -0,0 +1,47 @@
+package logger
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/rs/zerolog"
+	"gopkg.in/yaml.v3"
+
+	"github.com/Halfi/postmanq/common"
+)
+
+// OnCheck проверяет уровни и выводы логов
+func (s *Service) OnCheck(event *common.ApplicationEvent) []error {
+	service := new(Service)
+	if err := yaml.Unmarshal(event.Data, service); err != nil {
+		return []error{err}
+	}
+
+	errs := service.Config.check(common.EmptyStr)
+	if len(service.Configs) == 0 {
+		errs = append(errs, common.NewConfigError("postmans", "postmans should be defined"))
+	}
+	for domain, cfg := range service.Configs {
+		if cfg != nil {
+			errs = append(errs, cfg.check(fmt.Sprintf("postmans.%s.", domain))...)
+		}
+	}
+	return errs
+}
+
+// проверяет уровень и вывод логов, prefix - путь к настройкам
+func (c *Config) check(prefix string) []error {
+	errs := make([]error, 0)
+	if c.LevelName != common.EmptyStr {
+		if _, err := zerolog.ParseLevel(c.LevelName); err != nil {
+			errs = append(errs, common.NewConfigError(prefix+"logLevel", "unknown level %q", c.LevelName))
+		}
+	}
+	if c.Output != common.EmptyStr && c.Output != "stdout" {
+		if info, err := os.Stat(filepath.Dir(c.Output)); err != nil || !info.IsDir() {
+			errs = append(errs, common.NewConfigError(prefix+"logOutput", "directory of %s doesn't exist", c.Output))
+		}
+	}
+	return errs
+}
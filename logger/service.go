@@ -23,7 +23,7 @@ type Config struct {
 }
 
 type Service struct {
-	Config
+	Config `yaml:",inline"`
 
 	Configs map[string]*Config `yaml:"postmans"`
 }
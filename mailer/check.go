@@ -0,0 +1,140 @@
+package mailer
+
+import (
+	"context"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/Halfi/postmanq/common"
+)
+
+// время ожидания ответа dns при проверке dkim записи
+const dkimLookupTimeout = 10 * time.Second
+
+// Resolver ищет txt записи, используется для проверки dkim записей доменов
+type Resolver interface {
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+}
+
+// DkimResolver ищет dkim записи при проверке настроек, если равен nil, dkim записи не проверяются
+var DkimResolver Resolver = net.DefaultResolver
+
+// OnCheck проверяет закрытые ключи доменов и их соответствие открытым ключам в dkim записях
+func (s *Service) OnCheck(event *common.ApplicationEvent) []error {
+	service := new(Service)
+	if err := yaml.Unmarshal(event.Data, service); err != nil {
+		return []error{err}
+	}
+
+	errs := make([]error, 0)
+	if len(service.Configs) == 0 {
+		errs = append(errs, common.NewConfigError("postmans", "postmans should be defined"))
+	}
+	for name, config := range service.Configs {
+		if config == nil {
+			continue
+		}
+
+		path := fmt.Sprintf("postmans.%s", name)
+		privateKey, err := readPrivateKey(config.PrivateKeyFilename)
+		if err != nil {
+			errs = append(errs, common.NewConfigError(path+".privateKey", "%v", err))
+			continue
+		}
+
+		// при перечитывании настроек dkim записи не проверяются, чтобы не задерживать применение настроек запросами к dns
+		if DkimResolver != nil && !event.IsOfflineCheck() {
+			if err := checkDkimRecord(DkimResolver, name, config.selector(), privateKey); err != nil {
+				errs = append(errs, common.NewConfigError(path+".dkimSelector", "%v", err))
+			}
+		}
+	}
+	return errs
+}
+
+// читает закрытый ключ в формате PKCS1, ключ задается путем до файла или в формате PEM
+func readPrivateKey(value string) (*rsa.PrivateKey, error) {
+	if value == common.EmptyStr {
+		return nil, errors.New("private key should be defined")
+	}
+
+	filename := common.PEMSource(value)
+	data, err := common.ReadPEM(value)
+	if err != nil {
+		return nil, fmt.Errorf("can't read private key %s: %w", filename, err)
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("private key %s isn't pem encoded", filename)
+	}
+
+	privateKey, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("can't parse private key %s: %w", filename, err)
+	}
+	return privateKey, nil
+}
+
+// проверяет, что dkim запись домена содержит открытый ключ закрытого ключа
+func checkDkimRecord(resolver Resolver, hostname, selector string, privateKey *rsa.PrivateKey) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dkimLookupTimeout)
+	defer cancel()
+
+	name := fmt.Sprintf("%s._domainkey.%s", selector, hostname)
+	records, err := resolver.LookupTXT(ctx, name)
+	if err != nil {
+		return fmt.Errorf("can't lookup dkim record %s: %w", name, err)
+	}
+
+	found := false
+	for _, record := range records {
+		publicKey, ok := parseDkimPublicKey(record)
+		if !ok {
+			continue
+		}
+		if publicKey.N.Cmp(privateKey.N) == 0 && publicKey.E == privateKey.E {
+			return nil
+		}
+		found = true
+	}
+	if found {
+		return fmt.Errorf("dkim record %s doesn't match private key", name)
+	}
+	return fmt.Errorf("dkim record %s doesn't contain public key", name)
+}
+
+// достает открытый ключ из тега p dkim записи
+func parseDkimPublicKey(record string) (*rsa.PublicKey, bool) {
+	for _, tag := range strings.Split(record, ";") {
+		parts := strings.SplitN(strings.TrimSpace(tag), "=", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) != "p" {
+			continue
+		}
+
+		// длинные ключи публикуются несколькими строками, dns может вернуть их с пробелами
+		data, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(parts[1]), ""))
+		if err != nil {
+			return nil, false
+		}
+
+		if publicKey, err := x509.ParsePKIXPublicKey(data); err == nil {
+			rsaPublicKey, ok := publicKey.(*rsa.PublicKey)
+			return rsaPublicKey, ok
+		}
+		if rsaPublicKey, err := x509.ParsePKCS1PublicKey(data); err == nil {
+			return rsaPublicKey, true
+		}
+		return nil, false
+	}
+	return nil, false
+}
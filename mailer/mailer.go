@@ -2,10 +2,13 @@ package mailer
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"io"
+	"net/textproto"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/emersion/go-msgauth/dkim"
 
@@ -29,7 +32,7 @@ func newMailer(id int, service *Service) {
 
 // запускает отправителя
 func (m *Mailer) run() {
-	for event := range m.service.events {
+	for event := range m.service.events.Events() {
 		m.sendMail(event)
 	}
 }
@@ -41,6 +44,7 @@ func (m *Mailer) sendMail(event *common.SendEvent) {
 		m.prepare(message)
 		m.send(event)
 	} else {
+		m.release(event, nil)
 		ReturnMail(event, fmt.Errorf("511 service#%d can't send mail#%d, envelope or ricipient is invalid", m.id, message.Id))
 	}
 }
@@ -79,13 +83,22 @@ func (m *Mailer) send(event *common.SendEvent) {
 	logger.By(event.Message.HostnameFrom).Info("mailer#%d-%d begin sending mail", m.id, message.Id)
 	logger.By(message.HostnameFrom).Debug("mailer#%d-%d receive smtp client#%d", m.id, message.Id, event.Client.Id)
 
+	// получатель вернул письмо в очередь при остановке, письмо не отправляем, чтобы не отправить его дважды
+	if !event.StartTransmit() {
+		logger.By(message.HostnameFrom).Warn("mailer#%d-%d sending is cancelled, mail is requeued", m.id, message.Id)
+		m.release(event, nil)
+		return
+	}
+
 	success := false
 	toErr := event.Client.SetTimeout(common.App.Timeout().Mail)
 	if toErr != nil {
 		logger.By(message.HostnameFrom).ErrErr(toErr)
 	}
 
+	started := time.Now()
 	err := worker.Mail(message.Envelope)
+	common.ObserveSmtpCommand(common.MailSmtpCommand, started, err)
 	if err == nil {
 		logger.By(message.HostnameFrom).Debug("mailer#%d-%d send command MAIL FROM: %s", m.id, message.Id, message.Envelope)
 
@@ -94,7 +107,9 @@ func (m *Mailer) send(event *common.SendEvent) {
 			logger.By(message.HostnameFrom).ErrErr(toErr)
 		}
 
+		started = time.Now()
 		err = worker.Rcpt(message.Recipient)
+		common.ObserveSmtpCommand(common.RcptSmtpCommand, started, err)
 		if err == nil {
 			logger.By(message.HostnameFrom).Debug("mailer#%d-%d send command RCPT TO: %s", m.id, message.Id, message.Recipient)
 
@@ -103,6 +118,8 @@ func (m *Mailer) send(event *common.SendEvent) {
 				logger.By(message.HostnameFrom).ErrErr(toErr)
 			}
 
+			// время DATA учитывается до ответа почтового сервиса на точку, т.е. вместе с передачей письма
+			started = time.Now()
 			var wc io.WriteCloser
 			wc, err = worker.Data()
 			if err == nil {
@@ -110,25 +127,28 @@ func (m *Mailer) send(event *common.SendEvent) {
 
 				_, err = wc.Write(message.Body)
 				if err == nil {
-					_ = wc.Close()
-					logger.By(message.HostnameFrom).Debug("%s", message.Body)
-					logger.By(message.HostnameFrom).Debug("mailer#%d-%d send command .", m.id, message.Id)
-
-					// стараемся слать письма через уже созданное соединение,
-					// поэтому после отправки письма не закрываем соединение
-					err = worker.Reset()
-					if err == nil {
-						logger.By(message.HostnameFrom).Debug("mailer#%d-%d send command RSET", m.id, message.Id)
-						logger.By(event.Message.HostnameFrom).Info("mailer#%d-%d success send mail#%d", m.id, message.Id, message.Id)
-						success = true
-					}
+					// после точки почтовый сервис отвечает, принято ли письмо
+					err = wc.Close()
+				}
+			}
+			common.ObserveSmtpCommand(common.DataSmtpCommand, started, err)
+			if err == nil {
+				logger.By(message.HostnameFrom).Debug("%s", message.Body)
+				logger.By(message.HostnameFrom).Debug("mailer#%d-%d send command .", m.id, message.Id)
+
+				// стараемся слать письма через уже созданное соединение,
+				// поэтому после отправки письма не закрываем соединение
+				err = worker.Reset()
+				if err == nil {
+					logger.By(message.HostnameFrom).Debug("mailer#%d-%d send command RSET", m.id, message.Id)
+					logger.By(event.Message.HostnameFrom).Info("mailer#%d-%d success send mail#%d", m.id, message.Id, message.Id)
+					success = true
 				}
 			}
 		}
 	}
 
-	event.Client.Wait()
-	event.Queue.Push(event.Client)
+	m.release(event, err)
 
 	if success {
 		// отпускаем поток получателя сообщений из очереди
@@ -138,39 +158,51 @@ func (m *Mailer) send(event *common.SendEvent) {
 	}
 }
 
+// возвращает клиента в пул
+// если почтовый сервис ответил ошибкой, сбрасываем цепочку команд и продолжаем использовать соединение,
+// если соединение разорвано, закрываем его
+func (m *Mailer) release(event *common.SendEvent, err error) {
+	if event.Client == nil || event.Pool == nil {
+		return
+	}
+
+	if err != nil {
+		var smtpErr *textproto.Error
+		if errors.As(err, &smtpErr) {
+			err = event.Client.Worker.Reset()
+		}
+	}
+
+	if err == nil {
+		event.Pool.Put(event.Client)
+	} else {
+		logger.By(event.Message.HostnameFrom).Debug("mailer#%d-%d close smtp client#%d, err - %v", m.id, event.Message.Id, event.Client.Id, err)
+		event.Pool.Discard(event.Client)
+	}
+}
+
 // возвращает письмо обратно в очередь после ошибки во время отправки
 func ReturnMail(event *common.SendEvent, err error) {
 	// необходимо проверить сообщение на наличие кода ошибки
 	// обычно код идет первым
+	// результат зависит только от ошибки текущей попытки отправки,
+	// ошибка без кода сохраняется в письме с нулевым кодом, чтобы не потерять ее и не оставить в письме ошибку предыдущей попытки
+	var code int
 	if err != nil {
 		errorMessage := err.Error()
 		parts := strings.Split(errorMessage, " ")
 		if len(parts) > 0 {
 			// пытаемся получить код
-			code, e := strconv.Atoi(strings.TrimSpace(parts[0]))
-			// и создать ошибку
 			// письмо с ошибкой вернется в другую очередь, отличную от письмо без ошибки
-			if e == nil {
-				event.Message.Error = &common.MailError{Message: errorMessage, Code: code}
-			}
+			code, _ = strconv.Atoi(strings.TrimSpace(parts[0]))
 		} else {
 			logger.All().Err("can't get err code from error: %s", err)
 		}
-	}
-
-	// если в событии уже создан клиент
-	if event.Client != nil {
-		if event.Client.Worker != nil {
-			// сбрасываем цепочку команд к почтовому сервису
-			err := event.Client.Worker.Reset()
-			if err != nil {
-				logger.All().WarnErr(err)
-			}
-		}
+		event.Message.Error = &common.MailError{Message: errorMessage, Code: code}
 	}
 
 	// отпускаем поток получателя сообщений из очереди
-	if event.Message.Error == nil {
+	if code == 0 {
 		event.Result <- common.DelaySendEventResult
 		logger.All().Warn("message delayed")
 	} else {
@@ -1,10 +1,12 @@
 package mailer
 
 import (
+	"context"
 	"crypto/rsa"
-	"crypto/x509"
-	"encoding/pem"
-	"io/ioutil"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
 
 	"gopkg.in/yaml.v3"
 
@@ -21,13 +23,17 @@ type Service struct {
 
 	Configs map[string]*Config `yaml:"postmans"`
 
-	events       chan *common.SendEvent
-	eventsClosed bool
+	events *common.EventChannel
+
+	// защищает настройки от замены во время переконфигурации
+	rwm sync.RWMutex
 }
 
 // создает новый сервис отправки писем
 func Inst() common.SendingService {
-	return new(Service)
+	service := new(Service)
+	common.RegisterHealthCheck("dkim", common.ReadinessProbe, service.checkPrivateKeys)
+	return service
 }
 
 // инициализирует сервис отправки писем
@@ -42,8 +48,7 @@ func (s *Service) OnInit(event *common.ApplicationEvent) {
 		return
 	}
 
-	s.events = make(chan *common.SendEvent)
-	s.eventsClosed = false
+	s.events = common.NewEventChannel("mailer")
 
 	for name, config := range s.Configs {
 		s.init(config, name)
@@ -55,21 +60,17 @@ func (s *Service) OnInit(event *common.ApplicationEvent) {
 }
 
 func (s *Service) init(conf *Config, hostname string) {
+	conf.DkimSelector = conf.selector()
+
 	// закрытый ключ должен быть указан обязательно
-	// поэтому даже не проверяем что указано в переменной
-	privateKey, err := ioutil.ReadFile(conf.PrivateKeyFilename)
+	privateKey, err := readPrivateKey(conf.PrivateKeyFilename)
 	if err != nil {
-		logger.By(hostname).ErrWithErr(err, "mailer service can't read private key %s", conf.PrivateKeyFilename)
+		logger.By(hostname).ErrWithErr(err, "mailer service can't use private key %s", common.PEMSource(conf.PrivateKeyFilename))
 		return
 	}
 
-	logger.By(hostname).Debug("mailer service private key %s read success", conf.PrivateKeyFilename)
-	der, _ := pem.Decode(privateKey)
-	conf.privateKey, err = x509.ParsePKCS1PrivateKey(der.Bytes)
-	if err != nil {
-		logger.By(hostname).ErrWithErr(err, "mailer service can't decode or parse private key %s", conf.PrivateKeyFilename)
-		return
-	}
+	logger.By(hostname).Debug("mailer service private key %s read success", common.PEMSource(conf.PrivateKeyFilename))
+	conf.privateKey = privateKey
 }
 
 // запускает отправителей и прием сообщений из очереди
@@ -80,27 +81,74 @@ func (s *Service) OnRun() {
 	}
 }
 
-// Event send event
-func (s *Service) Event(ev *common.SendEvent) bool {
-	if s.eventsClosed {
-		return false
+// OnReconfigure перечитывает закрытые ключи и селекторы, не останавливая отправителей
+// ключи перечитываются для всех доменов, чтобы подхватить замененные файлы ключей
+// количество отправителей меняется только после перезапуска приложения
+func (s *Service) OnReconfigure(event *common.ApplicationEvent) {
+	service := new(Service)
+	err := yaml.Unmarshal(event.Data, service)
+	if err != nil {
+		logger.All().ErrWithErr(err, "mailer service can't unmarshal config")
+		return
+	}
+
+	if len(service.Configs) == 0 {
+		logger.All().Err("mailer config is empty, current config is used")
+		return
+	}
+
+	for name, config := range service.Configs {
+		service.init(config, name)
+		// если новый ключ не удалось прочитать, подписываем письма текущим ключом
+		if conf, ok := s.getConfig(name); ok && config.privateKey == nil && conf.privateKey != nil {
+			logger.By(name).Warn("mailer service can't use new private key %s, current key is used", common.PEMSource(config.PrivateKeyFilename))
+			config.privateKey = conf.privateKey
+		}
 	}
 
-	s.events <- ev
-	return true
+	s.rwm.Lock()
+	defer s.rwm.Unlock()
+	s.Configs = service.Configs
+}
+
+// Event send event
+func (s *Service) Event(ev *common.SendEvent) bool {
+	return s.events.Send(ev)
 }
 
 // завершает работу сервиса отправки писем
 func (s *Service) OnFinish() {
-	if !s.eventsClosed {
-		s.eventsClosed = true
-		close(s.events)
+	s.events.Close()
+}
+
+// проверяет, что закрытые ключи всех доменов прочитаны, без ключа письма домена не подписываются
+func (s *Service) checkPrivateKeys(_ context.Context) error {
+	s.rwm.RLock()
+	defer s.rwm.RUnlock()
+	missing := make([]string, 0)
+	for name, conf := range s.Configs {
+		if conf.privateKey == nil {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		return fmt.Errorf("private keys of %s aren't loaded", strings.Join(missing, ", "))
 	}
+	return nil
+}
+
+// отдает настройки домена
+func (s *Service) getConfig(hostname string) (*Config, bool) {
+	s.rwm.RLock()
+	defer s.rwm.RUnlock()
+	conf, ok := s.Configs[hostname]
+	return conf, ok
 }
 
 func (s *Service) getDkimSelector(hostname string) string {
-	if conf, ok := s.Configs[hostname]; ok {
-		return conf.DkimSelector
+	if conf, ok := s.getConfig(hostname); ok {
+		return conf.selector()
 	} else {
 		logger.By(hostname).Warn("mailer service can't find dkim selector by %s. Set default %s", hostname, defaultDkimSelector)
 		return defaultDkimSelector
@@ -108,7 +156,7 @@ func (s *Service) getDkimSelector(hostname string) string {
 }
 
 func (s *Service) getPrivateKey(hostname string) *rsa.PrivateKey {
-	if conf, ok := s.Configs[hostname]; ok {
+	if conf, ok := s.getConfig(hostname); ok {
 		return conf.privateKey
 	} else {
 		logger.By(hostname).Err("mailer service can't find private key by %s", hostname)
@@ -117,7 +165,7 @@ func (s *Service) getPrivateKey(hostname string) *rsa.PrivateKey {
 }
 
 type Config struct {
-	// путь до закрытого ключа
+	// путь до закрытого ключа или закрытый ключ в формате PEM
 	PrivateKeyFilename string `yaml:"privateKey"`
 
 	// селектор
@@ -126,3 +174,11 @@ type Config struct {
 	// содержимое приватного ключа
 	privateKey *rsa.PrivateKey
 }
+
+// отдает селектор dkim, если селектор не указан - селектор по умолчанию
+func (c *Config) selector() string {
+	if c.DkimSelector == common.EmptyStr {
+		return defaultDkimSelector
+	}
+	return c.DkimSelector
+}
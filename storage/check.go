@@ -0,0 +1,48 @@
+package storage
+
+import (
+	"net/url"
+	"os"
+	"path/filepath"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/Halfi/postmanq/common"
+)
+
+// OnCheck проверяет адрес общего хранилища и файл для сохранения счетчиков
+func (s *Service) OnCheck(event *common.ApplicationEvent) []error {
+	service := new(Service)
+	if err := yaml.Unmarshal(event.Data, service); err != nil {
+		return []error{err}
+	}
+
+	errs := make([]error, 0)
+	config := service.Config
+	if config.URI != common.EmptyStr {
+		u, err := url.Parse(config.URI)
+		switch {
+		case err != nil:
+			errs = append(errs, common.NewConfigError("storage.uri", "%v", err))
+		case u.Scheme != "redis" && u.Scheme != "rediss":
+			errs = append(errs, common.NewConfigError("storage.uri", "unknown scheme %q, should be redis or rediss", u.Scheme))
+		case u.Host == common.EmptyStr:
+			errs = append(errs, common.NewConfigError("storage.uri", "host should be defined"))
+		}
+	}
+	if config.Connections < 0 {
+		errs = append(errs, common.NewConfigError("storage.connections", "connections shouldn't be negative"))
+	}
+	if config.Timeout < 0 {
+		errs = append(errs, common.NewConfigError("storage.timeout", "timeout shouldn't be negative"))
+	}
+	if config.StateFile != common.EmptyStr {
+		if info, err := os.Stat(filepath.Dir(config.StateFile)); err != nil || !info.IsDir() {
+			errs = append(errs, common.NewConfigError("storage.stateFile", "directory of %s doesn't exist", config.StateFile))
+		}
+	}
+	if config.StateInterval < 0 {
+		errs = append(errs, common.NewConfigError("storage.stateInterval", "interval shouldn't be negative"))
+	}
+	return errs
+}
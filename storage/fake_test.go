@@ -0,0 +1,338 @@
+package storage
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeRedis сервер, отвечающий по протоколу RESP, для проверки хранилища без redis
+// lua не интерпретируется: EVAL сравнивает текст скрипта с addScript, takeScript, pushScript и putScript
+// и выполняет их копию на go, поэтому изменения скриптов нужно повторять в fakeRedis.eval
+type fakeRedis struct {
+	listener net.Listener
+	username string
+	password string
+
+	mutex   sync.Mutex
+	values  map[string]*fakeValue
+	zsets   map[string]*fakeZset
+	down    bool
+	accepts int
+}
+
+// строковое значение
+type fakeValue struct {
+	value  string
+	expire time.Time
+}
+
+// сортированное множество
+type fakeZset struct {
+	scores map[string]int64
+	expire time.Time
+}
+
+// запускает сервер на свободном порту, сервер останавливается по завершении теста
+func newFakeRedis(t *testing.T) *fakeRedis {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f := &fakeRedis{
+		listener: listener,
+		values:   make(map[string]*fakeValue),
+		zsets:    make(map[string]*fakeZset),
+	}
+	go f.serve()
+	t.Cleanup(func() {
+		_ = listener.Close()
+	})
+	return f
+}
+
+// адрес сервера вида redis://host:port
+func (f *fakeRedis) uri() string {
+	return "redis://" + f.listener.Addr().String()
+}
+
+// задает пользователя и пароль
+func (f *fakeRedis) auth(username, password string) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.username, f.password = username, password
+}
+
+// проверяет пользователя и пароль
+func (f *fakeRedis) authorize(username, password string) bool {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return password == f.password && (f.username == "" || username == f.username)
+}
+
+// переводит сервер в недоступное состояние: соединения принимаются и сразу закрываются
+func (f *fakeRedis) setDown(down bool) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.down = down
+}
+
+// количество принятых соединений
+func (f *fakeRedis) accepted() int {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.accepts
+}
+
+// время жизни ключа, 0 - ключа нет или время жизни не задано
+func (f *fakeRedis) ttl(key string) time.Duration {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if value := f.value(key); value != nil && !value.expire.IsZero() {
+		return time.Until(value.expire)
+	}
+	if zset := f.zset(key); zset != nil && !zset.expire.IsZero() {
+		return time.Until(zset.expire)
+	}
+	return 0
+}
+
+func (f *fakeRedis) serve() {
+	for {
+		conn, err := f.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		f.mutex.Lock()
+		f.accepts++
+		down := f.down
+		f.mutex.Unlock()
+
+		if down {
+			_ = conn.Close()
+			continue
+		}
+		go f.handle(conn)
+	}
+}
+
+func (f *fakeRedis) handle(conn net.Conn) {
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+	authorized := f.authorize("default", "")
+	for {
+		args, err := readCommand(reader)
+		if err != nil {
+			return
+		}
+
+		var reply string
+		switch name := strings.ToUpper(args[0]); {
+		case name == "AUTH":
+			username, password := "default", args[len(args)-1]
+			if len(args) == 3 {
+				username = args[1]
+			}
+			authorized = f.authorize(username, password)
+			if authorized {
+				reply = "+OK\r\n"
+			} else {
+				reply = "-WRONGPASS invalid username-password pair\r\n"
+			}
+		case !authorized:
+			reply = "-NOAUTH Authentication required.\r\n"
+		default:
+			reply = f.exec(name, args[1:])
+		}
+
+		if _, err = io.WriteString(conn, reply); err != nil {
+			return
+		}
+	}
+}
+
+// читает команду - массив строк
+func readCommand(reader *bufio.Reader) ([]string, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(line, "*") {
+		return nil, fmt.Errorf("unexpected command %q", line)
+	}
+	size, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+	if err != nil || size < 1 {
+		return nil, fmt.Errorf("unexpected command %q", line)
+	}
+
+	args := make([]string, size)
+	for i := range args {
+		line, err = reader.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		length, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "$")))
+		if err != nil {
+			return nil, err
+		}
+		data := make([]byte, length+2)
+		if _, err = io.ReadFull(reader, data); err != nil {
+			return nil, err
+		}
+		args[i] = string(data[:length])
+	}
+	return args, nil
+}
+
+// выполняет команду и отдает ответ в формате RESP
+func (f *fakeRedis) exec(name string, args []string) string {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	switch name {
+	case "PING":
+		return "+PONG\r\n"
+	case "SELECT":
+		return "+OK\r\n"
+	case "GET":
+		if value := f.value(args[0]); value != nil {
+			return bulk(value.value)
+		}
+		return "$-1\r\n"
+	case "ZREM":
+		if zset := f.zset(args[0]); zset != nil {
+			if _, ok := zset.scores[args[1]]; ok {
+				delete(zset.scores, args[1])
+				return ":1\r\n"
+			}
+		}
+		return ":0\r\n"
+	case "EVAL":
+		return f.eval(args[0], args[2], args[3:])
+	default:
+		return fmt.Sprintf("-ERR unknown command '%s'\r\n", name)
+	}
+}
+
+// выполняет копию скрипта
+func (f *fakeRedis) eval(script, key string, argv []string) string {
+	now := time.Now()
+	switch script {
+	case addScript:
+		delta, _ := strconv.ParseInt(argv[0], 10, 64)
+		ttl, _ := strconv.ParseInt(argv[1], 10, 64)
+		value := f.value(key)
+		if value == nil {
+			value = &fakeValue{value: "0"}
+			f.values[key] = value
+		}
+		current, _ := strconv.ParseInt(value.value, 10, 64)
+		current += delta
+		value.value = strconv.FormatInt(current, 10)
+		if value.expire.IsZero() {
+			value.expire = now.Add(time.Duration(ttl) * time.Millisecond)
+		}
+		return integer(current)
+	case takeScript:
+		current, interval, burst, hold := toInt64(argv[0]), toInt64(argv[1]), toInt64(argv[2]), toInt64(argv[3])
+		var tat int64
+		if value := f.value(key); value != nil {
+			tat = toInt64(value.value)
+		}
+		if tat < current {
+			tat = current
+		}
+		wait := tat - (burst-1)*interval - current
+		if wait > hold {
+			return pair(0, wait)
+		}
+		if wait < 0 {
+			wait = 0
+		}
+		tat += interval
+		px := int64(math.Ceil(float64(tat-current)/1000)) + 1
+		f.values[key] = &fakeValue{value: strconv.FormatInt(tat, 10), expire: now.Add(time.Duration(px) * time.Millisecond)}
+		return pair(1, wait)
+	case pushScript:
+		current, window, limit := toInt64(argv[0]), toInt64(argv[1]), toInt64(argv[2])
+		zset := f.zset(key)
+		if zset == nil {
+			zset = &fakeZset{scores: make(map[string]int64)}
+			f.zsets[key] = zset
+		}
+		for member, score := range zset.scores {
+			if score <= current-window {
+				delete(zset.scores, member)
+			}
+		}
+		if int64(len(zset.scores)) >= limit {
+			scores := make([]int64, 0, len(zset.scores))
+			for _, score := range zset.scores {
+				scores = append(scores, score)
+			}
+			if len(scores) == 0 {
+				return pair(0, window)
+			}
+			sort.Slice(scores, func(i, j int) bool { return scores[i] < scores[j] })
+			return pair(0, scores[0]+window-current)
+		}
+		zset.scores[argv[3]] = current
+		zset.expire = now.Add(time.Duration(int64(math.Ceil(float64(window)/1000))+1) * time.Millisecond)
+		return pair(1, 0)
+	case putScript:
+		if value := f.value(key); value != nil {
+			value.value = strconv.FormatInt(toInt64(value.value)-toInt64(argv[0]), 10)
+		}
+		return integer(0)
+	default:
+		return "-NOSCRIPT unknown script\r\n"
+	}
+}
+
+// отдает значение, удаляя его, если время жизни истекло
+func (f *fakeRedis) value(key string) *fakeValue {
+	value, ok := f.values[key]
+	if ok && !value.expire.IsZero() && time.Now().After(value.expire) {
+		delete(f.values, key)
+		return nil
+	}
+	return value
+}
+
+// отдает множество, удаляя его, если время жизни истекло
+func (f *fakeRedis) zset(key string) *fakeZset {
+	zset, ok := f.zsets[key]
+	if ok && !zset.expire.IsZero() && time.Now().After(zset.expire) {
+		delete(f.zsets, key)
+		return nil
+	}
+	return zset
+}
+
+func toInt64(value string) int64 {
+	result, _ := strconv.ParseInt(value, 10, 64)
+	return result
+}
+
+func bulk(value string) string {
+	return "$" + strconv.Itoa(len(value)) + "\r\n" + value + "\r\n"
+}
+
+func integer(value int64) string {
+	return ":" + strconv.FormatInt(value, 10) + "\r\n"
+}
+
+func pair(success, wait int64) string {
+	return "*2\r\n" + integer(success) + integer(wait)
+}
@@ -0,0 +1,267 @@
+package storage
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Memory хранилище счетчиков в памяти процесса, используется, если общее хранилище не указано
+type Memory struct {
+	values map[string]*memoryValue
+	logs   map[string]*memoryLog
+	mutex  sync.Mutex
+}
+
+// значение счетчика
+type memoryValue struct {
+	Value int64 `json:"value"`
+
+	// дата удаления счетчика
+	Expire time.Time `json:"expire"`
+}
+
+// журнал событий скользящего окна
+type memoryLog struct {
+	// события, упорядоченные по времени
+	Entries []*memoryEntry `json:"entries"`
+
+	// дата удаления журнала
+	Expire time.Time `json:"expire"`
+}
+
+// событие скользящего окна
+type memoryEntry struct {
+	Member string `json:"member"`
+
+	// время события в микросекундах
+	At int64 `json:"at"`
+}
+
+// сохраняемое состояние хранилища
+type memoryState struct {
+	Values map[string]*memoryValue `json:"values"`
+	Logs   map[string]*memoryLog   `json:"logs"`
+}
+
+// NewMemory создает хранилище в памяти и запускает удаление устаревших счетчиков
+func NewMemory() *Memory {
+	m := &Memory{values: make(map[string]*memoryValue), logs: make(map[string]*memoryLog)}
+	go m.clean()
+	return m
+}
+
+// Add прибавляет delta к счетчику и отдает новое значение счетчика
+func (m *Memory) Add(key string, delta int64, ttl time.Duration) (int64, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	now := time.Now()
+	value := m.get(key, now)
+	if value == nil {
+		value = &memoryValue{Expire: now.Add(ttl)}
+		m.values[key] = value
+	}
+	value.Value += delta
+	return value.Value, nil
+}
+
+// Get отдает значение счетчика
+func (m *Memory) Get(key string) (int64, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if value := m.get(key, time.Now()); value != nil {
+		return value.Value, nil
+	}
+	return 0, nil
+}
+
+// Take забирает токен из корзины токенов
+func (m *Memory) Take(key string, now time.Time, interval time.Duration, burst int64, hold time.Duration) (time.Duration, bool, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	var tat int64
+	if value := m.get(key, now); value != nil {
+		tat = value.Value
+	}
+
+	current := micros(now)
+	tat, wait, ok := gcra(tat, current, interval.Microseconds(), burst, hold.Microseconds())
+	if ok {
+		m.values[key] = &memoryValue{
+			Value:  tat,
+			Expire: now.Add(time.Duration(tat-current) * time.Microsecond),
+		}
+	}
+	return time.Duration(wait) * time.Microsecond, ok, nil
+}
+
+// Put возвращает токен в корзину токенов
+func (m *Memory) Put(key string, interval time.Duration) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if value := m.get(key, time.Now()); value != nil {
+		value.Value -= interval.Microseconds()
+	}
+	return nil
+}
+
+// Push добавляет событие в журнал скользящего окна
+func (m *Memory) Push(key, member string, now time.Time, window time.Duration, limit int64) (time.Duration, bool, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	log, ok := m.logs[key]
+	if !ok {
+		log = &memoryLog{Entries: make([]*memoryEntry, 0)}
+		m.logs[key] = log
+	}
+
+	current := micros(now)
+	since := current - window.Microseconds()
+	i := 0
+	for i < len(log.Entries) && log.Entries[i].At <= since {
+		i++
+	}
+	log.Entries = log.Entries[i:]
+
+	if int64(len(log.Entries)) >= limit {
+		if len(log.Entries) == 0 {
+			return window, false, nil
+		}
+		return time.Duration(log.Entries[0].At-since) * time.Microsecond, false, nil
+	}
+
+	log.Entries = append(log.Entries, &memoryEntry{Member: member, At: current})
+	log.Expire = now.Add(window)
+	return 0, true, nil
+}
+
+// Remove удаляет событие из журнала скользящего окна
+func (m *Memory) Remove(key, member string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if log, ok := m.logs[key]; ok {
+		for i, entry := range log.Entries {
+			if entry.Member == member {
+				log.Entries = append(log.Entries[:i], log.Entries[i+1:]...)
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// Close ничего не делает, счетчики сохраняются до завершения процесса
+func (m *Memory) Close() error {
+	return nil
+}
+
+// Save сохраняет действующие счетчики и журналы в файл
+// файл записывается целиком во временный файл, который затем переименовывается
+func (m *Memory) Save(filename string) error {
+	m.mutex.Lock()
+	now := time.Now()
+	state := &memoryState{
+		Values: make(map[string]*memoryValue, len(m.values)),
+		Logs:   make(map[string]*memoryLog, len(m.logs)),
+	}
+	for key, value := range m.values {
+		if !now.After(value.Expire) {
+			state.Values[key] = &memoryValue{Value: value.Value, Expire: value.Expire}
+		}
+	}
+	for key, log := range m.logs {
+		if !now.After(log.Expire) {
+			entries := make([]*memoryEntry, len(log.Entries))
+			copy(entries, log.Entries)
+			state.Logs[key] = &memoryLog{Entries: entries, Expire: log.Expire}
+		}
+	}
+	m.mutex.Unlock()
+
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	file, err := ioutil.TempFile(filepath.Dir(filename), filepath.Base(filename)+".*")
+	if err != nil {
+		return err
+	}
+	if _, err = file.Write(data); err != nil {
+		_ = file.Close()
+		_ = os.Remove(file.Name())
+		return err
+	}
+	if err = file.Close(); err != nil {
+		_ = os.Remove(file.Name())
+		return err
+	}
+	return os.Rename(file.Name(), filename)
+}
+
+// Load восстанавливает счетчики и журналы из файла, сохраненного Save
+// устаревшие счетчики пропускаются, счетчики, которые уже есть в памяти, не перезаписываются
+func (m *Memory) Load(filename string) error {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+
+	state := new(memoryState)
+	if err = json.Unmarshal(data, state); err != nil {
+		return err
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	now := time.Now()
+	for key, value := range state.Values {
+		if value == nil || now.After(value.Expire) || m.get(key, now) != nil {
+			continue
+		}
+		m.values[key] = value
+	}
+	for key, log := range state.Logs {
+		if _, ok := m.logs[key]; ok || log == nil || now.After(log.Expire) {
+			continue
+		}
+		m.logs[key] = log
+	}
+	return nil
+}
+
+// отдает действующий счетчик, вызывается под семафором
+func (m *Memory) get(key string, now time.Time) *memoryValue {
+	value, ok := m.values[key]
+	if !ok || now.After(value.Expire) {
+		return nil
+	}
+	return value
+}
+
+// периодически удаляет устаревшие счетчики
+func (m *Memory) clean() {
+	for now := range time.Tick(time.Minute) {
+		m.mutex.Lock()
+		for key, value := range m.values {
+			if now.After(value.Expire) {
+				delete(m.values, key)
+			}
+		}
+		for key, log := range m.logs {
+			if now.After(log.Expire) {
+				delete(m.logs, key)
+			}
+		}
+		m.mutex.Unlock()
+	}
+}
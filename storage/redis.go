@@ -0,0 +1,461 @@
+package storage
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Halfi/postmanq/logger"
+)
+
+const (
+	// прибавляет значение к счетчику и задает время жизни новому счетчику
+	addScript = `
+local value = redis.call('INCRBY', KEYS[1], ARGV[1])
+if redis.call('PTTL', KEYS[1]) < 0 then
+	redis.call('PEXPIRE', KEYS[1], ARGV[2])
+end
+return value`
+
+	// забирает токен из корзины токенов по алгоритму GCRA, повторяет функцию gcra
+	takeScript = `
+local now = tonumber(ARGV[1])
+local interval = tonumber(ARGV[2])
+local burst = tonumber(ARGV[3])
+local hold = tonumber(ARGV[4])
+local tat = tonumber(redis.call('GET', KEYS[1]) or 0)
+if tat < now then
+	tat = now
+end
+local wait = tat - (burst - 1) * interval - now
+if wait > hold then
+	return {0, wait}
+end
+if wait < 0 then
+	wait = 0
+end
+tat = tat + interval
+redis.call('SET', KEYS[1], string.format('%d', tat), 'PX', math.ceil((tat - now) / 1000) + 1)
+return {1, wait}`
+
+	// добавляет событие в журнал скользящего окна, повторяет функцию Memory.Push
+	pushScript = `
+local now = tonumber(ARGV[1])
+local window = tonumber(ARGV[2])
+local limit = tonumber(ARGV[3])
+redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', now - window)
+if redis.call('ZCARD', KEYS[1]) >= limit then
+	local oldest = redis.call('ZRANGE', KEYS[1], 0, 0, 'WITHSCORES')
+	if #oldest == 0 then
+		return {0, window}
+	end
+	return {0, tonumber(oldest[2]) + window - now}
+end
+redis.call('ZADD', KEYS[1], now, ARGV[4])
+redis.call('PEXPIRE', KEYS[1], math.ceil(window / 1000) + 1)
+return {1, 0}`
+
+	// возвращает токен в корзину токенов, если корзина еще существует
+	putScript = `
+if redis.call('EXISTS', KEYS[1]) == 1 then
+	redis.call('DECRBY', KEYS[1], ARGV[1])
+end
+return 0`
+)
+
+const (
+	// время, на которое хранилище считается недоступным после первой ошибки соединения
+	minBackoff = time.Second
+	// наибольшее время, на которое хранилище считается недоступным
+	maxBackoff = time.Minute
+)
+
+// ErrStorageDown хранилище недоступно, соединение не открывается до следующей попытки
+var ErrStorageDown = errors.New("shared storage is down")
+
+// ошибка, которую вернул сервер, соединение после нее остается рабочим
+type redisError string
+
+func (e redisError) Error() string {
+	return string(e)
+}
+
+// Redis хранилище счетчиков в redis или совместимом сервере
+// команды отправляются по протоколу RESP, соединения переиспользуются
+type Redis struct {
+	addr     string
+	username string
+	password string
+	db       int
+	useTLS   bool
+	timeout  time.Duration
+
+	// свободные соединения
+	conns chan *redisConn
+
+	// пока хранилище недоступно, соединения не открываются до retryAt
+	// после каждой неудачной попытки время ожидания удваивается
+	mutex   sync.Mutex
+	backoff time.Duration
+	retryAt time.Time
+}
+
+// соединение с сервером
+type redisConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+
+	// новое соединение, первый ответ по нему означает, что хранилище доступно
+	probe bool
+}
+
+// NewRedis создает хранилище по адресу вида redis://[user:password@]host:port[/db], rediss:// - для TLS соединений
+// соединения открываются при первом обращении
+func NewRedis(uri string, connections int, timeout time.Duration) (*Redis, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &Redis{
+		addr:    u.Host,
+		timeout: timeout,
+		conns:   make(chan *redisConn, connections),
+	}
+
+	switch u.Scheme {
+	case "redis":
+	case "rediss":
+		r.useTLS = true
+	default:
+		return nil, fmt.Errorf("unknown storage scheme %s", u.Scheme)
+	}
+
+	if u.Port() == "" {
+		r.addr = net.JoinHostPort(u.Hostname(), "6379")
+	}
+
+	if u.User != nil {
+		r.username = u.User.Username()
+		r.password, _ = u.User.Password()
+	}
+
+	if db := strings.Trim(u.Path, "/"); db != "" {
+		r.db, err = strconv.Atoi(db)
+		if err != nil {
+			return nil, fmt.Errorf("wrong storage database %s", db)
+		}
+	}
+
+	return r, nil
+}
+
+// Add прибавляет delta к счетчику и отдает новое значение счетчика
+func (r *Redis) Add(key string, delta int64, ttl time.Duration) (int64, error) {
+	reply, err := r.do("EVAL", addScript, "1", key, strconv.FormatInt(delta, 10), strconv.FormatInt(ttl.Milliseconds(), 10))
+	if err != nil {
+		return 0, err
+	}
+	return toInt(reply)
+}
+
+// Get отдает значение счетчика
+func (r *Redis) Get(key string) (int64, error) {
+	reply, err := r.do("GET", key)
+	if err != nil || reply == nil {
+		return 0, err
+	}
+	return toInt(reply)
+}
+
+// Take забирает токен из корзины токенов
+func (r *Redis) Take(key string, now time.Time, interval time.Duration, burst int64, hold time.Duration) (time.Duration, bool, error) {
+	reply, err := r.do(
+		"EVAL", takeScript, "1", key,
+		strconv.FormatInt(micros(now), 10),
+		strconv.FormatInt(interval.Microseconds(), 10),
+		strconv.FormatInt(burst, 10),
+		strconv.FormatInt(hold.Microseconds(), 10),
+	)
+	if err != nil {
+		return 0, false, err
+	}
+
+	return toWait(reply)
+}
+
+// Put возвращает токен в корзину токенов
+func (r *Redis) Put(key string, interval time.Duration) error {
+	_, err := r.do("EVAL", putScript, "1", key, strconv.FormatInt(interval.Microseconds(), 10))
+	return err
+}
+
+// Push добавляет событие в журнал скользящего окна
+func (r *Redis) Push(key, member string, now time.Time, window time.Duration, limit int64) (time.Duration, bool, error) {
+	reply, err := r.do(
+		"EVAL", pushScript, "1", key,
+		strconv.FormatInt(micros(now), 10),
+		strconv.FormatInt(window.Microseconds(), 10),
+		strconv.FormatInt(limit, 10),
+		member,
+	)
+	if err != nil {
+		return 0, false, err
+	}
+	return toWait(reply)
+}
+
+// Remove удаляет событие из журнала скользящего окна
+func (r *Redis) Remove(key, member string) error {
+	_, err := r.do("ZREM", key, member)
+	return err
+}
+
+// Close закрывает свободные соединения
+func (r *Redis) Close() error {
+	for {
+		select {
+		case c := <-r.conns:
+			_ = c.conn.Close()
+		default:
+			return nil
+		}
+	}
+}
+
+// отправляет команду и читает ответ
+func (r *Redis) do(args ...string) (interface{}, error) {
+	c, err := r.conn()
+	if err != nil {
+		return nil, err
+	}
+
+	reply, err := c.do(r.timeout, args...)
+	var replyErr redisError
+	if err != nil && !errors.As(err, &replyErr) {
+		_ = c.conn.Close()
+		r.failed()
+		return nil, err
+	}
+
+	if c.probe {
+		c.probe = false
+		r.succeeded()
+	}
+	r.release(c)
+	return reply, err
+}
+
+// разрешает открыть соединение, пока хранилище недоступно, разрешается одна попытка за время ожидания
+func (r *Redis) allow() bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.retryAt.IsZero() {
+		return true
+	}
+	now := time.Now()
+	if now.Before(r.retryAt) {
+		return false
+	}
+	r.retryAt = now.Add(r.backoff)
+	return true
+}
+
+// помечает хранилище недоступным, закрывает свободные соединения и увеличивает время ожидания следующей попытки
+func (r *Redis) failed() {
+	_ = r.Close()
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	switch {
+	case r.backoff == 0:
+		r.backoff = minBackoff
+	case r.backoff < maxBackoff:
+		r.backoff *= 2
+		if r.backoff > maxBackoff {
+			r.backoff = maxBackoff
+		}
+	}
+	r.retryAt = time.Now().Add(r.backoff)
+}
+
+// помечает хранилище доступным
+func (r *Redis) succeeded() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if !r.retryAt.IsZero() {
+		logger.All().Info("storage service connected to %s, shared storage is available", r.addr)
+	}
+	r.backoff = 0
+	r.retryAt = time.Time{}
+}
+
+// отдает свободное соединение или открывает новое
+func (r *Redis) conn() (*redisConn, error) {
+	select {
+	case c := <-r.conns:
+		return c, nil
+	default:
+	}
+
+	if !r.allow() {
+		return nil, ErrStorageDown
+	}
+
+	c, err := r.dial()
+	if err != nil {
+		r.failed()
+		return nil, err
+	}
+	c.probe = true
+	return c, nil
+}
+
+// открывает соединение, авторизуется и выбирает базу
+func (r *Redis) dial() (*redisConn, error) {
+	dialer := &net.Dialer{Timeout: r.timeout}
+	var conn net.Conn
+	var err error
+	if r.useTLS {
+		host, _, _ := net.SplitHostPort(r.addr)
+		conn, err = tls.DialWithDialer(dialer, "tcp", r.addr, &tls.Config{ServerName: host})
+	} else {
+		conn, err = dialer.Dial("tcp", r.addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	c := &redisConn{conn: conn, reader: bufio.NewReader(conn)}
+	if r.password != "" {
+		args := []string{"AUTH", r.password}
+		if r.username != "" {
+			args = []string{"AUTH", r.username, r.password}
+		}
+		if _, err = c.do(r.timeout, args...); err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+	}
+	if r.db > 0 {
+		if _, err = c.do(r.timeout, "SELECT", strconv.Itoa(r.db)); err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// возвращает соединение в список свободных, лишние соединения закрываются
+func (r *Redis) release(c *redisConn) {
+	select {
+	case r.conns <- c:
+	default:
+		_ = c.conn.Close()
+	}
+}
+
+// отправляет команду и читает ответ
+func (c *redisConn) do(timeout time.Duration, args ...string) (interface{}, error) {
+	if timeout > 0 {
+		_ = c.conn.SetDeadline(time.Now().Add(timeout))
+	}
+
+	var builder strings.Builder
+	builder.WriteString("*" + strconv.Itoa(len(args)) + "\r\n")
+	for _, arg := range args {
+		builder.WriteString("$" + strconv.Itoa(len(arg)) + "\r\n" + arg + "\r\n")
+	}
+	if _, err := io.WriteString(c.conn, builder.String()); err != nil {
+		return nil, err
+	}
+	return c.read()
+}
+
+// читает ответ сервера
+func (c *redisConn) read() (interface{}, error) {
+	line, err := c.reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || !strings.HasSuffix(line, "\r\n") {
+		return nil, fmt.Errorf("malformed storage reply %q", line)
+	}
+
+	kind, value := line[0], line[1:len(line)-2]
+	switch kind {
+	case '+':
+		return value, nil
+	case '-':
+		return nil, redisError(value)
+	case ':':
+		return strconv.ParseInt(value, 10, 64)
+	case '$':
+		size, err := strconv.Atoi(value)
+		if err != nil || size < 0 {
+			return nil, err
+		}
+		data := make([]byte, size+2)
+		if _, err = io.ReadFull(c.reader, data); err != nil {
+			return nil, err
+		}
+		return string(data[:size]), nil
+	case '*':
+		size, err := strconv.Atoi(value)
+		if err != nil || size < 0 {
+			return nil, err
+		}
+		values := make([]interface{}, size)
+		for i := range values {
+			// ошибки элементов не прерывают чтение, чтобы не оставить ответ в соединении недочитанным
+			values[i], err = c.read()
+			var replyErr redisError
+			if err != nil && !errors.As(err, &replyErr) {
+				return nil, err
+			}
+		}
+		return values, nil
+	default:
+		return nil, fmt.Errorf("unknown storage reply %q", line)
+	}
+}
+
+// приводит ответ сервера к числу
+func toInt(reply interface{}) (int64, error) {
+	switch value := reply.(type) {
+	case int64:
+		return value, nil
+	case string:
+		return strconv.ParseInt(value, 10, 64)
+	default:
+		return 0, fmt.Errorf("unexpected storage reply %v", reply)
+	}
+}
+
+// приводит ответ сервера вида {1|0, время ожидания в микросекундах} к времени ожидания и признаку успеха
+func toWait(reply interface{}) (time.Duration, bool, error) {
+	values, ok := reply.([]interface{})
+	if !ok || len(values) != 2 {
+		return 0, false, fmt.Errorf("unexpected storage reply %v", reply)
+	}
+	success, err := toInt(values[0])
+	if err != nil {
+		return 0, false, err
+	}
+	wait, err := toInt(values[1])
+	if err != nil {
+		return 0, false, err
+	}
+	return time.Duration(wait) * time.Microsecond, success == 1, nil
+}
@@ -0,0 +1,306 @@
+package storage
+
+import (
+	"errors"
+	"os"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/Halfi/postmanq/common"
+	"github.com/Halfi/postmanq/logger"
+)
+
+var (
+	// сервис хранилища счетчиков
+	service *Service
+)
+
+// Config настройки хранилища
+type Config struct {
+	// URI адрес общего хранилища, redis://[user:password@]host:port[/db], если не указан, счетчики хранятся в памяти процесса
+	URI string `yaml:"uri"`
+
+	// Prefix префикс ключей, позволяет нескольким группам экземпляров использовать одно хранилище
+	Prefix string `yaml:"prefix"`
+
+	// Connections максимальное количество свободных соединений с хранилищем
+	Connections int `yaml:"connections"`
+
+	// Timeout время ожидания ответа хранилища
+	Timeout time.Duration `yaml:"timeout"`
+
+	// StateFile файл, в который сохраняются счетчики из памяти процесса,
+	// счетчики восстанавливаются после перезапуска приложения
+	StateFile string `yaml:"stateFile"`
+
+	// StateInterval как часто счетчики сохраняются в файл
+	StateInterval time.Duration `yaml:"stateInterval"`
+}
+
+// Service сервис хранилища счетчиков ограничений и прогрева ip
+// если общее хранилище недоступно, счетчики временно хранятся в памяти процесса
+type Service struct {
+	Config Config `yaml:"storage"`
+
+	// хранилище в памяти, сохраняется между переконфигурациями
+	memory *Memory
+
+	backend Storage
+	rwm     sync.RWMutex
+
+	// периодическое сохранение счетчиков в файл
+	ticker *time.Ticker
+	done   chan struct{}
+}
+
+// Inst создает сервис хранилища, до инициализации счетчики хранятся в памяти
+func Inst() *Service {
+	if service == nil {
+		memory := NewMemory()
+		service = &Service{memory: memory, backend: memory}
+	}
+	return service
+}
+
+// инициализирует значения по умолчанию
+func (c *Config) init() {
+	if c.Prefix == "" {
+		c.Prefix = "postmanq"
+	}
+	if c.Connections == 0 {
+		c.Connections = common.DefaultWorkersCount
+	}
+	if c.Timeout == 0 {
+		c.Timeout = time.Second
+	}
+	if c.StateInterval == 0 {
+		c.StateInterval = time.Minute
+	}
+}
+
+// разбирает настройки хранилища
+func parseConfig(data []byte) (Config, error) {
+	parsed := new(Service)
+	err := yaml.Unmarshal(data, parsed)
+	parsed.Config.init()
+	return parsed.Config, err
+}
+
+// создает хранилище по настройкам, если общее хранилище не указано или недоступно, отдает хранилище в памяти
+func (s *Service) newBackend(config Config) Storage {
+	if config.URI == "" {
+		return s.memory
+	}
+	backend, err := NewRedis(config.URI, config.Connections, config.Timeout)
+	if err != nil {
+		logger.All().ErrWithErr(err, "storage service can't use %s, counters are stored in memory", config.URI)
+		return s.memory
+	}
+	return backend
+}
+
+// OnInit подключает общее хранилище
+func (s *Service) OnInit(event *common.ApplicationEvent) {
+	config, err := parseConfig(event.Data)
+	if err != nil {
+		logger.All().ErrWithErr(err, "storage service can't unmarshal config")
+	}
+
+	if config.StateFile != "" {
+		err = s.memory.Load(config.StateFile)
+		if err != nil && !os.IsNotExist(err) {
+			logger.All().WarnWithErr(err, "storage service can't load state from %s", config.StateFile)
+		}
+	}
+
+	backend := s.newBackend(config)
+	s.rwm.Lock()
+	s.Config = config
+	s.backend = backend
+	s.rwm.Unlock()
+}
+
+// OnReconfigure заменяет хранилище, только если изменились его настройки
+// счетчики в памяти процесса сохраняются, ограничители продолжают работать со старым хранилищем до замены
+func (s *Service) OnReconfigure(event *common.ApplicationEvent) {
+	config, err := parseConfig(event.Data)
+	if err != nil {
+		logger.All().ErrWithErr(err, "storage service can't unmarshal config, current config is used")
+		return
+	}
+
+	current := s.config()
+	if common.Fingerprint(config) == common.Fingerprint(current) {
+		return
+	}
+
+	backend := s.newBackend(config)
+	s.rwm.Lock()
+	previous := s.backend
+	s.Config = config
+	s.backend = backend
+	s.rwm.Unlock()
+
+	if previous != s.memory {
+		if err := previous.Close(); err != nil {
+			logger.All().WarnWithErr(err, "storage service can't close connections")
+		}
+	}
+	if config.StateFile != current.StateFile || config.StateInterval != current.StateInterval {
+		s.stopSaving()
+		s.OnRun()
+	}
+	logger.All().Debug("storage service apply new config")
+}
+
+// OnRun запускает периодическое сохранение счетчиков в файл, соединения с хранилищем открываются при первом обращении
+func (s *Service) OnRun() {
+	config := s.config()
+	if config.StateFile == "" {
+		return
+	}
+
+	s.ticker = time.NewTicker(config.StateInterval)
+	s.done = make(chan struct{})
+	go func(ticker *time.Ticker, done chan struct{}) {
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				s.save()
+			}
+		}
+	}(s.ticker, s.done)
+}
+
+// останавливает периодическое сохранение счетчиков в файл
+func (s *Service) stopSaving() {
+	if s.ticker != nil {
+		s.ticker.Stop()
+		close(s.done)
+		s.ticker = nil
+	}
+}
+
+// Event send event
+func (s *Service) Event(_ *common.SendEvent) bool {
+	return true
+}
+
+// OnFinish сохраняет счетчики в файл и закрывает соединения с общим хранилищем
+func (s *Service) OnFinish() {
+	s.stopSaving()
+	if s.config().StateFile != "" {
+		s.save()
+	}
+
+	s.rwm.Lock()
+	defer s.rwm.Unlock()
+	if err := s.backend.Close(); err != nil {
+		logger.All().WarnWithErr(err, "storage service can't close connections")
+	}
+	s.backend = s.memory
+}
+
+// Add прибавляет delta к счетчику и отдает новое значение счетчика
+func (s *Service) Add(key string, delta int64, ttl time.Duration) (int64, error) {
+	backend, key := s.get(key)
+	value, err := backend.Add(key, delta, ttl)
+	if err != nil {
+		s.warn(err)
+		return s.memory.Add(key, delta, ttl)
+	}
+	return value, nil
+}
+
+// Get отдает значение счетчика
+func (s *Service) Get(key string) (int64, error) {
+	backend, key := s.get(key)
+	value, err := backend.Get(key)
+	if err != nil {
+		s.warn(err)
+		return s.memory.Get(key)
+	}
+	return value, nil
+}
+
+// Take забирает токен из корзины токенов
+func (s *Service) Take(key string, now time.Time, interval time.Duration, burst int64, hold time.Duration) (time.Duration, bool, error) {
+	backend, key := s.get(key)
+	wait, ok, err := backend.Take(key, now, interval, burst, hold)
+	if err != nil {
+		s.warn(err)
+		return s.memory.Take(key, now, interval, burst, hold)
+	}
+	return wait, ok, nil
+}
+
+// Put возвращает токен в корзину токенов
+func (s *Service) Put(key string, interval time.Duration) error {
+	backend, key := s.get(key)
+	if err := backend.Put(key, interval); err != nil {
+		s.warn(err)
+		return s.memory.Put(key, interval)
+	}
+	return nil
+}
+
+// Push добавляет событие в журнал скользящего окна
+func (s *Service) Push(key, member string, now time.Time, window time.Duration, limit int64) (time.Duration, bool, error) {
+	backend, key := s.get(key)
+	wait, ok, err := backend.Push(key, member, now, window, limit)
+	if err != nil {
+		s.warn(err)
+		return s.memory.Push(key, member, now, window, limit)
+	}
+	return wait, ok, nil
+}
+
+// Remove удаляет событие из журнала скользящего окна
+func (s *Service) Remove(key, member string) error {
+	backend, key := s.get(key)
+	if err := backend.Remove(key, member); err != nil {
+		s.warn(err)
+		return s.memory.Remove(key, member)
+	}
+	return nil
+}
+
+// Close закрывает соединения с общим хранилищем
+func (s *Service) Close() error {
+	s.OnFinish()
+	return nil
+}
+
+// отдает текущие настройки
+func (s *Service) config() Config {
+	s.rwm.RLock()
+	defer s.rwm.RUnlock()
+	return s.Config
+}
+
+// отдает текущее хранилище и ключ с префиксом
+func (s *Service) get(key string) (Storage, string) {
+	s.rwm.RLock()
+	defer s.rwm.RUnlock()
+	return s.backend, s.Config.Prefix + ":" + key
+}
+
+// сохраняет счетчики из памяти процесса в файл
+func (s *Service) save() {
+	stateFile := s.config().StateFile
+	if err := s.memory.Save(stateFile); err != nil {
+		logger.All().WarnWithErr(err, "storage service can't save state to %s", stateFile)
+	}
+}
+
+// пишет в лог ошибку общего хранилища, пока хранилище недоступно, ошибки не пишутся
+func (s *Service) warn(err error) {
+	if errors.Is(err, ErrStorageDown) {
+		return
+	}
+	logger.All().WarnWithErr(err, "storage service can't use shared storage, counters are stored in memory until it is available")
+}
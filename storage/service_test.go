@@ -0,0 +1,138 @@
+package storage
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/Halfi/postmanq/common"
+)
+
+// создает сервис с общим хранилищем на fakeRedis
+func newTestService(t *testing.T, f *fakeRedis) (*Service, *Redis) {
+	r, err := NewRedis(f.uri(), 2, 100*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Service{Config: Config{Prefix: "test"}, memory: NewMemory(), backend: r}, r
+}
+
+func TestServiceFallback(t *testing.T) {
+	cases := []struct {
+		name string
+		down bool
+		// ожидаемые значения счетчика в общем хранилище и в памяти
+		shared int64
+		memory int64
+	}{
+		{name: "available", shared: 2},
+		{name: "down", down: true, memory: 2},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			f := newFakeRedis(t)
+			f.setDown(c.down)
+			s, r := newTestService(t, f)
+			defer r.Close()
+
+			for i := 0; i < 2; i++ {
+				if _, err := s.Add("counter", 1, time.Minute); err != nil {
+					t.Fatalf("service should fall back to memory: %v", err)
+				}
+			}
+
+			value, err := s.Get("counter")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if expected := c.shared + c.memory; value != expected {
+				t.Errorf("expected %d, got %d", expected, value)
+			}
+			if memory, _ := s.memory.Get("test:counter"); memory != c.memory {
+				t.Errorf("expected %d in memory, got %d", c.memory, memory)
+			}
+		})
+	}
+}
+
+func TestRedisBreaker(t *testing.T) {
+	f := newFakeRedis(t)
+	f.setDown(true)
+	s, r := newTestService(t, f)
+	defer r.Close()
+
+	// пока хранилище недоступно, соединение не открывается на каждое обращение
+	for i := 0; i < 10; i++ {
+		if _, _, err := s.Take("bucket", time.Now(), time.Second, 10, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if accepts := f.accepted(); accepts != 1 {
+		t.Fatalf("expected one connection attempt, got %d", accepts)
+	}
+	if _, err := r.Get("key"); !errors.Is(err, ErrStorageDown) {
+		t.Fatalf("expected ErrStorageDown, got %v", err)
+	}
+
+	// неудачная попытка после ожидания удваивает время ожидания
+	r.mutex.Lock()
+	r.retryAt = time.Now()
+	r.mutex.Unlock()
+	if _, err := r.Get("key"); err == nil || errors.Is(err, ErrStorageDown) {
+		t.Fatalf("expected connection error, got %v", err)
+	}
+	if r.backoff != 2*minBackoff {
+		t.Errorf("expected backoff %v, got %v", 2*minBackoff, r.backoff)
+	}
+
+	// после восстановления хранилища первая попытка возвращает счетчики в общее хранилище
+	f.setDown(false)
+	r.mutex.Lock()
+	r.retryAt = time.Now()
+	r.mutex.Unlock()
+	if _, err := s.Add("counter", 1, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if value, _ := s.memory.Get("test:counter"); value != 0 {
+		t.Errorf("counter should be stored in shared storage, got %d in memory", value)
+	}
+	if !r.retryAt.IsZero() || r.backoff != 0 {
+		t.Errorf("breaker should be closed, retry at %v, backoff %v", r.retryAt, r.backoff)
+	}
+}
+
+func TestServiceReconfigure(t *testing.T) {
+	f := newFakeRedis(t)
+	s := &Service{memory: NewMemory()}
+	s.backend = s.memory
+	s.Config.init()
+
+	cases := []struct {
+		name    string
+		data    string
+		changed bool
+		redis   bool
+	}{
+		{name: "redis", data: "storage:\n  uri: " + f.uri() + "\n", changed: true, redis: true},
+		{name: "same config", data: "storage:\n  uri: " + f.uri() + "\n", redis: true},
+		{name: "memory", data: "storage: {}\n", changed: true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			previous, _ := s.get("key")
+			s.OnReconfigure(&common.ApplicationEvent{Kind: common.ReconfigureApplicationEventKind, Data: []byte(c.data)})
+			backend, key := s.get("key")
+			if changed := backend != previous; changed != c.changed {
+				t.Errorf("expected backend change %v", c.changed)
+			}
+			if _, ok := backend.(*Redis); ok != c.redis {
+				t.Errorf("unexpected backend %T", backend)
+			}
+			if key != "postmanq:key" {
+				t.Errorf("unexpected key %s", key)
+			}
+		})
+	}
+}
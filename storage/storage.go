@@ -0,0 +1,54 @@
+package storage
+
+import (
+	"time"
+)
+
+// Storage хранилище счетчиков, позволяет нескольким экземплярам приложения соблюдать общие ограничения
+type Storage interface {
+	// Add прибавляет delta к счетчику и отдает новое значение счетчика
+	// новый счетчик удаляется через ttl после создания
+	Add(key string, delta int64, ttl time.Duration) (int64, error)
+
+	// Get отдает значение счетчика, если счетчика нет, отдает 0
+	Get(key string) (int64, error)
+
+	// Take забирает токен из корзины токенов, которая пополняется одним токеном за interval и вмещает burst токенов
+	// если токен появится не позже, чем через hold, резервирует его и отдает время ожидания
+	// если токен появится позже, отдает время ожидания и false
+	Take(key string, now time.Time, interval time.Duration, burst int64, hold time.Duration) (time.Duration, bool, error)
+
+	// Put возвращает токен в корзину токенов
+	Put(key string, interval time.Duration) error
+
+	// Push добавляет событие в журнал скользящего окна, если за последние window в журнале меньше limit событий
+	// если событий уже limit, отдает время, через которое самое старое событие выйдет из окна, и false
+	Push(key, member string, now time.Time, window time.Duration, limit int64) (time.Duration, bool, error)
+
+	// Remove удаляет событие из журнала скользящего окна
+	Remove(key, member string) error
+
+	// Close закрывает соединения с хранилищем
+	Close() error
+}
+
+// корзина токенов хранится как теоретическое время прихода следующего письма в микросекундах (алгоритм GCRA)
+// письмо можно отправить, если до этого времени осталось не больше, чем время пополнения burst - 1 токенов
+func gcra(tat, now, interval, burst, hold int64) (int64, int64, bool) {
+	if tat < now {
+		tat = now
+	}
+
+	wait := tat - (burst-1)*interval - now
+	if wait > hold {
+		return tat, wait, false
+	}
+	if wait < 0 {
+		wait = 0
+	}
+	return tat + interval, wait, true
+}
+
+func micros(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Microsecond)
+}
@@ -0,0 +1,106 @@
+package webservice
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/Halfi/postmanq/common"
+	"github.com/Halfi/postmanq/logger"
+)
+
+const (
+	// префикс путей api администрирования
+	adminPrefix = "/admin"
+
+	bearerPrefix = "Bearer "
+)
+
+// api администрирования, обработчики регистрируют сервисы, поэтому обработчик ищется при каждом запросе
+type admin struct {
+	token string
+}
+
+func (a *admin) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !a.authorized(r) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="postmanq"`)
+		writeJSON(w, http.StatusUnauthorized, errorResponse{Error: "unauthorized"})
+		return
+	}
+
+	handlers := common.AdminHandlers()
+	path := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, adminPrefix), "/")
+	if path == common.EmptyStr {
+		writeJSON(w, http.StatusOK, index(handlers))
+		return
+	}
+
+	methods, ok := handlers[path]
+	if !ok {
+		writeJSON(w, http.StatusNotFound, errorResponse{Error: "not found"})
+		return
+	}
+	handler, ok := methods[r.Method]
+	if !ok {
+		w.Header().Set("Allow", strings.Join(sortedMethods(methods), ", "))
+		writeJSON(w, http.StatusMethodNotAllowed, errorResponse{Error: "method not allowed"})
+		return
+	}
+
+	response, err := handler(r)
+	if err != nil {
+		status := http.StatusInternalServerError
+		var adminErr *common.AdminError
+		if errors.As(err, &adminErr) {
+			status = adminErr.Status
+		}
+		writeJSON(w, status, errorResponse{Error: err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, response)
+}
+
+// проверяет токен из заголовка Authorization
+func (a *admin) authorized(r *http.Request) bool {
+	header := r.Header.Get("Authorization")
+	if !strings.HasPrefix(header, bearerPrefix) {
+		return false
+	}
+	token := strings.TrimPrefix(header, bearerPrefix)
+	return subtle.ConstantTimeCompare([]byte(token), []byte(a.token)) == 1
+}
+
+// ошибка api администрирования
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+// отдает пути api администрирования и их методы
+func index(handlers map[string]map[string]common.AdminHandler) map[string][]string {
+	paths := make(map[string][]string, len(handlers))
+	for path, methods := range handlers {
+		paths[adminPrefix+path] = sortedMethods(methods)
+	}
+	return paths
+}
+
+func sortedMethods(methods map[string]common.AdminHandler) []string {
+	names := make([]string, 0, len(methods))
+	for method := range methods {
+		names = append(names, method)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// выводит ответ в json
+func writeJSON(w http.ResponseWriter, status int, response interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		logger.All().ErrWithErr(err, "web service can't write response")
+	}
+}
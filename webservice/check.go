@@ -0,0 +1,29 @@
+package webservice
+
+import (
+	"net"
+	"strconv"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/Halfi/postmanq/common"
+)
+
+// OnCheck проверяет адрес веб сервера
+func (s *service) OnCheck(event *common.ApplicationEvent) []error {
+	service := new(service)
+	if err := yaml.Unmarshal(event.Data, service); err != nil {
+		return []error{err}
+	}
+
+	errs := make([]error, 0)
+	if service.WSAddr != common.EmptyStr {
+		_, port, err := net.SplitHostPort(service.WSAddr)
+		if err != nil {
+			errs = append(errs, common.NewConfigError("wsAddr", "%v", err))
+		} else if number, err := strconv.Atoi(port); err != nil || number < 0 || number > 65535 {
+			errs = append(errs, common.NewConfigError("wsAddr", "wrong port %q", port))
+		}
+	}
+	return errs
+}
@@ -6,6 +6,7 @@ import (
 	stdLog "log"
 	"net/http"
 	"net/http/pprof"
+	"sync"
 	"time"
 
 	"github.com/alexliesenfeld/health"
@@ -23,7 +24,12 @@ type service struct {
 	Debug  bool   `yaml:"debug"`
 	WSAddr string `yaml:"wsAddr"`
 
+	// AdminToken токен api администрирования, если не указан, api администрирования отключено
+	AdminToken string `yaml:"adminToken"`
+
+	// маршруты заменяются при переконфигурации, сервер при этом продолжает работать
 	routes *http.ServeMux
+	rwm    sync.RWMutex
 	server *http.Server
 }
 
@@ -31,19 +37,54 @@ func Inst() common.SendingService {
 	return new(service)
 }
 
+// разбирает настройки веб сервиса
+func parseConfig(data []byte) (*service, error) {
+	config := new(service)
+	err := yaml.Unmarshal(data, config)
+	if config.WSAddr == "" {
+		config.WSAddr = defaultWSAddr
+	}
+	return config, err
+}
+
 func (s *service) OnInit(event *common.ApplicationEvent) {
-	err := yaml.Unmarshal(event.Data, s)
+	config, err := parseConfig(event.Data)
 	if err != nil {
-		logger.All().ErrWithErr(err, "can't unmarshal logger config")
+		logger.All().ErrWithErr(err, "can't unmarshal webservice config")
 	}
 
-	if s.WSAddr == "" {
-		s.WSAddr = defaultWSAddr
+	s.apply(config)
+	s.server = &http.Server{
+		Addr:     s.WSAddr,
+		Handler:  s,
+		ErrorLog: stdLog.New(log.Logger, "", stdLog.Llongfile),
+	}
+}
+
+// OnReconfigure заменяет маршруты работающего сервера, сервер перезапускается, только если изменился адрес
+// поэтому запрос к api администрирования, перечитывающий настройки, не обрывается остановкой сервера
+func (s *service) OnReconfigure(event *common.ApplicationEvent) {
+	config, err := parseConfig(event.Data)
+	if err != nil {
+		logger.All().ErrWithErr(err, "can't unmarshal webservice config, current config is used")
+		return
+	}
+
+	if config.WSAddr != s.WSAddr {
+		s.OnFinish()
+		s.OnInit(event)
+		s.OnRun()
+		return
 	}
+	s.apply(config)
+	logger.All().Debug("web server apply new config")
+}
 
-	s.routes = http.NewServeMux()
+// применяет настройки и создает маршруты
+func (s *service) apply(config *service) {
+	routes := http.NewServeMux()
 
-	if s.Debug {
+	if config.Debug {
 		for n, f := range map[string]func(http.ResponseWriter, *http.Request){
 			"/debug/pprof/":        pprof.Index,
 			"/debug/pprof/cmdline": pprof.Cmdline,
@@ -51,34 +92,73 @@ func (s *service) OnInit(event *common.ApplicationEvent) {
 			"/debug/pprof/symbol":  pprof.Symbol,
 			"/debug/pprof/trace":   pprof.Trace,
 		} {
-			s.routes.HandleFunc(n, f)
+			routes.HandleFunc(n, f)
 		}
 	}
 
-	checker := health.NewChecker(
-		health.WithCacheDuration(1*time.Second),
-		health.WithTimeout(10*time.Second),
-	)
-	s.routes.Handle("/health", health.NewHandler(checker))
+	routes.Handle("/health/live", healthHandler(common.LivenessProbe))
+	routes.Handle("/health/ready", healthHandler(common.ReadinessProbe))
+	routes.Handle("/health", healthHandler(common.LivenessProbe, common.ReadinessProbe))
 
-	s.routes.Handle("/metrics", promhttp.Handler())
+	routes.Handle("/metrics", promhttp.Handler())
+	routes.HandleFunc("/config/reload", reloadStatus)
+	if config.AdminToken != common.EmptyStr {
+		handler := &admin{token: config.AdminToken}
+		routes.Handle(adminPrefix, handler)
+		routes.Handle(adminPrefix+"/", handler)
+	}
 
-	s.server = &http.Server{
-		Addr:     s.WSAddr,
-		Handler:  s.routes,
-		ErrorLog: stdLog.New(log.Logger, "", stdLog.Llongfile),
+	s.rwm.Lock()
+	defer s.rwm.Unlock()
+	s.Debug = config.Debug
+	s.WSAddr = config.WSAddr
+	s.AdminToken = config.AdminToken
+	s.routes = routes
+}
+
+// передает запрос текущим маршрутам
+func (s *service) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.rwm.RLock()
+	routes := s.routes
+	s.rwm.RUnlock()
+	routes.ServeHTTP(w, r)
+}
+
+// отдает результат последнего перечитывания настроек
+func reloadStatus(w http.ResponseWriter, _ *http.Request) {
+	status := common.LastReloadStatus()
+	if status == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
 	}
+	writeJSON(w, http.StatusOK, status)
 }
 
 func (s *service) Event(_ *common.SendEvent) bool {
 	return true
 }
 
+// создает обработчик, выполняющий проверки состояния указанных видов,
+// если хотя бы одна проверка не прошла, отдается код 503 и ошибки проверок
+func healthHandler(probes ...common.HealthProbe) http.Handler {
+	options := []health.CheckerOption{
+		health.WithCacheDuration(1 * time.Second),
+		health.WithTimeout(10 * time.Second),
+	}
+	for _, probe := range probes {
+		for name, check := range common.HealthChecks(probe) {
+			options = append(options, health.WithCheck(health.Check{Name: name, Check: check}))
+		}
+	}
+	return health.NewHandler(health.NewChecker(options...))
+}
+
 func (s *service) OnRun() {
+	// при переконфигурации сервер создается заново, поэтому горутина работает со своим сервером
+	server := s.server
 	go func() {
-		logger.All().Debug("web server has been started on addr %s successful", s.WSAddr)
-		err := s.server.ListenAndServe()
-		s.server = nil
+		logger.All().Debug("web server has been started on addr %s successful", server.Addr)
+		err := server.ListenAndServe()
 		if errors.Is(err, http.ErrServerClosed) {
 			err = nil
 		}